@@ -0,0 +1,113 @@
+package cardnumber
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultBINRange = "400000-400999"
+	DefaultLength = 16
+)
+
+/*
+	Generator creates card numbers made of
+	- a BIN (issuer identification number) picked from a configured range
+	- random digits from crypto/rand
+	- a Luhn check digit
+ */
+type Generator struct {
+	binLow		int64
+	binHigh		int64
+	binDigits	int
+	length		int
+}
+
+/*
+	Creates a generator for binRange, either a single BIN like "400000"
+	or an inclusive range of BINs with the same number of digits like "400000-400999"
+ */
+func NewGenerator(binRange string, length int) (*Generator, error) {
+	bounds := strings.SplitN(binRange, "-", 2)
+	if len(bounds) == 1 {
+		bounds = append(bounds, bounds[0])
+	}
+	low, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BIN range %q: %v", binRange, err)
+	}
+	high, err := strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BIN range %q: %v", binRange, err)
+	}
+	if len(bounds[0]) != len(bounds[1]) || low > high || low <= 0 {
+		return nil, fmt.Errorf("invalid BIN range %q", binRange)
+	}
+	if length <= len(bounds[0]) + 1 {
+		return nil, fmt.Errorf("card numbers of length %d are too short for BIN range %q", length, binRange)
+	}
+	return &Generator{
+		binLow: low,
+		binHigh: high,
+		binDigits: len(bounds[0]),
+		length: length,
+	}, nil
+}
+
+// A generator for the default BIN range and length
+func Default() *Generator {
+	g, _ := NewGenerator(DefaultBINRange, DefaultLength)
+	return g
+}
+
+func (g *Generator) Generate() (string, error) {
+	bin, err := rand.Int(rand.Reader, big.NewInt(g.binHigh - g.binLow + 1))
+	if err != nil {
+		return "", err
+	}
+	number := make([]byte, 0, g.length)
+	number = append(number, fmt.Sprintf("%0*d", g.binDigits, bin.Int64() + g.binLow)...)
+	for len(number) < g.length - 1 {
+		digit, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		number = append(number, byte('0' + digit.Int64()))
+	}
+	number = append(number, checkDigit(string(number)))
+	return string(number), nil
+}
+
+// Reports whether number is all digits and passes the Luhn check
+func Valid(number string) bool {
+	if len(number) < 2 {
+		return false
+	}
+	for _, r := range number {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return checkDigit(number[:len(number) - 1]) == number[len(number) - 1]
+}
+
+// The Luhn check digit to append to partial
+func checkDigit(partial string) byte {
+	sum := 0
+	double := true
+	for i := len(partial) - 1; i >= 0; i-- {
+		digit := int(partial[i] - '0')
+		if double {
+			digit = digit * 2
+			if digit > 9 {
+				digit = digit - 9
+			}
+		}
+		sum = sum + digit
+		double = !double
+	}
+	return byte('0' + (10 - sum % 10) % 10)
+}
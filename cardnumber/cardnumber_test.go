@@ -0,0 +1,63 @@
+package cardnumber
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestValid(t *testing.T) {
+	cases := map[string]bool{
+		"4111111111111111": true,
+		"79927398713": true,
+		"4000001234567899": true,
+		"4111111111111112": false,
+		"79927398710": false,
+		"4111 1111 1111 1111": false,
+		"411111111111111a": false,
+		"0": false,
+		"": false,
+	}
+	for number, valid := range cases {
+		if Valid(number) != valid {
+			t.Errorf("Valid(%q) = %v, expected %v", number, !valid, valid)
+		}
+	}
+}
+
+// Generated numbers have the configured length, a BIN in range and a valid check digit
+func TestGenerate(t *testing.T) {
+	g, err := NewGenerator("400100-400199", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		number, err := g.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(number) != 16 || !Valid(number) {
+			t.Fatalf("generated invalid card number %q", number)
+		}
+		if bin, _ := strconv.Atoi(number[:6]); bin < 400100 || bin > 400199 {
+			t.Fatalf("generated card number %q outside the BIN range", number)
+		}
+	}
+}
+
+func TestNewGenerator(t *testing.T) {
+	valid := []string{"400000", "400000-400999", "000001-000009"}
+	for _, binRange := range valid {
+		if _, err := NewGenerator(binRange, DefaultLength); err != nil {
+			t.Errorf("BIN range %q was rejected: %v", binRange, err)
+		}
+	}
+	invalid := []string{"", "abc", "400999-400000", "40000-400999", "000000", "400000-"}
+	for _, binRange := range invalid {
+		if _, err := NewGenerator(binRange, DefaultLength); err == nil {
+			t.Errorf("BIN range %q was accepted", binRange)
+		}
+	}
+	if _, err := NewGenerator("400000", 7); err == nil {
+		t.Errorf("length 7 was accepted for a 6 digit BIN")
+	}
+}
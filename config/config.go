@@ -0,0 +1,250 @@
+package config
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"prepaidcard/cardnumber"
+	"prepaidcard/mcc"
+	"prepaidcard/models"
+	"strings"
+	"time"
+)
+
+/*
+	Config is everything the app can be configured with.
+	Values are taken from, in increasing order of precedence, the defaults, a YAML or JSON config file,
+	environment variables and command line flags, see Load.
+ */
+type Config struct {
+	Database	Database	`yaml:"database"`
+	Server		Server		`yaml:"server"`
+	Log			Log			`yaml:"log"`
+	Cards		Cards		`yaml:"cards"`
+	Auth		Auth		`yaml:"auth"`
+	Capture		Capture		`yaml:"capture"`
+	FX			FX			`yaml:"fx"`
+	// A fixture of merchants and cards to load on start
+	Seed		string		`yaml:"seed"`
+	// Whatever is left on the command line after the flags
+	Args		[]string	`yaml:"-"`
+}
+
+/*
+	Database holds the connection settings for the datastore.
+	DSN, when set, is used as it is instead of the individual postgres settings or the sqlite path.
+ */
+type Database struct {
+	Type		string	`yaml:"type"`
+	DSN			string	`yaml:"dsn"`
+	Host		string	`yaml:"host"`
+	Port		int		`yaml:"port"`
+	User		string	`yaml:"user"`
+	Password	string	`yaml:"password"`
+	Name		string	`yaml:"name"`
+	SSLMode		string	`yaml:"sslmode"`
+	Path		string	`yaml:"path"`
+	// How long a request's database work may take before it is cancelled
+	Timeout		time.Duration	`yaml:"timeout"`
+}
+
+type Server struct {
+	Addr			string			`yaml:"addr"`
+	ReadTimeout		time.Duration	`yaml:"read_timeout"`
+	WriteTimeout	time.Duration	`yaml:"write_timeout"`
+	IdleTimeout		time.Duration	`yaml:"idle_timeout"`
+	// How long in-flight requests get to finish after SIGTERM
+	ShutdownTimeout	time.Duration	`yaml:"shutdown_timeout"`
+	// Needed as a bearer token to reveal full card numbers, which is disabled when empty
+	PANRevealToken	string			`yaml:"pan_reveal_token"`
+	// How long an idempotency key stays claimed by a request that never finishes before a retry can take it over
+	IdempotencyClaimTTL	time.Duration	`yaml:"idempotency_claim_ttl"`
+}
+
+type Log struct {
+	Level	string	`yaml:"level"`
+}
+
+type Cards struct {
+	BINRange	string	`yaml:"bin_range"`
+}
+
+type Auth struct {
+	Lifetime		time.Duration				`yaml:"lifetime"`
+	// Lifetimes by MCC or MCC group, see models.AuthExpiryPolicy
+	LifetimeByMCC	map[string]time.Duration	`yaml:"lifetime_by_mcc"`
+	// How often the expiry worker looks for expired auths
+	ExpiryInterval	time.Duration				`yaml:"expiry_interval"`
+}
+
+type Capture struct {
+	// How far captures may go over the auth by MCC or MCC group, see models.OverCapturePolicy
+	OverCaptureByMCC	map[string]models.OverCaptureRule	`yaml:"over_capture_by_mcc"`
+}
+
+type FX struct {
+	RatesFile	string	`yaml:"rates_file"`
+}
+
+const (
+	DatabasePostgres = "postgres"
+	DatabaseSQLite = "sqlite"
+	DatabaseMemory = "memory"
+)
+
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+func Default() *Config {
+	return &Config{
+		Database: Database{
+			Type: DatabasePostgres,
+			Host: "localhost",
+			Port: 5432,
+			User: "postgres",
+			Name: "postgres",
+			SSLMode: "disable",
+			Path: "prepaidcard.db",
+			Timeout: 5 * time.Second,
+		},
+		Server: Server{
+			Addr: ":8080",
+			ReadTimeout: 10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			IdleTimeout: 2 * time.Minute,
+			ShutdownTimeout: 30 * time.Second,
+			IdempotencyClaimTTL: time.Minute,
+		},
+		Log: Log{Level: "info"},
+		Cards: Cards{BINRange: cardnumber.DefaultBINRange},
+		Auth: Auth{
+			Lifetime: models.DefaultAuthLifetime,
+			LifetimeByMCC: make(map[string]time.Duration),
+			ExpiryInterval: time.Minute,
+		},
+		Capture: Capture{OverCaptureByMCC: models.DefaultOverCaptureRules()},
+	}
+}
+
+// The connection string for the datastore's driver, empty for the memory store
+func (d Database) ConnString() string {
+	if d.DSN != "" || d.Type == DatabaseMemory {
+		return d.DSN
+	}
+	if d.Type == DatabaseSQLite {
+		return d.Path
+	}
+	parts := []string{
+		"host=" + quote(d.Host),
+		fmt.Sprintf("port=%d", d.Port),
+		"user=" + quote(d.User),
+		"dbname=" + quote(d.Name),
+		"sslmode=" + quote(d.SSLMode),
+	}
+	if d.Password != "" {
+		parts = append(parts, "password=" + quote(d.Password))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Quotes a value for a postgres key=value connection string
+func quote(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
+func (a Auth) Policy() models.AuthExpiryPolicy {
+	return models.AuthExpiryPolicy{Default: a.Lifetime, ByMCC: a.LifetimeByMCC}
+}
+
+func (c Capture) Policy() *models.OverCapturePolicy {
+	return &models.OverCapturePolicy{ByMCC: c.OverCaptureByMCC}
+}
+
+// Every problem with the configuration, reported together so they can all be fixed at once
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e, "\n  - ")
+}
+
+func (c *Config) validate() ValidationError {
+	var problems ValidationError
+	d := c.Database
+	switch d.Type {
+	case DatabasePostgres:
+		if d.DSN == "" {
+			if d.Host == "" {
+				problems = append(problems, "database host is required for postgres")
+			}
+			if d.Port <= 0 || d.Port > 65535 {
+				problems = append(problems, fmt.Sprintf("database port %d is out of range", d.Port))
+			}
+			if d.User == "" {
+				problems = append(problems, "database user is required for postgres")
+			}
+			if d.Name == "" {
+				problems = append(problems, "database name is required for postgres")
+			}
+			if !contains(sslModes, d.SSLMode) {
+				problems = append(problems, fmt.Sprintf("database sslmode %q must be one of %s", d.SSLMode, strings.Join(sslModes, ", ")))
+			}
+		}
+	case DatabaseSQLite:
+		if d.DSN == "" && d.Path == "" {
+			problems = append(problems, "database path is required for sqlite")
+		}
+	case DatabaseMemory:
+	default:
+		problems = append(problems, fmt.Sprintf("database type %q must be postgres, sqlite or memory", d.Type))
+	}
+	if c.Server.Addr == "" {
+		problems = append(problems, "server listen address is required")
+	}
+	if c.Server.ReadTimeout < 0 || c.Server.WriteTimeout < 0 || c.Server.IdleTimeout < 0 || c.Server.ShutdownTimeout < 0 {
+		problems = append(problems, "server timeouts can't be negative")
+	}
+	if d.Timeout <= 0 {
+		problems = append(problems, "database timeout must be positive")
+	}
+	if c.Server.IdempotencyClaimTTL <= d.Timeout {
+		problems = append(problems, "idempotency claim TTL must be longer than the database timeout")
+	}
+	if _, err := log.ParseLevel(c.Log.Level); err != nil {
+		problems = append(problems, fmt.Sprintf("log level %q is not a valid level", c.Log.Level))
+	}
+	if _, err := cardnumber.NewGenerator(c.Cards.BINRange, cardnumber.DefaultLength); err != nil {
+		problems = append(problems, fmt.Sprintf("card BIN range: %v", err))
+	}
+	if c.Auth.Lifetime <= 0 {
+		problems = append(problems, "auth lifetime must be positive")
+	}
+	for rule, lifetime := range c.Auth.LifetimeByMCC {
+		if !mcc.ValidRule(rule) {
+			problems = append(problems, fmt.Sprintf("auth lifetime by MCC: %q is not an MCC or MCC group", rule))
+		}
+		if lifetime <= 0 {
+			problems = append(problems, fmt.Sprintf("auth lifetime by MCC: lifetime for %q must be positive", rule))
+		}
+	}
+	if c.Auth.ExpiryInterval <= 0 {
+		problems = append(problems, "auth expiry interval must be positive")
+	}
+	for rule, overCapture := range c.Capture.OverCaptureByMCC {
+		if !mcc.ValidRule(rule) {
+			problems = append(problems, fmt.Sprintf("over-capture by MCC: %q is not an MCC or MCC group", rule))
+		}
+		if overCapture.Percent < 0 || overCapture.Max < 0 {
+			problems = append(problems, fmt.Sprintf("over-capture by MCC: the caps for %q can't be negative", rule))
+		}
+	}
+	return problems
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,259 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"prepaidcard/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A setting that can come from both a flag and an environment variable
+type setting struct {
+	flag	string
+	env		string
+	usage	string
+	set		func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"db-type", "DB_TYPE", "datastore: postgres, sqlite or memory", func(c *Config, v string) error {
+		c.Database.Type = v
+		return nil
+	}},
+	{"db-dsn", "DB_DSN", "full connection string, overriding the other database settings", func(c *Config, v string) error {
+		c.Database.DSN = v
+		return nil
+	}},
+	{"db-host", "DB_HOST", "postgres host", func(c *Config, v string) error {
+		c.Database.Host = v
+		return nil
+	}},
+	{"db-port", "DB_PORT", "postgres port", func(c *Config, v string) error {
+		return parseInt(v, &c.Database.Port)
+	}},
+	{"db-user", "DB_USER", "postgres user", func(c *Config, v string) error {
+		c.Database.User = v
+		return nil
+	}},
+	{"db-password", "DB_PASSWORD", "postgres password, prefer the environment variable or config file", func(c *Config, v string) error {
+		c.Database.Password = v
+		return nil
+	}},
+	{"db-name", "DB_NAME", "postgres database name", func(c *Config, v string) error {
+		c.Database.Name = v
+		return nil
+	}},
+	{"db-sslmode", "DB_SSLMODE", "postgres TLS mode: disable, allow, prefer, require, verify-ca or verify-full", func(c *Config, v string) error {
+		c.Database.SSLMode = v
+		return nil
+	}},
+	{"db-path", "DB_PATH", "sqlite database file", func(c *Config, v string) error {
+		c.Database.Path = v
+		return nil
+	}},
+	{"db-timeout", "DB_TIMEOUT", "longest a request's database work can take", func(c *Config, v string) error {
+		return parseDuration(v, &c.Database.Timeout)
+	}},
+	{"listen", "LISTEN_ADDR", "address the API listens on", func(c *Config, v string) error {
+		c.Server.Addr = v
+		return nil
+	}},
+	{"read-timeout", "READ_TIMEOUT", "longest time to read a request", func(c *Config, v string) error {
+		return parseDuration(v, &c.Server.ReadTimeout)
+	}},
+	{"write-timeout", "WRITE_TIMEOUT", "longest time to write a response", func(c *Config, v string) error {
+		return parseDuration(v, &c.Server.WriteTimeout)
+	}},
+	{"idle-timeout", "IDLE_TIMEOUT", "longest time to keep an idle connection open", func(c *Config, v string) error {
+		return parseDuration(v, &c.Server.IdleTimeout)
+	}},
+	{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "how long in-flight requests get to finish on SIGTERM", func(c *Config, v string) error {
+		return parseDuration(v, &c.Server.ShutdownTimeout)
+	}},
+	{"pan-reveal-token", "PAN_REVEAL_TOKEN", "bearer token for revealing full card numbers", func(c *Config, v string) error {
+		c.Server.PANRevealToken = v
+		return nil
+	}},
+	{"idempotency-claim-ttl", "IDEMPOTENCY_CLAIM_TTL", "how long a request that never finishes keeps its idempotency key", func(c *Config, v string) error {
+		return parseDuration(v, &c.Server.IdempotencyClaimTTL)
+	}},
+	{"log-level", "LOG_LEVEL", "debug, info, warning, error, fatal or panic", func(c *Config, v string) error {
+		c.Log.Level = v
+		return nil
+	}},
+	{"card-bin-range", "CARD_BIN_RANGE", "BIN or BIN range new card numbers start with, e.g. 400000-400999", func(c *Config, v string) error {
+		c.Cards.BINRange = v
+		return nil
+	}},
+	{"auth-lifetime", "AUTH_LIFETIME", "how long auths block funds, e.g. 168h", func(c *Config, v string) error {
+		return parseDuration(v, &c.Auth.Lifetime)
+	}},
+	{"auth-lifetime-by-mcc", "AUTH_LIFETIME_BY_MCC", "auth lifetimes by MCC or group, e.g. 7011=720h,travel=720h", func(c *Config, v string) error {
+		return parseLifetimes(v, c.Auth.LifetimeByMCC)
+	}},
+	{"auth-expiry-interval", "AUTH_EXPIRY_INTERVAL", "how often expired auths are released", func(c *Config, v string) error {
+		return parseDuration(v, &c.Auth.ExpiryInterval)
+	}},
+	{"over-capture-by-mcc", "OVER_CAPTURE_BY_MCC", "how far captures may go over the auth by MCC or group, e.g. restaurants=20%,fuel=15%:5000,7011=10000", func(c *Config, v string) error {
+		return parseOverCaptures(v, c.Capture.OverCaptureByMCC)
+	}},
+	{"fx-rates-file", "FX_RATES_FILE", "JSON file of exchange rates", func(c *Config, v string) error {
+		c.FX.RatesFile = v
+		return nil
+	}},
+	{"seed", "SEED_FILE", "YAML or JSON file of merchants and cards to create or update on start", func(c *Config, v string) error {
+		c.Seed = v
+		return nil
+	}},
+}
+
+/*
+	Builds the config from the defaults, then the config file named by --config or CONFIG_FILE,
+	then the environment and finally the flags in args, and validates the result.
+	Bad values are returned together as a ValidationError, and flag.ErrHelp is returned for -h.
+ */
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	flags := flag.NewFlagSet("prepaidcard", flag.ContinueOnError)
+	configFile := flags.String("config", "", "YAML or JSON config file (env CONFIG_FILE)")
+	for _, s := range settings {
+		flags.String(s.flag, "", fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	c := Default()
+	path := *configFile
+	if path == "" {
+		path, _ = lookupEnv("CONFIG_FILE")
+	}
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	var problems ValidationError
+	for _, s := range settings {
+		if value, ok := lookupEnv(s.env); ok && value != "" {
+			if err := s.set(c, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", s.env, err))
+			}
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag != f.Name {
+				continue
+			}
+			if err := s.set(c, f.Value.String()); err != nil {
+				problems = append(problems, fmt.Sprintf("--%s: %v", s.flag, err))
+			}
+		}
+	})
+	c.Args = flags.Args()
+	problems = append(problems, c.validate()...)
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return c, nil
+}
+
+// Reads a config file over c, JSON files work too as YAML is a superset of JSON
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// Maps in the file replace the defaults rather than merging with them, as the env and flags do
+	lifetimes, overCaptures := c.Auth.LifetimeByMCC, c.Capture.OverCaptureByMCC
+	c.Auth.LifetimeByMCC, c.Capture.OverCaptureByMCC = nil, nil
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	if c.Auth.LifetimeByMCC == nil {
+		c.Auth.LifetimeByMCC = lifetimes
+	}
+	if c.Capture.OverCaptureByMCC == nil {
+		c.Capture.OverCaptureByMCC = overCaptures
+	}
+	return nil
+}
+
+func parseInt(value string, dst *int) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", value)
+	}
+	*dst = n
+	return nil
+}
+
+func parseDuration(value string, dst *time.Duration) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a duration like 30s or 72h", value)
+	}
+	*dst = d
+	return nil
+}
+
+// Parses entries like "7011=720h,travel=720h" into lifetimes, replacing any already there
+func parseLifetimes(value string, lifetimes map[string]time.Duration) error {
+	parsed := make(map[string]time.Duration)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("entry %q should look like 7011=720h", pair)
+		}
+		var lifetime time.Duration
+		if err := parseDuration(parts[1], &lifetime); err != nil {
+			return fmt.Errorf("entry %q: %v", pair, err)
+		}
+		parsed[parts[0]] = lifetime
+	}
+	for rule := range lifetimes {
+		delete(lifetimes, rule)
+	}
+	for rule, lifetime := range parsed {
+		lifetimes[rule] = lifetime
+	}
+	return nil
+}
+
+/*
+	Parses entries like "restaurants=20%,fuel=15%:5000,7011=10000" into over-capture rules, replacing any already there
+	A value ending in % is a percentage of the auth and any other an absolute amount, and 0 turns over-capture off.
+ */
+func parseOverCaptures(value string, rules map[string]models.OverCaptureRule) error {
+	parsed := make(map[string]models.OverCaptureRule)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("entry %q should look like restaurants=20%% or fuel=15%%:5000", pair)
+		}
+		var rule models.OverCaptureRule
+		for _, limit := range strings.Split(parts[1], ":") {
+			dst := &rule.Max
+			if strings.HasSuffix(limit, "%") {
+				dst = &rule.Percent
+				limit = strings.TrimSuffix(limit, "%")
+			}
+			n, err := strconv.ParseInt(limit, 10, 64)
+			if err != nil {
+				return fmt.Errorf("entry %q: %q is not a whole number", pair, limit)
+			}
+			*dst = n
+		}
+		parsed[parts[0]] = rule
+	}
+	for rule := range rules {
+		delete(rules, rule)
+	}
+	for name, rule := range parsed {
+		rules[name] = rule
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"prepaidcard/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A lookupEnv over a fixed set of variables
+func env(values map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := values[name]
+		return value, ok
+	}
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Flags win over the environment, which wins over the config file, which wins over the defaults
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+database:
+  type: sqlite
+  path: file.db
+  timeout: 2s
+server:
+  addr: ":9000"
+log:
+  level: warning
+`)
+	c, err := Load([]string{"--db-path", "flag.db", "migrate", "up"}, env(map[string]string{
+		"CONFIG_FILE": path,
+		"DB_PATH": "env.db",
+		"LOG_LEVEL": "error",
+		"LISTEN_ADDR": "",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Database.Path != "flag.db" {
+		t.Errorf("database path is %q, expected the flag's", c.Database.Path)
+	}
+	if c.Log.Level != "error" {
+		t.Errorf("log level is %q, expected the environment's", c.Log.Level)
+	}
+	if c.Database.Type != DatabaseSQLite || c.Database.Timeout != 2 * time.Second || c.Server.Addr != ":9000" {
+		t.Errorf("database %+v and listen address %q don't come from the file", c.Database, c.Server.Addr)
+	}
+	if c.Server.ReadTimeout != Default().Server.ReadTimeout {
+		t.Errorf("read timeout is %s, expected the default", c.Server.ReadTimeout)
+	}
+	if !reflect.DeepEqual(c.Args, []string{"migrate", "up"}) {
+		t.Errorf("arguments after the flags are %v", c.Args)
+	}
+}
+
+// --config wins over CONFIG_FILE, and the defaults are used without either
+func TestLoadConfigFileFlag(t *testing.T) {
+	flagged := writeConfigFile(t, "log:\n  level: debug\n")
+	ignored := writeConfigFile(t, "log:\n  level: warning\n")
+	c, err := Load([]string{"--config", flagged}, env(map[string]string{"CONFIG_FILE": ignored}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Log.Level != "debug" {
+		t.Errorf("log level is %q, expected the --config file's", c.Log.Level)
+	}
+	c, err = Load(nil, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, Default()) {
+		t.Errorf("config without any settings is %+v, expected the defaults", c)
+	}
+}
+
+// Maps from the file or the environment replace the default rules rather than merging with them
+func TestLoadReplacesRuleMaps(t *testing.T) {
+	path := writeConfigFile(t, `
+capture:
+  over_capture_by_mcc:
+    restaurants: {percent: 25}
+`)
+	c, err := Load([]string{"--config", path}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]models.OverCaptureRule{"restaurants": {Percent: 25}}; !reflect.DeepEqual(c.Capture.OverCaptureByMCC, expected) {
+		t.Errorf("over-capture rules from the file are %v, expected %v", c.Capture.OverCaptureByMCC, expected)
+	}
+	c, err = Load(nil, env(map[string]string{
+		"OVER_CAPTURE_BY_MCC": "fuel=15%:5000, 7011=10000",
+		"AUTH_LIFETIME_BY_MCC": "travel=720h",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]models.OverCaptureRule{"fuel": {Percent: 15, Max: 5000}, "7011": {Max: 10000}}; !reflect.DeepEqual(c.Capture.OverCaptureByMCC, expected) {
+		t.Errorf("over-capture rules from the environment are %v, expected %v", c.Capture.OverCaptureByMCC, expected)
+	}
+	if expected := map[string]time.Duration{"travel": 720 * time.Hour}; !reflect.DeepEqual(c.Auth.LifetimeByMCC, expected) {
+		t.Errorf("auth lifetimes from the environment are %v, expected %v", c.Auth.LifetimeByMCC, expected)
+	}
+}
+
+// Every bad value is reported at once
+func TestLoadValidation(t *testing.T) {
+	_, err := Load([]string{"--log-level", "loud"}, env(map[string]string{
+		"DB_TYPE": "mongo",
+		"DB_PORT": "abc",
+		"AUTH_LIFETIME": "a week",
+		"OVER_CAPTURE_BY_MCC": "casinos=10%",
+	}))
+	problems, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("loading bad values returned %v", err)
+	}
+	if len(problems) != 5 {
+		t.Errorf("%d problems were reported, expected 5: %v", len(problems), problems)
+	}
+	if _, err = Load(nil, env(map[string]string{"CONFIG_FILE": writeConfigFile(t, "database:\n  kind: sqlite\n")})); err == nil {
+		t.Errorf("a config file with an unknown field was accepted")
+	}
+	if _, err = Load(nil, env(map[string]string{"CONFIG_FILE": filepath.Join(t.TempDir(), "missing.yaml")})); err == nil {
+		t.Errorf("a missing config file was accepted")
+	}
+}
+
+func TestConnString(t *testing.T) {
+	d := Default().Database
+	d.Password = `it's \ secret`
+	expected := `host='localhost' port=5432 user='postgres' dbname='postgres' sslmode='disable' password='it\'s \\ secret'`
+	if d.ConnString() != expected {
+		t.Errorf("connection string is %s, expected %s", d.ConnString(), expected)
+	}
+	d.DSN = "postgres://elsewhere"
+	if d.ConnString() != d.DSN {
+		t.Errorf("connection string is %s, expected the DSN", d.ConnString())
+	}
+	sqlite := Database{Type: DatabaseSQLite, Path: "cards.db"}
+	if sqlite.ConnString() != "cards.db" {
+		t.Errorf("sqlite connection string is %s", sqlite.ConnString())
+	}
+}
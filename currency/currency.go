@@ -0,0 +1,89 @@
+package currency
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// Cards and merchants are in pounds unless told otherwise
+const Default = "GBP"
+
+// ISO 4217 codes and the number of digits after the decimal point in their minor unit
+var minorUnits = map[string]int{
+	"AUD": 2,
+	"BHD": 3,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"CZK": 2,
+	"DKK": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"HKD": 2,
+	"HUF": 2,
+	"ISK": 0,
+	"JOD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"NOK": 2,
+	"NZD": 2,
+	"OMR": 3,
+	"PLN": 2,
+	"SEK": 2,
+	"SGD": 2,
+	"USD": 2,
+	"ZAR": 2,
+}
+
+func Valid(code string) bool {
+	_, ok := minorUnits[code]
+	return ok
+}
+
+// The number of digits after the decimal point, e.g. 2 for GBP (pence) and 0 for JPY
+func MinorUnits(code string) (int, error) {
+	units, ok := minorUnits[code]
+	if !ok {
+		return 0, fmt.Errorf("unknown currency %s", code)
+	}
+	return units, nil
+}
+
+/*
+	Converts amount in the minor units of from into the minor units of to at rate,
+	rounding half away from zero. e.g. 1000 JPY at 0.0053 is 530 GBP pence.
+ */
+func Convert(amount int64, from string, to string, rate *big.Rat) (int64, error) {
+	fromUnits, err := MinorUnits(from)
+	if err != nil {
+		return 0, err
+	}
+	toUnits, err := MinorUnits(to)
+	if err != nil {
+		return 0, err
+	}
+	value := new(big.Rat).SetInt64(amount)
+	value.Mul(value, rate)
+	value.Mul(value, new(big.Rat).SetFrac(pow10(toUnits), pow10(fromUnits)))
+	return round(value)
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+func round(value *big.Rat) (int64, error) {
+	num := new(big.Int).Abs(value.Num())
+	quotient, remainder := new(big.Int).QuoRem(num, value.Denom(), new(big.Int))
+	if remainder.Mul(remainder, big.NewInt(2)).Cmp(value.Denom()) >= 0 {
+		quotient.Add(quotient, big.NewInt(1))
+	}
+	if value.Sign() < 0 {
+		quotient.Neg(quotient)
+	}
+	if !quotient.IsInt64() {
+		return 0, fmt.Errorf("converted amount %s is too large", quotient)
+	}
+	return quotient.Int64(), nil
+}
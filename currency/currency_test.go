@@ -0,0 +1,50 @@
+package currency
+
+import (
+	"math"
+	"math/big"
+	"testing"
+)
+
+// Conversions scale between minor units and round half away from zero
+func TestConvert(t *testing.T) {
+	cases := []struct {
+		amount		int64
+		from		string
+		to			string
+		rate		string
+		converted	int64
+	}{
+		{1000, "JPY", "GBP", "0.0053", 530},
+		{100, "GBP", "JPY", "187.5", 188},
+		{1234, "KWD", "GBP", "2.5", 309},
+		{1000, "EUR", "GBP", "0.86", 860},
+		{1, "EUR", "GBP", "0.86", 1},
+		{1, "GBP", "EUR", "0.5", 1},
+		{1, "GBP", "EUR", "0.49", 0},
+		{5, "GBP", "EUR", "0.9", 5},
+		{-5, "GBP", "EUR", "0.9", -5},
+		{7, "GBP", "GBP", "1", 7},
+	}
+	for _, c := range cases {
+		rate, _ := new(big.Rat).SetString(c.rate)
+		converted, err := Convert(c.amount, c.from, c.to, rate)
+		if err != nil {
+			t.Errorf("converting %d %s to %s at %s: %v", c.amount, c.from, c.to, c.rate, err)
+		} else if converted != c.converted {
+			t.Errorf("%d %s at %s converted to %d %s, expected %d", c.amount, c.from, c.rate, converted, c.to, c.converted)
+		}
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	if _, err := Convert(100, "XXX", "GBP", big.NewRat(1, 1)); err == nil {
+		t.Error("converting from an unknown currency succeeded")
+	}
+	if _, err := Convert(100, "GBP", "XXX", big.NewRat(1, 1)); err == nil {
+		t.Error("converting to an unknown currency succeeded")
+	}
+	if _, err := Convert(math.MaxInt64, "GBP", "EUR", big.NewRat(2, 1)); err == nil {
+		t.Error("converting to an amount too large for int64 succeeded")
+	}
+}
@@ -0,0 +1,88 @@
+package datastore
+
+import (
+	"prepaidcard/models"
+	"time"
+)
+
+/*
+	Splits a capture into the part covered by what's left of the auth and the part over it
+	The part over, added to what the transaction's earlier captures went over, must be within the merchant's allowance
+	and the card's available balance.
+ */
+func splitCapture(policy *models.OverCapturePolicy, transaction *models.Transaction, merchantMCC string, captures []*models.Capture, card *models.PrepaidCard, amount int64) (int64, int64, error) {
+	if amount <= transaction.AuthorizedAmount {
+		return amount, 0, nil
+	}
+	over := amount - transaction.AuthorizedAmount
+	total := over
+	for _, capture := range captures {
+		total = total + capture.OverCapturedAmount
+	}
+	if total > policy.Allowance(merchantMCC, transaction.OriginalAmount) {
+		return 0, 0, models.OverCaptureExceeded
+	}
+	if over > card.FullBalance - card.BlockedBalance {
+		return 0, 0, models.InvalidCardBalance
+	}
+	return transaction.AuthorizedAmount, over, nil
+}
+
+// The total refunded off the captures
+func refundedTotal(captures []*models.Capture) int64 {
+	var refunded int64
+	for _, capture := range captures {
+		refunded = refunded + capture.RefundedAmount
+	}
+	return refunded
+}
+
+func newCapture(transactionId string, amount int64, final bool) *models.Capture {
+	capture := &models.Capture{
+		TransactionID: transactionId,
+		Amount: amount,
+		Final: final,
+		CreatedAt: time.Now(),
+	}
+	capture.UpdatedAt = capture.CreatedAt
+	capture.ID = newId(capture.CreatedAt).String()
+	return capture
+}
+
+/*
+	Works out how much of a refund comes off each of the transaction's captures, by capture id
+	With a captureId the whole amount comes off that capture, which has to have enough left.
+	Without one it's spread over the captures oldest first, which must be given in order.
+ */
+func allocateRefund(captures []*models.Capture, captureId string, amount int64) (map[string]int64, error) {
+	refunds := make(map[string]int64)
+	if captureId != "" {
+		for _, capture := range captures {
+			if capture.ID != captureId {
+				continue
+			}
+			if amount > capture.Refundable() {
+				return nil, models.InvalidTransactionCaptured
+			}
+			refunds[capture.ID] = amount
+			return refunds, nil
+		}
+		return nil, models.NotFound
+	}
+	left := amount
+	for _, capture := range captures {
+		if left == 0 {
+			break
+		}
+		refund := capture.Refundable()
+		if refund > left {
+			refund = left
+		}
+		refunds[capture.ID] = refund
+		left = left - refund
+	}
+	if left > 0 {
+		return nil, models.InvalidTransactionCaptured
+	}
+	return refunds, nil
+}
@@ -0,0 +1,233 @@
+package datastore
+
+import (
+	"context"
+	"prepaidcard/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The part of a capture over the auth is held to the allowance, counting earlier over-captures, and the card's available balance
+func TestSplitCapture(t *testing.T) {
+	policy := &models.OverCapturePolicy{ByMCC: models.DefaultOverCaptureRules()}
+	transaction := &models.Transaction{OriginalAmount: 1000, AuthorizedAmount: 400}
+	card := &models.PrepaidCard{FullBalance: 2000, BlockedBalance: 1500}
+	earlier := []*models.Capture{{Amount: 650, OverCapturedAmount: 50}}
+	cases := []struct {
+		mcc			string
+		captures	[]*models.Capture
+		amount		int64
+		authorized	int64
+		over		int64
+		err			error
+	}{
+		{"5411", nil, 400, 400, 0, nil},
+		{"5411", nil, 100, 100, 0, nil},
+		{"5411", nil, 401, 0, 0, models.OverCaptureExceeded},
+		{"5812", nil, 550, 400, 150, nil},
+		{"5812", earlier, 550, 400, 150, nil},
+		{"5812", earlier, 551, 0, 0, models.OverCaptureExceeded},
+		{"5812", nil, 600, 400, 200, nil},
+		{"5812", nil, 601, 0, 0, models.OverCaptureExceeded},
+	}
+	for _, c := range cases {
+		authorized, over, err := splitCapture(policy, transaction, c.mcc, c.captures, card, c.amount)
+		if authorized != c.authorized || over != c.over || err != c.err {
+			t.Errorf("capture of %d at %s split into %d and %d, %v, expected %d and %d, %v", c.amount, c.mcc, authorized, over,
+				err, c.authorized, c.over, c.err)
+		}
+	}
+	// Only 100 is available on the card
+	poorer := &models.PrepaidCard{FullBalance: 2000, BlockedBalance: 1900}
+	if _, _, err := splitCapture(policy, transaction, "5812", nil, poorer, 600); err != models.InvalidCardBalance {
+		t.Errorf("over-capture beyond the available balance returned %v", err)
+	}
+}
+
+func TestAllocateRefund(t *testing.T) {
+	captures := []*models.Capture{
+		{ID: "first", Amount: 300, RefundedAmount: 100},
+		{ID: "second", Amount: 200},
+		{ID: "third", Amount: 500},
+	}
+	cases := []struct {
+		captureId	string
+		amount		int64
+		refunds		map[string]int64
+		err			error
+	}{
+		{"", 150, map[string]int64{"first": 150}, nil},
+		{"", 200, map[string]int64{"first": 200}, nil},
+		{"", 300, map[string]int64{"first": 200, "second": 100}, nil},
+		{"", 900, map[string]int64{"first": 200, "second": 200, "third": 500}, nil},
+		{"", 901, nil, models.InvalidTransactionCaptured},
+		{"third", 500, map[string]int64{"third": 500}, nil},
+		{"first", 201, nil, models.InvalidTransactionCaptured},
+		{"fourth", 1, nil, models.NotFound},
+	}
+	for _, c := range cases {
+		refunds, err := allocateRefund(captures, c.captureId, c.amount)
+		if err != c.err || !reflect.DeepEqual(refunds, c.refunds) {
+			t.Errorf("refund of %d off %q allocated %v, %v, expected %v, %v", c.amount, c.captureId, refunds, err, c.refunds, c.err)
+		}
+	}
+}
+
+/*
+	Partial captures each take their part of the auth until a final one releases the rest,
+	and refunds come off a given capture or off the captures oldest first
+ */
+func TestCapturesAndRefunds(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			card, err := store.CreateCard(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.LoadCard(ctx, card.ID, 10000); err != nil {
+				t.Fatal(err)
+			}
+			merchant, err := store.CreateMerchant(ctx, &models.Merchant{Name: "Corner Shop", MCC: "5411", Address: "High Street"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			transaction, err := store.Auth(ctx, card, merchant, 1000, "", time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			first, err := store.Capture(ctx, transaction, 300, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if transaction.Status != models.TransactionPartiallyCaptured || transaction.AuthorizedAmount != 700 {
+				t.Errorf("transaction is %s with %d authorized after a partial capture", transaction.Status, transaction.AuthorizedAmount)
+			}
+			second, err := store.Capture(ctx, transaction, 200, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if transaction.Status != models.TransactionCaptured || transaction.AuthorizedAmount != 0 || transaction.CapturedAmount != 500 {
+				t.Errorf("transaction is %s with %d authorized and %d captured after the final capture", transaction.Status,
+					transaction.AuthorizedAmount, transaction.CapturedAmount)
+			}
+			if _, err = store.Capture(ctx, transaction, 100, false); err != models.TransactionFullyCaptured {
+				t.Errorf("capturing after the final capture returned %v", err)
+			}
+
+			if err = store.Refund(ctx, transaction, second.ID, 150); err != nil {
+				t.Fatal(err)
+			}
+			if err = store.Refund(ctx, transaction, "", 351); err != models.InvalidTransactionCaptured {
+				t.Errorf("refunding more than is left returned %v", err)
+			}
+			if err = store.Refund(ctx, transaction, "", 350); err != nil {
+				t.Fatal(err)
+			}
+			if err = store.Refund(ctx, transaction, "", 1); err != models.TransactionFullyRefunded {
+				t.Errorf("refunding a fully refunded transaction returned %v", err)
+			}
+			captures, err := store.ListCaptures(ctx, transaction.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			refunded := map[string]int64{}
+			for _, capture := range captures.Captures {
+				refunded[capture.ID] = capture.RefundedAmount
+			}
+			if expected := map[string]int64{first.ID: 300, second.ID: 200}; !reflect.DeepEqual(refunded, expected) {
+				t.Errorf("captures have %v refunded, expected %v", refunded, expected)
+			}
+			card, err = store.GetCard(ctx, card.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if card.FullBalance != 10000 || card.BlockedBalance != 0 {
+				t.Errorf("card has full %d blocked %d, expected 10000 and 0", card.FullBalance, card.BlockedBalance)
+			}
+		})
+	}
+}
+
+// A capture moves the transaction's updated_at on, as every other change to it does
+func TestCaptureUpdatesTransaction(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			card, err := store.CreateCard(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.LoadCard(ctx, card.ID, 10000); err != nil {
+				t.Fatal(err)
+			}
+			merchant, err := store.CreateMerchant(ctx, &models.Merchant{Name: "Corner Shop", MCC: "5411", Address: "High Street"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			transaction, err := store.Auth(ctx, card, merchant, 1000, "", time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			captured := time.Now()
+			if _, err = store.Capture(ctx, transaction, 400, false); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := store.GetTransaction(ctx, transaction.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.UpdatedAt.Before(captured) || transaction.UpdatedAt.Before(captured) {
+				t.Errorf("transaction was last updated at %s (returned %s), before the capture at %s", stored.UpdatedAt,
+					transaction.UpdatedAt, captured)
+			}
+		})
+	}
+}
+
+// An over-capture at a restaurant takes the tip from the card's available balance, and the ledger agrees
+func TestOverCapture(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			card, err := store.CreateCard(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.LoadCard(ctx, card.ID, 10000); err != nil {
+				t.Fatal(err)
+			}
+			restaurant, err := store.CreateMerchant(ctx, &models.Merchant{Name: "Bistro", MCC: "5812", Address: "High Street"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			transaction, err := store.Auth(ctx, card, restaurant, 1000, "", time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.Capture(ctx, transaction, 1201, true); err != models.OverCaptureExceeded {
+				t.Errorf("capturing over the 20%% allowance returned %v", err)
+			}
+			capture, err := store.Capture(ctx, transaction, 1200, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if capture.OverCapturedAmount != 200 || transaction.CapturedAmount != 1200 || transaction.Status != models.TransactionCaptured {
+				t.Errorf("capture of 1200 is %+v on a %s transaction with %d captured", capture, transaction.Status, transaction.CapturedAmount)
+			}
+			card, err = store.GetCard(ctx, card.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ledger, err := store.CardLedger(ctx, card.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if card.FullBalance != 8800 || card.BlockedBalance != 0 || ledger.FullBalance != 8800 || ledger.BlockedBalance != 0 {
+				t.Errorf("card has full %d blocked %d and its ledger %d and %d, expected 8800 and 0", card.FullBalance,
+					card.BlockedBalance, ledger.FullBalance, ledger.BlockedBalance)
+			}
+		})
+	}
+}
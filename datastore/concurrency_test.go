@@ -0,0 +1,343 @@
+package datastore
+
+import (
+	"context"
+	"github.com/jmoiron/sqlx"
+	"os"
+	"path/filepath"
+	"prepaidcard/models"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	concurrentAuths = 40
+	authAmount = 1000
+	loadAmount = 25 * authAmount
+)
+
+// Postgres connection string the store tests also run against when set, as only postgres takes row locks
+const postgresTestEnv = "PREPAIDCARD_TEST_POSTGRES_DSN"
+
+/*
+	Every store the balance tests run against, each starting empty
+	Postgres is included when postgresTestEnv is set, with a schema of its own that is dropped afterwards.
+ */
+func testStores(t *testing.T) map[string]models.CardStore {
+	t.Helper()
+	sqlite, err := New("sqlite", filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatalf("opening sqlite store: %v", err)
+	}
+	t.Cleanup(func() { sqlite.(*SQLStore).Close() })
+	if _, err = sqlite.(*SQLStore).MigrateUp(context.Background()); err != nil {
+		t.Fatalf("migrating sqlite store: %v", err)
+	}
+	stores := map[string]models.CardStore{
+		"memory": NewMemoryStore(),
+		"sqlite": sqlite,
+	}
+	if dsn := os.Getenv(postgresTestEnv); dsn != "" {
+		stores["postgres"] = postgresTestStore(t, dsn)
+	}
+	return stores
+}
+
+// A migrated postgres store in a new schema, which lib/pq sets as the search_path of every connection
+func postgresTestStore(t *testing.T, dsn string) *SQLStore {
+	t.Helper()
+	admin, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatalf("connecting to postgres: %v", err)
+	}
+	schema := "test_" + strings.ToLower(newId(time.Now()).String())
+	if _, err = admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		admin.Close()
+		t.Fatalf("creating schema %s: %v", schema, err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Errorf("dropping schema %s: %v", schema, err)
+		}
+		admin.Close()
+	})
+	if strings.Contains(dsn, "://") {
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		dsn = dsn + separator + "search_path=" + schema
+	} else {
+		dsn = dsn + " search_path=" + schema
+	}
+	store, err := New("postgres", dsn, Options{})
+	if err != nil {
+		t.Fatalf("opening postgres store: %v", err)
+	}
+	s := store.(*SQLStore)
+	t.Cleanup(func() { s.Close() })
+	if _, err = s.MigrateUp(context.Background()); err != nil {
+		t.Fatalf("migrating postgres store: %v", err)
+	}
+	return s
+}
+
+// Runs fn n times at once and returns how many calls succeeded, failing the test on anything but an ApiError
+func hammer(t *testing.T, n int, fn func(i int) error) int {
+	t.Helper()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := fn(i)
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				succeeded++
+			} else if _, ok := err.(models.ApiError); !ok {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return succeeded
+}
+
+/*
+	Hammers one card with auths, then its transactions with racing captures and reverses, then refunds,
+	and checks the card and the ledger agree with the operations that went through
+ */
+func TestConcurrentBalanceChanges(t *testing.T) {
+	for name, store := range testStores(t) {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			card, err := store.CreateCard(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.LoadCard(ctx, card.ID, loadAmount); err != nil {
+				t.Fatal(err)
+			}
+			merchant, err := store.CreateMerchant(ctx, &models.Merchant{Name: "Corner Shop", MCC: "5411", Address: "High Street"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var mu sync.Mutex
+			var transactionIds []string
+			auths := hammer(t, concurrentAuths, func(i int) error {
+				transaction, err := store.Auth(ctx, card, merchant, authAmount, "", time.Now().Add(time.Hour))
+				if err != nil {
+					return err
+				}
+				mu.Lock()
+				transactionIds = append(transactionIds, transaction.ID)
+				mu.Unlock()
+				return nil
+			})
+			if auths != loadAmount / authAmount {
+				t.Fatalf("%d auths went through, the card only had funds for %d", auths, loadAmount / authAmount)
+			}
+
+			// Two captures of 600 race a reverse of 300 on each auth of 1000, so they can't all go through
+			var captured, reversed int64
+			hammer(t, len(transactionIds) * 3, func(i int) error {
+				transaction, err := store.GetTransaction(ctx, transactionIds[i / 3])
+				if err != nil {
+					return err
+				}
+				if i % 3 == 2 {
+					if err = store.Reverse(ctx, transaction, 300); err == nil {
+						mu.Lock()
+						reversed += 300
+						mu.Unlock()
+					}
+					return err
+				}
+				if _, err = store.Capture(ctx, transaction, 600, false); err == nil {
+					mu.Lock()
+					captured += 600
+					mu.Unlock()
+				}
+				return err
+			})
+
+			var refunded int64
+			hammer(t, len(transactionIds) * 3, func(i int) error {
+				transaction, err := store.GetTransaction(ctx, transactionIds[i / 3])
+				if err != nil {
+					return err
+				}
+				if err = store.Refund(ctx, transaction, "", 250); err == nil {
+					mu.Lock()
+					refunded += 250
+					mu.Unlock()
+				}
+				return err
+			})
+
+			// Whatever order they ran in, one capture and the reverse fit in each auth, and two refunds in each capture
+			if captured != int64(auths) * 600 || reversed != int64(auths) * 300 || refunded != int64(auths) * 500 {
+				t.Errorf("captured %d, reversed %d and refunded %d over %d auths", captured, reversed, refunded, auths)
+			}
+
+			var blocked int64
+			for _, id := range transactionIds {
+				transaction, err := store.GetTransaction(ctx, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if transaction.AuthorizedAmount + transaction.CapturedAmount > authAmount {
+					t.Errorf("transaction %s holds %d and captured %d of a %d auth", id,
+						transaction.AuthorizedAmount, transaction.CapturedAmount, authAmount)
+				}
+				blocked += transaction.AuthorizedAmount
+			}
+			if blocked != int64(auths) * authAmount - captured - reversed {
+				t.Errorf("transactions hold %d, expected %d", blocked, int64(auths) * authAmount - captured - reversed)
+			}
+
+			card, err = store.GetCard(ctx, card.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			total := loadAmount - captured + refunded
+			if card.FullBalance != total || card.BlockedBalance != blocked {
+				t.Errorf("card has full %d blocked %d, expected full %d blocked %d", card.FullBalance, card.BlockedBalance, total, blocked)
+			}
+
+			balances, err := store.LedgerBalances(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for currency, sum := range balances.Totals {
+				if sum != 0 {
+					t.Errorf("ledger sums to %d %s", sum, currency)
+				}
+			}
+			accounts := make(map[string]int64)
+			for _, account := range balances.Accounts {
+				accounts[account.Account] = account.Balance
+			}
+			available := accounts[models.CardAvailableAccount(card.ID)]
+			if available != card.FullBalance - card.BlockedBalance || accounts[models.CardBlockedAccount(card.ID)] != card.BlockedBalance {
+				t.Errorf("ledger has available %d blocked %d, card has %d and %d", available,
+					accounts[models.CardBlockedAccount(card.ID)], card.FullBalance - card.BlockedBalance, card.BlockedBalance)
+			}
+			if available + blocked != total {
+				t.Errorf("available %d plus blocked %d is not the expected total %d", available, blocked, total)
+			}
+		})
+	}
+}
+
+// Transfers racing both ways between two cards all go through, which needs the pair locked in the same order every time
+func TestConcurrentTransfers(t *testing.T) {
+	for name, store := range testStores(t) {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			var ids []string
+			for i := 0; i < 2; i++ {
+				card, err := store.CreateCard(ctx, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err = store.LoadCard(ctx, card.ID, loadAmount); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, card.ID)
+			}
+			transfers := hammer(t, concurrentAuths, func(i int) error {
+				_, err := store.Transfer(ctx, ids[i % 2], ids[(i + 1) % 2], authAmount)
+				return err
+			})
+			if transfers != concurrentAuths {
+				t.Errorf("%d of %d transfers went through", transfers, concurrentAuths)
+			}
+			for _, id := range ids {
+				checkBalance(t, store, id, loadAmount)
+			}
+			checkCardLedgers(t, store, ids...)
+		})
+	}
+}
+
+/*
+	Holding the lock lockCard, lockTransaction or lockCardPair takes makes writes to the same rows wait
+	Only postgres takes row locks, SQLite locks the whole database for a writer instead.
+ */
+func TestRowLocksBlockWriters(t *testing.T) {
+	dsn := os.Getenv(postgresTestEnv)
+	if dsn == "" {
+		t.Skipf("set %s to run against postgres", postgresTestEnv)
+	}
+	s := postgresTestStore(t, dsn)
+	ctx := context.Background()
+	from, err := s.CreateCardWithID(ctx, "", "", loadAmount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := s.CreateCard(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	merchant, err := s.CreateMerchant(ctx, &models.Merchant{Name: "Corner Shop", MCC: "5411", Address: "High Street"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transaction, err := s.Auth(ctx, from, merchant, authAmount, "", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name	string
+		lock	func(tx *sqlx.Tx) error
+		write	func(ctx context.Context) error
+	}{
+		{
+			"lockCard",
+			func(tx *sqlx.Tx) error { _, err := s.lockCard(ctx, tx, to.ID); return err },
+			func(ctx context.Context) error { _, err := s.LoadCard(ctx, to.ID, 100); return err },
+		},
+		{
+			"lockTransaction",
+			func(tx *sqlx.Tx) error { _, err := s.lockTransaction(ctx, tx, transaction.ID); return err },
+			func(ctx context.Context) error { return s.Reverse(ctx, transaction, 100) },
+		},
+		{
+			"lockCardPair",
+			func(tx *sqlx.Tx) error { _, _, err := s.lockCardPair(ctx, tx, to.ID, from.ID); return err },
+			func(ctx context.Context) error { _, err := s.Transfer(ctx, from.ID, to.ID, 100); return err },
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tx, err := s.db.Beginx()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			if err = c.lock(tx); err != nil {
+				t.Fatal(err)
+			}
+			waiting, cancel := context.WithTimeout(ctx, 200 * time.Millisecond)
+			defer cancel()
+			if err = c.write(waiting); err == nil || waiting.Err() == nil {
+				t.Fatalf("write went ahead while the rows were locked: %v", err)
+			}
+			if err = tx.Rollback(); err != nil {
+				t.Fatal(err)
+			}
+			if err = c.write(ctx); err != nil {
+				t.Errorf("write after the lock was released: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package datastore
+
+import (
+	"fmt"
+	"math/big"
+	"prepaidcard/currency"
+	"prepaidcard/fx"
+	"prepaidcard/models"
+)
+
+// Falls back to the default currency when code is empty
+func currencyOrDefault(code string) (string, error) {
+	if code == "" {
+		return currency.Default, nil
+	}
+	if !currency.Valid(code) {
+		return "", models.InvalidCurrency
+	}
+	return code, nil
+}
+
+/*
+	Fills in the amounts of a new auth on card for amount in currencyCode
+	- The merchant's amount and currency are kept as they were sent
+	- The authorized amount is converted into the card's currency at the provider's rate
+ */
+func convertAuth(rates fx.RateProvider, transaction *models.Transaction, card *models.PrepaidCard, amount int64, currencyCode string) error {
+	rate, err := rates.Rate(currencyCode, card.Currency)
+	if _, ok := err.(fx.ErrNoRate); ok {
+		return models.NoExchangeRate
+	}
+	if err != nil {
+		return err
+	}
+	converted, err := currency.Convert(amount, currencyCode, card.Currency, rate)
+	if err != nil {
+		return err
+	}
+	if converted <= 0 {
+		return models.InvalidAmount
+	}
+	transaction.Currency = card.Currency
+	transaction.MerchantAmount = amount
+	transaction.MerchantCurrency = currencyCode
+	transaction.FXRate = fx.FormatRate(rate)
+	transaction.OriginalAmount = converted
+	transaction.AuthorizedAmount = converted
+	return nil
+}
+
+/*
+	Converts an increment of amount in currencyCode into the card's currency, at the rate the auth used
+	currencyCode has to be the auth's merchant currency, as that is the only rate the auth has
+ */
+func convertIncrement(transaction *models.Transaction, amount int64, currencyCode string) (int64, error) {
+	if !currency.Valid(currencyCode) {
+		return 0, models.InvalidCurrency
+	}
+	if currencyCode != transaction.MerchantCurrency {
+		return 0, models.IncrementCurrencyMismatch
+	}
+	rate, ok := new(big.Rat).SetString(transaction.FXRate)
+	if !ok {
+		return 0, fmt.Errorf("transaction %s has an invalid fx rate %q", transaction.ID, transaction.FXRate)
+	}
+	converted, err := currency.Convert(amount, transaction.MerchantCurrency, transaction.Currency, rate)
+	if err != nil {
+		return 0, err
+	}
+	if converted <= 0 {
+		return 0, models.InvalidAmount
+	}
+	return converted, nil
+}
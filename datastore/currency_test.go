@@ -0,0 +1,29 @@
+package datastore
+
+import (
+	"prepaidcard/models"
+	"testing"
+)
+
+// An increment has to be in the merchant's currency of the auth, and is converted at the auth's rate
+func TestConvertIncrement(t *testing.T) {
+	transaction := &models.Transaction{ID: "hotel", Currency: "GBP", MerchantCurrency: "EUR", FXRate: "0.86"}
+	cases := []struct {
+		amount		int64
+		currency	string
+		converted	int64
+		err			error
+	}{
+		{1000, "EUR", 860, nil},
+		{1, "EUR", 1, nil},
+		{1000, "GBP", 0, models.IncrementCurrencyMismatch},
+		{1000, "", 0, models.InvalidCurrency},
+		{1000, "XXX", 0, models.InvalidCurrency},
+	}
+	for _, c := range cases {
+		converted, err := convertIncrement(transaction, c.amount, c.currency)
+		if converted != c.converted || err != c.err {
+			t.Errorf("increment of %d %q converted to %d, %v, expected %d, %v", c.amount, c.currency, converted, err, c.converted, c.err)
+		}
+	}
+}
@@ -1,24 +1,90 @@
 package datastore
 
 import (
+	"context"
 	"fmt"
 	"github.com/jmoiron/sqlx"
-	log "github.com/sirupsen/logrus"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"prepaidcard/cardnumber"
+	"prepaidcard/fx"
 	"prepaidcard/models"
+	"strings"
 )
 
-func New(dbType string, dbUrl string) (models.CardStore, error) {
+// Components the datastores depend on, anything left nil falls back to a default
+type Options struct {
+	CardNumbers	*cardnumber.Generator
+	Rates		fx.RateProvider
+	OverCapture	*models.OverCapturePolicy
+}
+
+func (o Options) withDefaults() Options {
+	if o.CardNumbers == nil {
+		o.CardNumbers = cardnumber.Default()
+	}
+	if o.Rates == nil {
+		// Without any rates only auths in the card's own currency are possible
+		o.Rates, _ = fx.NewStaticRates(nil)
+	}
+	if o.OverCapture == nil {
+		o.OverCapture = &models.OverCapturePolicy{ByMCC: models.DefaultOverCaptureRules()}
+	}
+	return o
+}
+
+// Implemented by the stores with a versioned schema, see migrations.go
+type Migrator interface {
+	MigrationStatus(ctx context.Context) ([]MigrationStatus, error)
+	MigrateUp(ctx context.Context) ([]MigrationStatus, error)
+	MigrateDown(ctx context.Context, steps int) ([]MigrationStatus, error)
+	CheckSchema(ctx context.Context) error
+}
+
+func New(dbType string, dbUrl string, options Options) (models.CardStore, error) {
+	options = options.withDefaults()
 	switch dbType {
 	case "postgres":
 		db, err := sqlx.Connect("postgres", dbUrl)
 		if err != nil {
-			log.WithError(err).WithFields(log.Fields{"url": dbUrl}).Fatal("bad DB URL")
+			return nil, fmt.Errorf("connecting to postgres: %v", err)
 		}
-		ds, err := InitDB(db)
+		ds, err := NewSQLStore(db)
 		if err != nil {
-			log.WithError(err).Fatal("database failed to initialise")
+			db.Close()
+			return nil, err
 		}
+		ds.options = options
+		return ds, nil
+	case "sqlite":
+		db, err := sqlx.Connect("sqlite3", sqliteForeignKeys(dbUrl))
+		if err != nil {
+			return nil, fmt.Errorf("opening sqlite database %s: %v", dbUrl, err)
+		}
+		// SQLite only allows a single writer, so serialise everything through one connection
+		db.SetMaxOpenConns(1)
+		ds, err := NewSQLStore(db)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		ds.options = options
+		return ds, nil
+	case "memory":
+		ds := NewMemoryStore()
+		ds.options = options
 		return ds, nil
 	}
 	return nil, fmt.Errorf("invalid datastore type %s", dbType)
 }
+
+// SQLite ignores foreign keys unless each connection turns them on, which the driver does when the DSN asks
+func sqliteForeignKeys(dsn string) string {
+	if strings.Contains(dsn, "_foreign_keys=") || strings.Contains(dsn, "_fk=") {
+		return dsn
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&_foreign_keys=1"
+	}
+	return dsn + "?_foreign_keys=1"
+}
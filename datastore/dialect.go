@@ -0,0 +1,56 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+	A dialect holds the bits of SQL that differ between the databases SQLStore supports.
+	Migrations use {{placeholders}} which the dialect fills in when they run.
+ */
+type dialect struct {
+	name			string
+	rowLocks		bool
+	placeholders	*strings.Replacer
+	// Lists a table's columns in order, none when the table doesn't exist
+	columnsQuery	string
+}
+
+var (
+	postgresDialect = dialect{
+		name: "postgres",
+		rowLocks: true,
+		placeholders: strings.NewReplacer(
+			"{{timestamp}}", "timestamp without time zone",
+		),
+		columnsQuery: `SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? ORDER BY ordinal_position`,
+	}
+	sqliteDialect = dialect{
+		name: "sqlite3",
+		// The whole database is locked by a writer, and New limits SQLite to one connection
+		rowLocks: false,
+		placeholders: strings.NewReplacer(
+			"{{timestamp}}", "timestamp",
+		),
+		columnsQuery: `SELECT name FROM pragma_table_info(?) ORDER BY cid`,
+	}
+)
+
+func dialectFor(driverName string) (dialect, error) {
+	switch driverName {
+	case postgresDialect.name:
+		return postgresDialect, nil
+	case sqliteDialect.name:
+		return sqliteDialect, nil
+	}
+	return dialect{}, fmt.Errorf("unsupported database driver %s", driverName)
+}
+
+// Adds a row lock to a single row select, where the database supports it
+func (d dialect) forUpdate(query string) string {
+	if d.rowLocks {
+		return query + " FOR UPDATE"
+	}
+	return query
+}
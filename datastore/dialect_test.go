@@ -0,0 +1,14 @@
+package datastore
+
+import "testing"
+
+// Only postgres takes row locks, SQLite serialises writers on the whole database
+func TestForUpdate(t *testing.T) {
+	query := `SELECT * FROM cards WHERE id=?`
+	if locked := postgresDialect.forUpdate(query); locked != query + " FOR UPDATE" {
+		t.Errorf("postgres locks with %q", locked)
+	}
+	if locked := sqliteDialect.forUpdate(query); locked != query {
+		t.Errorf("sqlite locks with %q", locked)
+	}
+}
@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"errors"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"prepaidcard/models"
+	"strings"
+)
+
+var (
+	errCardNumberCollision = errors.New("could not generate an unused card number")
+	// A new card's id or number is already taken, which CreateCardWithID tells apart and retries on
+	errCardCollision = errors.New("card id or number already in use")
+)
+
+// The errors for the CHECK constraints in the schema, by constraint name
+var checkViolations = map[string]models.ApiError{
+	"cards_full_balance_check": models.InvalidCardBalance,
+	"cards_blocked_balance_check": models.InvalidCardBalance,
+	"cards_status_check": models.InvalidCardStatusChange,
+	"transactions_amount_check": models.InvalidAmount,
+	"transactions_authorized_check": models.InvalidTransactionAuth,
+	"transactions_captured_check": models.InvalidTransactionCaptured,
+	"card_limits_kind_check": models.InvalidLimit,
+	"card_limits_value_check": models.InvalidLimit,
+	"card_mcc_rules_list_check": models.InvalidMCC,
+	"transaction_events_amount_check": models.InvalidAmount,
+	"postings_amount_check": models.InvalidAmount,
+	"captures_amount_check": models.InvalidAmount,
+	"captures_refunded_check": models.InvalidTransactionCaptured,
+	"captures_over_captured_check": models.OverCaptureExceeded,
+	"transfers_cards_check": models.InvalidTransfer,
+	"transfers_amount_check": models.InvalidAmount,
+}
+
+// Reports whether err is a unique or primary key violation from any of the supported databases
+func isUniqueViolation(err error) bool {
+	switch dbErr := err.(type) {
+	case *pq.Error:
+		return dbErr.Code == "23505"
+	case sqlite3.Error:
+		return dbErr.ExtendedCode == sqlite3.ErrConstraintUnique || dbErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
+
+/*
+	Turns a constraint violation from any of the supported databases into the ApiError it stands for
+	The store checks everything itself before writing, so these only show up when a check was missed.
+	A missing foreign key is NotFound, and a CHECK constraint maps by name, falling back to ConstraintViolation.
+	Anything else comes back unchanged.
+ */
+func constraintError(err error) error {
+	switch dbErr := err.(type) {
+	case *pq.Error:
+		switch dbErr.Code {
+		case "23503":
+			return models.NotFound
+		case "23514":
+			return checkViolation(dbErr.Constraint)
+		case "23505":
+			return models.ConstraintViolation
+		}
+	case sqlite3.Error:
+		switch dbErr.ExtendedCode {
+		case sqlite3.ErrConstraintForeignKey:
+			return models.NotFound
+		case sqlite3.ErrConstraintCheck:
+			// SQLite only names the constraint in the message, "CHECK constraint failed: name"
+			message := dbErr.Error()
+			return checkViolation(strings.TrimSpace(message[strings.LastIndex(message, ":")+1:]))
+		case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+			return models.ConstraintViolation
+		}
+	}
+	return err
+}
+
+func checkViolation(constraint string) error {
+	if apiErr, ok := checkViolations[constraint]; ok {
+		return apiErr
+	}
+	return models.ConstraintViolation
+}
@@ -0,0 +1,20 @@
+package datastore
+
+import (
+	"prepaidcard/models"
+	"time"
+)
+
+// Records an operation on transaction, which must already hold the resulting totals
+func newEvent(transaction *models.Transaction, kind string, amount int64) *models.TransactionEvent {
+	event := &models.TransactionEvent{
+		TransactionID: transaction.ID,
+		Kind: kind,
+		Amount: amount,
+		AuthorizedAmount: transaction.AuthorizedAmount,
+		CapturedAmount: transaction.CapturedAmount,
+		CreatedAt: time.Now(),
+	}
+	event.ID = newId(event.CreatedAt).String()
+	return event
+}
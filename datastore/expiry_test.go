@@ -0,0 +1,87 @@
+package datastore
+
+import (
+	"context"
+	"prepaidcard/models"
+	"testing"
+	"time"
+)
+
+// Expiring releases what each auth past its expiry still holds, leaves later auths alone, and only happens once
+func TestExpireAuths(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			card, err := store.CreateCard(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.LoadCard(ctx, card.ID, 10000); err != nil {
+				t.Fatal(err)
+			}
+			merchant, err := store.CreateMerchant(ctx, &models.Merchant{Name: "Corner Shop", MCC: "5411", Address: "High Street"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			soon := time.Now().Add(time.Hour)
+			untouched, err := store.Auth(ctx, card, merchant, 1000, "", soon)
+			if err != nil {
+				t.Fatal(err)
+			}
+			captured, err := store.Auth(ctx, card, merchant, 1000, "", soon)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.Capture(ctx, captured, 400, false); err != nil {
+				t.Fatal(err)
+			}
+			later, err := store.Auth(ctx, card, merchant, 1000, "", time.Now().Add(3 * time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			now := time.Now().Add(2 * time.Hour)
+			if expired, err := store.ExpireAuths(ctx, now); err != nil || expired != 2 {
+				t.Errorf("expired %d auths, expected 2: %v", expired, err)
+			}
+			if expired, err := store.ExpireAuths(ctx, now); err != nil || expired != 0 {
+				t.Errorf("expired %d auths a second time, expected 0: %v", expired, err)
+			}
+			expected := map[string]struct {
+				authorized	int64
+				status		string
+			}{
+				untouched.ID: {0, models.TransactionExpired},
+				captured.ID: {0, models.TransactionCaptured},
+				later.ID: {1000, models.TransactionPending},
+			}
+			for id, e := range expected {
+				transaction, err := store.GetTransaction(ctx, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if transaction.AuthorizedAmount != e.authorized || transaction.Status != e.status {
+					t.Errorf("transaction has authorized %d and status %s, expected %d and %s", transaction.AuthorizedAmount,
+						transaction.Status, e.authorized, e.status)
+				}
+			}
+			events, err := store.TransactionEvents(ctx, untouched.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last := events.Events[len(events.Events) - 1]; last.Kind != models.EventExpire || last.Amount != 1000 {
+				t.Errorf("last event is %+v, expected an expire of 1000", last)
+			}
+			card, err = store.GetCard(ctx, card.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if card.FullBalance != 9600 || card.BlockedBalance != 1000 {
+				t.Errorf("card has full %d blocked %d, expected 9600 and 1000", card.FullBalance, card.BlockedBalance)
+			}
+			if _, err = store.Capture(ctx, untouched, 100, false); err != models.AuthExpired {
+				t.Errorf("capturing an expired auth returned %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package datastore
+
+import (
+	"fmt"
+	"prepaidcard/models"
+	"sort"
+	"time"
+)
+
+// Builds a balanced entry moving amount out of the debit account and into the credit account
+func newEntry(kind string, reference string, amount int64, currency string, debit string, credit string) *models.JournalEntry {
+	entry := &models.JournalEntry{
+		Kind: kind,
+		Reference: reference,
+		CreatedAt: time.Now(),
+	}
+	entry.ID = newId(entry.CreatedAt).String()
+	entry.Postings = []*models.Posting{
+		{
+			ID: newId(entry.CreatedAt).String(),
+			EntryID: entry.ID,
+			Account: debit,
+			Direction: models.Debit,
+			Amount: amount,
+			Currency: currency,
+		},
+		{
+			ID: newId(entry.CreatedAt).String(),
+			EntryID: entry.ID,
+			Account: credit,
+			Direction: models.Credit,
+			Amount: amount,
+			Currency: currency,
+		},
+	}
+	return entry
+}
+
+func loadEntry(card *models.PrepaidCard, amount int64) *models.JournalEntry {
+	return newEntry(models.EntryLoad, card.ID, amount, card.Currency, models.FundingAccount, models.CardAvailableAccount(card.ID))
+}
+
+func authEntry(transaction *models.Transaction, amount int64) *models.JournalEntry {
+	return newEntry(models.EntryAuth, transaction.ID, amount, transaction.Currency,
+		models.CardAvailableAccount(transaction.CardID), models.CardBlockedAccount(transaction.CardID))
+}
+
+func incrementEntry(transaction *models.Transaction, amount int64) *models.JournalEntry {
+	return newEntry(models.EntryIncrement, transaction.ID, amount, transaction.Currency,
+		models.CardAvailableAccount(transaction.CardID), models.CardBlockedAccount(transaction.CardID))
+}
+
+func captureEntry(transaction *models.Transaction, amount int64) *models.JournalEntry {
+	return newEntry(models.EntryCapture, transaction.ID, amount, transaction.Currency,
+		models.CardBlockedAccount(transaction.CardID), models.MerchantSettlementAccount(transaction.MerchantID))
+}
+
+// The part of a capture over the auth, which comes out of the card's available funds
+func overCaptureEntry(transaction *models.Transaction, amount int64) *models.JournalEntry {
+	return newEntry(models.EntryOverCapture, transaction.ID, amount, transaction.Currency,
+		models.CardAvailableAccount(transaction.CardID), models.MerchantSettlementAccount(transaction.MerchantID))
+}
+
+func reverseEntry(transaction *models.Transaction, amount int64) *models.JournalEntry {
+	return newEntry(models.EntryReverse, transaction.ID, amount, transaction.Currency,
+		models.CardBlockedAccount(transaction.CardID), models.CardAvailableAccount(transaction.CardID))
+}
+
+func refundEntry(transaction *models.Transaction, amount int64) *models.JournalEntry {
+	return newEntry(models.EntryRefund, transaction.ID, amount, transaction.Currency,
+		models.MerchantSettlementAccount(transaction.MerchantID), models.CardAvailableAccount(transaction.CardID))
+}
+
+func expireEntry(transaction *models.Transaction, amount int64) *models.JournalEntry {
+	return newEntry(models.EntryExpire, transaction.ID, amount, transaction.Currency,
+		models.CardBlockedAccount(transaction.CardID), models.CardAvailableAccount(transaction.CardID))
+}
+
+func transferEntry(transfer *models.Transfer) *models.JournalEntry {
+	return newEntry(models.EntryTransfer, transfer.ID, transfer.Amount, transfer.Currency,
+		models.CardAvailableAccount(transfer.FromCardID), models.CardAvailableAccount(transfer.ToCardID))
+}
+
+func transferReversalEntry(transfer *models.Transfer) *models.JournalEntry {
+	return newEntry(models.EntryTransferReversal, transfer.ID, transfer.Amount, transfer.Currency,
+		models.CardAvailableAccount(transfer.ToCardID), models.CardAvailableAccount(transfer.FromCardID))
+}
+
+// Funds a card's available and blocked accounts with the balances it had before the ledger existed
+func openingEntry(card *models.PrepaidCard) *models.JournalEntry {
+	entry := newEntry(models.EntryOpening, card.ID, card.FullBalance - card.BlockedBalance, card.Currency,
+		models.FundingAccount, models.CardAvailableAccount(card.ID))
+	if card.BlockedBalance > 0 {
+		blocked := newEntry(models.EntryOpening, card.ID, card.BlockedBalance, card.Currency,
+			models.FundingAccount, models.CardBlockedAccount(card.ID))
+		for _, p := range blocked.Postings {
+			p.EntryID = entry.ID
+		}
+		entry.Postings = append(entry.Postings, blocked.Postings...)
+	}
+	return entry
+}
+
+func checkBalanced(entry *models.JournalEntry) error {
+	if !entry.Balanced() {
+		return fmt.Errorf("journal entry %s (%s) is not balanced", entry.ID, entry.Kind)
+	}
+	return nil
+}
+
+// Recomputes a card's balances from the entries that touched its accounts
+func cardLedger(card *models.PrepaidCard, entries []*models.JournalEntry) *models.CardLedger {
+	ledger := &models.CardLedger{CardID: card.ID, Currency: card.Currency, Entries: entries}
+	available := models.CardAvailableAccount(card.ID)
+	blocked := models.CardBlockedAccount(card.ID)
+	for _, entry := range entries {
+		for _, p := range entry.Postings {
+			switch p.Account {
+			case available:
+				ledger.FullBalance = ledger.FullBalance + p.Value()
+			case blocked:
+				ledger.FullBalance = ledger.FullBalance + p.Value()
+				ledger.BlockedBalance = ledger.BlockedBalance + p.Value()
+			}
+		}
+	}
+	return ledger
+}
+
+func ledgerBalances(accounts []*models.AccountBalance) *models.LedgerBalances {
+	balances := &models.LedgerBalances{Accounts: accounts, Totals: make(map[string]int64)}
+	sort.Slice(balances.Accounts, func(i, j int) bool {
+		if balances.Accounts[i].Account == balances.Accounts[j].Account {
+			return balances.Accounts[i].Currency < balances.Accounts[j].Currency
+		}
+		return balances.Accounts[i].Account < balances.Accounts[j].Account
+	})
+	for _, a := range accounts {
+		balances.Totals[a.Currency] = balances.Totals[a.Currency] + a.Balance
+	}
+	return balances
+}
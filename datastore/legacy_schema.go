@@ -0,0 +1,135 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"prepaidcard/models"
+	"strings"
+	"time"
+)
+
+// A table's name and its columns in order
+type tableLayout struct {
+	name	string
+	columns	[]string
+}
+
+/*
+	Before migrations existed the app made its tables on start, in the layout of the first release:
+	cards keyed by their number, merchants with a free text type and unique names, and transactions
+	with neither currencies nor an expiry. Migration 1 adopts such a database by setting its tables
+	aside, making its own, and copying the rows back over in the new layout.
+ */
+var baselineTables = []tableLayout{
+	{"cards", []string{"card_number", "full_balance", "blocked_balance", "created_at", "updated_at"}},
+	{"merchants", []string{"id", "name", "type", "address", "created_at", "updated_at"}},
+	{"transactions", []string{"id", "card_id", "merchant_id", "original_amount", "authorized_amount", "captured_amount", "created_at", "updated_at"}},
+}
+
+func (s *SQLStore) tableColumns(ctx context.Context, tx *sqlx.Tx, table string) ([]string, error) {
+	var columns []string
+	err := tx.SelectContext(ctx, &columns, tx.Rebind(s.dialect.columnsQuery), table)
+	return columns, err
+}
+
+/*
+	Copies the tables of a database from before migrations to <table>_baseline and drops them, along with the view
+	Nothing is done unless there is a cards table, and any table whose columns aren't the first release's is an error,
+	as there would be no telling what its rows mean. Cards are given their ids here, while the old table can still
+	be read, and copies don't keep keys or constraints so their names are free for the tables migration 1 makes.
+ */
+func (s *SQLStore) setAsideBaselineTables(ctx context.Context, tx *sqlx.Tx) error {
+	columns, err := s.tableColumns(ctx, tx, "cards")
+	if err != nil || len(columns) == 0 {
+		return err
+	}
+	for _, table := range baselineTables {
+		columns, err := s.tableColumns(ctx, tx, table.name)
+		if err != nil {
+			return err
+		}
+		if strings.Join(columns, ", ") != strings.Join(table.columns, ", ") {
+			return fmt.Errorf("%s has columns (%s) rather than the (%s) of a database from before migrations, so it can't be adopted",
+				table.name, strings.Join(columns, ", "), strings.Join(table.columns, ", "))
+		}
+	}
+	statements := []string{`DROP VIEW IF EXISTS user_transaction_list;`}
+	for _, table := range baselineTables {
+		statements = append(statements, fmt.Sprintf(`CREATE TABLE %s_baseline AS SELECT * FROM %s;`, table.name, table.name))
+	}
+	statements = append(statements, `ALTER TABLE cards_baseline ADD COLUMN id varchar(256);`)
+	if err = s.execAll(ctx, tx, statements); err != nil {
+		return err
+	}
+	var cards []struct {
+		CardNumber	string		`db:"card_number"`
+		CreatedAt	*time.Time	`db:"created_at"`
+	}
+	if err = tx.SelectContext(ctx, &cards, `SELECT card_number, created_at FROM cards`); err != nil {
+		return err
+	}
+	for _, card := range cards {
+		createdAt := time.Now()
+		if card.CreatedAt != nil {
+			createdAt = *card.CreatedAt
+		}
+		query := tx.Rebind(`UPDATE cards_baseline SET id=? WHERE card_number=?`)
+		if _, err = tx.ExecContext(ctx, query, newId(createdAt).String(), card.CardNumber); err != nil {
+			return err
+		}
+	}
+	statements = nil
+	for i := len(baselineTables) - 1; i >= 0; i-- {
+		statements = append(statements, fmt.Sprintf(`DROP TABLE %s;`, baselineTables[i].name))
+	}
+	return s.execAll(ctx, tx, statements)
+}
+
+/*
+	Copies the rows set aside by setAsideBaselineTables into the tables migration 1 made, then drops the copies
+	- Cards are active and in GBP, the only currency there was
+	- Merchant types become the category of a merchant with 5999, the catch-all retail MCC
+	- Transactions refer to their card by its new id, and pending auths expire after the default lifetime,
+	  counted from the upgrade. A transaction whose card doesn't exist fails the migration, as card_id can't be null
+	- Each card's ledger opens with an entry funding its available and blocked accounts with its balances,
+	  so the ledger agrees with the card from the start
+ */
+func (s *SQLStore) restoreBaselineRows(ctx context.Context, tx *sqlx.Tx) error {
+	columns, err := s.tableColumns(ctx, tx, "cards_baseline")
+	if err != nil || len(columns) == 0 {
+		return err
+	}
+	err = s.execAll(ctx, tx, []string{
+		`INSERT INTO cards (id, card_number, full_balance, blocked_balance, status, currency, created_at, updated_at)
+			SELECT id, card_number, full_balance, blocked_balance, 'active', 'GBP', created_at, updated_at FROM cards_baseline;`,
+		`INSERT INTO merchants (id, name, mcc, category, address, currency, created_at, updated_at)
+			SELECT id, name, '5999', type, address, 'GBP', created_at, updated_at FROM merchants_baseline;`,
+	})
+	if err != nil {
+		return err
+	}
+	query := tx.Rebind(`INSERT INTO transactions (id, card_id, merchant_id, original_amount, authorized_amount, captured_amount,
+			currency, merchant_amount, merchant_currency, fx_rate, expires_at, created_at, updated_at)
+		SELECT id, (SELECT id FROM cards_baseline WHERE cards_baseline.card_number = transactions_baseline.card_id), merchant_id,
+			original_amount, authorized_amount, captured_amount, 'GBP', original_amount, 'GBP', '1', ?, created_at, updated_at
+		FROM transactions_baseline;`)
+	if _, err = tx.ExecContext(ctx, query, time.Now().Add(models.DefaultAuthLifetime)); err != nil {
+		return err
+	}
+	var cards []*models.PrepaidCard
+	err = tx.SelectContext(ctx, &cards, `SELECT id, full_balance, blocked_balance, currency FROM cards WHERE full_balance > 0`)
+	if err != nil {
+		return err
+	}
+	for _, card := range cards {
+		if err = s.postEntry(ctx, tx, openingEntry(card)); err != nil {
+			return err
+		}
+	}
+	var statements []string
+	for i := len(baselineTables) - 1; i >= 0; i-- {
+		statements = append(statements, fmt.Sprintf(`DROP TABLE %s_baseline;`, baselineTables[i].name))
+	}
+	return s.execAll(ctx, tx, statements)
+}
@@ -0,0 +1,173 @@
+package datastore
+
+import (
+	"context"
+	"path/filepath"
+	"prepaidcard/models"
+	"testing"
+	"time"
+)
+
+// The tables and view the first release made on start, before migrations existed
+var baselineSchema = []string{
+	`CREATE TABLE cards (
+		card_number varchar(256) NOT NULL PRIMARY KEY,
+		full_balance bigint NOT NULL,
+		blocked_balance bigint NOT NULL,
+		created_at {{timestamp}},
+		updated_at {{timestamp}}
+	);`,
+	`CREATE TABLE merchants (
+		id varchar(256) NOT NULL PRIMARY KEY,
+		name varchar(256) NOT NULL UNIQUE,
+		type varchar(256) NOT NULL,
+		address text NOT NULL,
+		created_at {{timestamp}},
+		updated_at {{timestamp}}
+	);`,
+	`CREATE TABLE transactions (
+		id varchar(256) NOT NULL PRIMARY KEY,
+		card_id varchar(256) NOT NULL,
+		merchant_id varchar(256) NOT NULL,
+		original_amount	bigint NOT NULL,
+		authorized_amount bigint NOT NULL,
+		captured_amount bigint NOT NULL,
+		created_at {{timestamp}},
+		updated_at {{timestamp}}
+	);`,
+	`CREATE VIEW user_transaction_list AS
+		SELECT cards.card_number card_id, transactions.id transaction_id, merchants.type merchant_type, merchants.name merchant_name, transactions.original_amount auth_amount, transactions.captured_amount amount, transactions.created_at auth_time FROM transactions
+		JOIN merchants ON transactions.merchant_id = merchants.id
+		JOIN cards ON transactions.card_id = cards.card_number;`,
+}
+
+// A SQLite store in a temporary directory, with the given statements run and no migrations applied
+func openLegacyStore(t *testing.T, statements ...string) *SQLStore {
+	t.Helper()
+	store, err := New("sqlite", filepath.Join(t.TempDir(), "legacy.db"), Options{})
+	if err != nil {
+		t.Fatalf("opening sqlite store: %v", err)
+	}
+	s := store.(*SQLStore)
+	t.Cleanup(func() { s.Close() })
+	for _, statement := range statements {
+		if _, err = s.db.Exec(s.dialect.placeholders.Replace(statement)); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+	return s
+}
+
+func TestMigrateUpAdoptsBaselineDatabase(t *testing.T) {
+	s := openLegacyStore(t, baselineSchema...)
+	ctx := context.Background()
+	created := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	rows := []struct {
+		query	string
+		args	[]interface{}
+	}{
+		{`INSERT INTO cards VALUES (?, ?, ?, ?, ?)`, []interface{}{"4000001234567899", 1000, 200, created, created}},
+		{`INSERT INTO merchants VALUES (?, ?, ?, ?, ?, ?)`, []interface{}{"corner-shop", "Corner Shop", "groceries", "High Street", created, created}},
+		{`INSERT INTO transactions VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, []interface{}{"settled", "4000001234567899", "corner-shop", 300, 0, 300, created, created}},
+		{`INSERT INTO transactions VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, []interface{}{"pending", "4000001234567899", "corner-shop", 200, 200, 0, created, created}},
+	}
+	for _, row := range rows {
+		if _, err := s.db.Exec(row.query, row.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := s.MigrateUp(ctx); err != nil {
+		t.Fatalf("migrating the baseline database: %v", err)
+	}
+	if err := s.CheckSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	card, err := s.GetCardByNumber(ctx, "4000001234567899")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.ID == "" || card.FullBalance != 1000 || card.BlockedBalance != 200 || card.Status != models.CardActive || card.Currency != "GBP" {
+		t.Errorf("card was adopted as %+v", card)
+	}
+	merchant, err := s.GetMerchant(ctx, "corner-shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merchant.MCC != "5999" || merchant.Category != "groceries" || merchant.Currency != "GBP" {
+		t.Errorf("merchant was adopted as %+v", merchant)
+	}
+	pending, err := s.GetTransaction(ctx, "pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.CardID != card.ID || pending.MerchantAmount != 200 || !pending.ExpiresAt.After(time.Now()) {
+		t.Errorf("pending auth was adopted as %+v", pending)
+	}
+	spending, err := s.TransactionList(ctx, card.ID, &models.SpendingFilter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spending.SpendingList) != 2 {
+		t.Errorf("card has %d transactions listed, expected 2", len(spending.SpendingList))
+	}
+
+	checkCardLedgers(t, s, card.ID)
+
+	// The adopted transactions can still be refunded and captured, and the ledger keeps up with the card
+	settled, err := s.GetTransaction(ctx, "settled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Refund(ctx, settled, "", 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Capture(ctx, pending, 200, true); err != nil {
+		t.Fatal(err)
+	}
+	card, err = s.GetCard(ctx, card.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.FullBalance != 900 || card.BlockedBalance != 0 {
+		t.Errorf("card has full %d blocked %d after the refund and capture, expected 900 and 0", card.FullBalance, card.BlockedBalance)
+	}
+	checkCardLedgers(t, s, card.ID)
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for _, table := range baselineTables {
+		if columns, err := s.tableColumns(ctx, tx, table.name + "_baseline"); err != nil || len(columns) > 0 {
+			t.Errorf("%s_baseline was left behind: %v", table.name, err)
+		}
+	}
+}
+
+func TestMigrateUpRejectsUnknownLayout(t *testing.T) {
+	s := openLegacyStore(t, append(baselineSchema, `ALTER TABLE cards ADD COLUMN nickname text;`)...)
+	ctx := context.Background()
+	if _, err := s.MigrateUp(ctx); err == nil {
+		t.Fatal("migrating a cards table with an unknown column succeeded")
+	}
+	statuses, err := s.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			t.Errorf("migration %d was applied", status.Version)
+		}
+	}
+	tx, err := s.db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if columns, err := s.tableColumns(ctx, tx, "cards"); err != nil || len(columns) != 6 {
+		t.Errorf("cards was changed to %v: %v", columns, err)
+	}
+}
@@ -0,0 +1,49 @@
+package datastore
+
+import (
+	"prepaidcard/models"
+	"time"
+)
+
+// Returns the amount authorized or captured, and the number of auths, on a card since a time
+// at merchants the limit applies to
+type limitUsage func(limit *models.CardLimit, since time.Time) (spent int64, auths int64, err error)
+
+/*
+	Checks amount (in the card's currency) at merchant against every limit on the card
+	For a new auth total is the amount, for an increment it's what the auth comes to with it, which is what
+	max_auth caps. An increment isn't a new auth, so it doesn't count towards auth_count.
+ */
+func checkLimits(limits []*models.CardLimit, merchant *models.Merchant, amount int64, total int64, newAuth bool, now time.Time, usage limitUsage) error {
+	for _, limit := range limits {
+		if !limit.AppliesTo(merchant) {
+			continue
+		}
+		switch limit.Kind {
+		case models.LimitMaxAuth:
+			if total > limit.Value {
+				return models.LimitExceeded(limit)
+			}
+		case models.LimitSpend:
+			spent, _, err := usage(limit, limit.Since(now))
+			if err != nil {
+				return err
+			}
+			if spent + amount > limit.Value {
+				return models.LimitExceeded(limit)
+			}
+		case models.LimitAuthCount:
+			if !newAuth {
+				continue
+			}
+			_, auths, err := usage(limit, limit.Since(now))
+			if err != nil {
+				return err
+			}
+			if auths + 1 > limit.Value {
+				return models.LimitExceeded(limit)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"prepaidcard/models"
+	"testing"
+	"time"
+)
+
+// Moves an auth's creation time, as if it had been made then
+func backdate(t *testing.T, store models.CardStore, transactionId string, then time.Time) {
+	t.Helper()
+	switch s := store.(type) {
+	case *MemoryStore:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		transaction := s.transactions[transactionId]
+		transaction.CreatedAt = then
+		s.transactions[transactionId] = transaction
+	case *SQLStore:
+		if _, err := s.db.Exec(s.db.Rebind(`UPDATE transactions SET created_at=? WHERE id=?`), then, transactionId); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("can't backdate transactions in %T", store)
+	}
+}
+
+/*
+	A daily spend limit counts the auth from 23 hours ago and not the one from 25 hours ago,
+	whichever side of UTC the server's zone is on
+ */
+func TestSpendWindowOutsideUTC(t *testing.T) {
+	local := time.Local
+	defer func() { time.Local = local }()
+	for _, zone := range []*time.Location{time.FixedZone("UTC+9", 9 * 60 * 60), time.FixedZone("UTC-9", -9 * 60 * 60)} {
+		time.Local = zone
+		for name, store := range testStores(t) {
+			t.Run(zone.String() + "/" + name, func(t *testing.T) {
+				ctx := context.Background()
+				card, err := store.CreateCard(ctx, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err = store.LoadCard(ctx, card.ID, 10000); err != nil {
+					t.Fatal(err)
+				}
+				merchant, err := store.CreateMerchant(ctx, &models.Merchant{Name: "Corner Shop", MCC: "5411", Address: "High Street"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				expiresAt := time.Now().Add(time.Hour)
+				for _, age := range []time.Duration{23 * time.Hour, 25 * time.Hour} {
+					transaction, err := store.Auth(ctx, card, merchant, 600, "", expiresAt)
+					if err != nil {
+						t.Fatal(err)
+					}
+					backdate(t, store, transaction.ID, time.Now().UTC().Add(-age))
+				}
+				_, err = store.CreateCardLimit(ctx, &models.CardLimit{CardID: card.ID, Kind: models.LimitSpend, Window: models.WindowDay, Value: 1000})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err = store.Auth(ctx, card, merchant, 300, "", expiresAt); err != nil {
+					t.Errorf("auth within the limit, with only the auth from 23 hours ago counted, was declined: %v", err)
+				}
+				if _, err = store.Auth(ctx, card, merchant, 200, "", expiresAt); err == nil {
+					t.Errorf("auth over the limit, with the auth from 23 hours ago counted, went through")
+				}
+			})
+		}
+	}
+}
+
+// Each kind of limit against usage reported for its window, without a store
+func TestCheckLimits(t *testing.T) {
+	now := time.Date(2018, 10, 8, 12, 0, 0, 0, time.UTC)
+	grocer := &models.Merchant{MCC: "5411"}
+	station := &models.Merchant{MCC: "5541"}
+	usage := func(limit *models.CardLimit, since time.Time) (int64, int64, error) {
+		if !since.Equal(limit.Since(now)) {
+			t.Errorf("%s usage asked for since %s", limit, since)
+		}
+		return 700, 2, nil
+	}
+	maxAuth := &models.CardLimit{ID: "max", Kind: models.LimitMaxAuth, Value: 1000}
+	spend := &models.CardLimit{ID: "spend", Kind: models.LimitSpend, Window: models.WindowDay, Value: 1000}
+	groceries := &models.CardLimit{ID: "groceries", Kind: models.LimitSpend, Window: models.WindowDay, MCC: "groceries", Value: 1000}
+	count := &models.CardLimit{ID: "count", Kind: models.LimitAuthCount, Window: models.WindowWeek, Value: 2}
+	cases := []struct {
+		limit		*models.CardLimit
+		merchant	*models.Merchant
+		amount		int64
+		total		int64
+		newAuth		bool
+		exceeded	bool
+	}{
+		{maxAuth, grocer, 1000, 1000, true, false},
+		{maxAuth, grocer, 1001, 1001, true, true},
+		// An increment is held to max_auth by the auth's new total
+		{maxAuth, grocer, 200, 1100, false, true},
+		{spend, grocer, 300, 300, true, false},
+		{spend, grocer, 301, 301, true, true},
+		{groceries, grocer, 301, 301, true, true},
+		{groceries, station, 301, 301, true, false},
+		{count, grocer, 1, 1, true, true},
+		// Increments aren't new auths, so they don't count towards auth_count
+		{count, grocer, 1, 1, false, false},
+	}
+	for _, c := range cases {
+		var expected error
+		if c.exceeded {
+			expected = models.LimitExceeded(c.limit)
+		}
+		err := checkLimits([]*models.CardLimit{c.limit}, c.merchant, c.amount, c.total, c.newAuth, now, usage)
+		if fmt.Sprint(err) != fmt.Sprint(expected) {
+			t.Errorf("%s for %d (total %d, new auth %v) at %s returned %v, expected %v", c.limit, c.amount, c.total, c.newAuth,
+				c.merchant.MCC, err, expected)
+		}
+	}
+
+	failed := errors.New("usage failed")
+	err := checkLimits([]*models.CardLimit{spend}, grocer, 1, 1, true, now, func(*models.CardLimit, time.Time) (int64, int64, error) {
+		return 0, 0, failed
+	})
+	if err != failed {
+		t.Errorf("failing usage returned %v", err)
+	}
+}
+
+// Count and category limits declined by both stores, with usage coming from the stored auths
+func TestLimitsDeclineAuths(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			card, err := store.CreateCard(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.LoadCard(ctx, card.ID, 10000); err != nil {
+				t.Fatal(err)
+			}
+			grocer, err := store.CreateMerchant(ctx, &models.Merchant{Name: "Corner Shop", MCC: "5411", Address: "High Street"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			station, err := store.CreateMerchant(ctx, &models.Merchant{Name: "Petrol Station", MCC: "5541", Address: "Ring Road"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			limits := []*models.CardLimit{
+				{CardID: card.ID, Kind: models.LimitSpend, Window: models.WindowDay, MCC: "groceries", Value: 1000},
+				{CardID: card.ID, Kind: models.LimitAuthCount, Window: models.WindowDay, Value: 4},
+			}
+			for _, limit := range limits {
+				if _, err = store.CreateCardLimit(ctx, limit); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expiresAt := time.Now().Add(time.Hour)
+			auths := []struct {
+				merchant	*models.Merchant
+				amount		int64
+				declined	bool
+			}{
+				{station, 800, false},
+				{grocer, 800, false},
+				{grocer, 300, true},
+				{station, 300, false},
+				{grocer, 200, false},
+				{station, 100, true},
+			}
+			for i, auth := range auths {
+				_, err := store.Auth(ctx, card, auth.merchant, auth.amount, "", expiresAt)
+				if _, limited := err.(models.ApiError); (err != nil) != auth.declined || (err != nil && !limited) {
+					t.Errorf("auth %d of %d at %s returned %v, expected declined %v", i, auth.amount, auth.merchant.Name, err, auth.declined)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,917 @@
+package datastore
+
+import (
+	"context"
+	"prepaidcard/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	MemoryStore keeps cards, merchants and transactions in process memory.
+	It follows the same balance rules as the SQLStore and is intended for
+	tests and local development, everything is lost when the process exits.
+	Nothing it does waits on I/O, so the contexts passed to it are ignored.
+ */
+type MemoryStore struct {
+	mu				sync.Mutex
+	options			Options
+	cards			map[string]models.PrepaidCard
+	cardNumbers		map[string]string
+	limits			map[string]models.CardLimit
+	restrictions	map[string]models.CardRestrictions
+	merchants		map[string]models.Merchant
+	transactions	map[string]models.Transaction
+	entries			[]*models.JournalEntry
+	events			map[string][]*models.TransactionEvent
+	captures		map[string][]*models.Capture
+	transfers		map[string]models.Transfer
+	idempotency		map[string]models.IdempotencyRecord
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		options: Options{}.withDefaults(),
+		cards: make(map[string]models.PrepaidCard),
+		cardNumbers: make(map[string]string),
+		limits: make(map[string]models.CardLimit),
+		restrictions: make(map[string]models.CardRestrictions),
+		merchants: make(map[string]models.Merchant),
+		transactions: make(map[string]models.Transaction),
+		events: make(map[string][]*models.TransactionEvent),
+		captures: make(map[string][]*models.Capture),
+		transfers: make(map[string]models.Transfer),
+		idempotency: make(map[string]models.IdempotencyRecord),
+	}
+}
+
+func (s *MemoryStore) CreateCard(ctx context.Context, currency string) (*models.PrepaidCard, error) {
+	return s.CreateCardWithID(ctx, "", currency, 0)
+}
+
+// Creates a card with cardId as its id unless it's empty and balance loaded onto it, see SQLStore.CreateCardWithID
+func (s *MemoryStore) CreateCardWithID(ctx context.Context, cardId string, currency string, balance int64) (*models.PrepaidCard, error) {
+	var card models.PrepaidCard
+	var err error
+	card.Currency, err = currencyOrDefault(currency)
+	if err != nil {
+		return nil, err
+	}
+	if balance < 0 {
+		return nil, models.InvalidAmount
+	}
+	card.CreatedAt = time.Now()
+	card.UpdatedAt = card.CreatedAt
+	card.Status = models.CardActive
+	card.FullBalance = balance
+	card.ID = cardId
+	if card.ID == "" {
+		card.ID = newId(card.CreatedAt).String()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.cards[card.ID]; ok {
+		return nil, models.CardExists
+	}
+	for attempt := 0; attempt < maxCardNumberAttempts; attempt++ {
+		number, err := s.options.CardNumbers.Generate()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := s.cardNumbers[number]; ok {
+			continue
+		}
+		card.CardNumber = number
+		s.cards[card.ID] = card
+		s.cardNumbers[card.CardNumber] = card.ID
+		if balance > 0 {
+			s.entries = append(s.entries, loadEntry(&card, balance))
+		}
+		return &card, nil
+	}
+	return nil, errCardNumberCollision
+}
+
+func (s *MemoryStore) GetCard(ctx context.Context, cardId string) (*models.PrepaidCard, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	card, ok := s.cards[cardId]
+	if !ok {
+		return nil, models.NotFound
+	}
+	return &card, nil
+}
+
+func (s *MemoryStore) GetCardByNumber(ctx context.Context, cardNumber string) (*models.PrepaidCard, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	card, ok := s.cards[s.cardNumbers[cardNumber]]
+	if !ok {
+		return nil, models.NotFound
+	}
+	return &card, nil
+}
+
+func (s *MemoryStore) LoadCard(ctx context.Context, cardId string, amount int64) (*models.PrepaidCard, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	card, ok := s.cards[cardId]
+	if !ok {
+		return nil, models.NotFound
+	}
+	if err := card.CheckLoad(); err != nil {
+		return nil, err
+	}
+	card.FullBalance = card.FullBalance + amount
+	s.cards[cardId] = card
+	s.entries = append(s.entries, loadEntry(&card, amount))
+	return &card, nil
+}
+
+// Moves a card to a new status if its current status allows it
+func (s *MemoryStore) SetCardStatus(ctx context.Context, cardId string, status string) (*models.PrepaidCard, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	card, ok := s.cards[cardId]
+	if !ok {
+		return nil, models.NotFound
+	}
+	if err := card.CheckTransition(status); err != nil {
+		return nil, err
+	}
+	card.Status = status
+	card.UpdatedAt = time.Now()
+	s.cards[cardId] = card
+	return &card, nil
+}
+
+func (s *MemoryStore) TransactionList(ctx context.Context, cardId string, filter *models.SpendingFilter) (*models.SpendingList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	card, ok := s.cards[cardId]
+	if !ok {
+		return nil, models.NotFound
+	}
+	list := &models.SpendingList{SpendingList: []*models.Spending{}}
+	list.Summary.Currency = card.Currency
+	var matched []*models.Spending
+	for _, transaction := range s.transactions {
+		if transaction.CardID != cardId {
+			continue
+		}
+		merchant, ok := s.merchants[transaction.MerchantID]
+		if !ok {
+			continue
+		}
+		spending := &models.Spending{
+			CardID: transaction.CardID,
+			CardNumber: models.MaskPAN(card.CardNumber),
+			TransactionId: transaction.ID,
+			MerchantID: merchant.ID,
+			MerchantMCC: merchant.MCC,
+			MerchantCategory: merchant.Category,
+			MerchantName: merchant.Name,
+			OriginalAmount: transaction.OriginalAmount,
+			CapturedAmount: transaction.CapturedAmount,
+			Currency: transaction.Currency,
+			Status: transaction.Status,
+			Time: transaction.CreatedAt,
+		}
+		if !filter.Matches(spending) {
+			continue
+		}
+		list.Summary.Count++
+		list.Summary.AuthorizedTotal = list.Summary.AuthorizedTotal + spending.OriginalAmount
+		list.Summary.CapturedTotal = list.Summary.CapturedTotal + spending.CapturedAmount
+		if filter.After != "" {
+			if filter.Order == models.SortOldest && spending.TransactionId <= filter.After {
+				continue
+			}
+			if filter.Order == models.SortNewest && spending.TransactionId >= filter.After {
+				continue
+			}
+		}
+		matched = append(matched, spending)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if filter.Order == models.SortOldest {
+			return matched[i].TransactionId < matched[j].TransactionId
+		}
+		return matched[i].TransactionId > matched[j].TransactionId
+	})
+	if len(matched) > filter.Limit {
+		matched = matched[:filter.Limit]
+		list.Next = matched[filter.Limit-1].TransactionId
+	}
+	list.SpendingList = append(list.SpendingList, matched...)
+	return list, nil
+}
+
+func (s *MemoryStore) CreateMerchant(ctx context.Context, newMerchant *models.Merchant) (*models.Merchant, error) {
+	merchant := new(models.Merchant)
+	*merchant = *newMerchant
+	merchant.CreatedAt = time.Now()
+	merchant.UpdatedAt = merchant.CreatedAt
+	if merchant.ID == "" {
+		merchant.ID = newId(merchant.CreatedAt).String()
+	}
+	if err := prepareMerchant(merchant); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.merchants[merchant.ID]; ok || s.merchantNameTaken(merchant) {
+		return nil, models.MerchantExists
+	}
+	s.merchants[merchant.ID] = *merchant
+	return merchant, nil
+}
+
+func (s *MemoryStore) GetMerchant(ctx context.Context, merchantId string) (*models.Merchant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	merchant, ok := s.merchants[merchantId]
+	if !ok || merchant.DeletedAt != nil {
+		return nil, models.NotFound
+	}
+	return &merchant, nil
+}
+
+func (s *MemoryStore) GetTransaction(ctx context.Context, transactionId string) (*models.Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	transaction, ok := s.transactions[transactionId]
+	if !ok {
+		return nil, models.NotFound
+	}
+	return &transaction, nil
+}
+
+func (s *MemoryStore) TransactionEvents(ctx context.Context, transactionId string) (*models.TransactionEventList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.transactions[transactionId]; !ok {
+		return nil, models.NotFound
+	}
+	events := append([]*models.TransactionEvent(nil), s.events[transactionId]...)
+	return &models.TransactionEventList{Events: events}, nil
+}
+
+/*
+	Performs a card Auth, see SQLStore.Auth
+	The balance check is made against the stored card rather than the one passed in,
+	which is only updated with the result.
+ */
+func (s *MemoryStore) Auth(ctx context.Context, card *models.PrepaidCard, merchant *models.Merchant, amount int64, currency string, expiresAt time.Time) (*models.Transaction, error) {
+	var transaction models.Transaction
+	transaction.CreatedAt = time.Now().UTC()
+	transaction.UpdatedAt = transaction.CreatedAt
+	transaction.ID = newId(transaction.CreatedAt).String()
+	transaction.ExpiresAt = expiresAt
+	if currency == "" {
+		currency = merchant.Currency
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.cards[card.ID]
+	if !ok {
+		return nil, models.NotFound
+	}
+	if err := stored.CheckAuth(); err != nil {
+		return nil, err
+	}
+	if err := s.cardRestrictions(stored.ID).CheckAuth(merchant); err != nil {
+		return nil, err
+	}
+	if err := convertAuth(s.options.Rates, &transaction, &stored, amount, currency); err != nil {
+		return nil, err
+	}
+	authorized := transaction.AuthorizedAmount
+	if authorized > (stored.FullBalance - stored.BlockedBalance) {
+		return nil, models.InvalidCardBalance
+	}
+	if err := s.checkLimits(stored.ID, merchant, authorized, authorized, true); err != nil {
+		return nil, err
+	}
+	stored.BlockedBalance = stored.BlockedBalance + authorized
+	s.cards[stored.ID] = stored
+	*card = stored
+	transaction.CardID = card.ID
+	transaction.MerchantID = merchant.ID
+	transaction.UpdateStatus(models.EventAuth, 0)
+	s.transactions[transaction.ID] = transaction
+	s.entries = append(s.entries, authEntry(&transaction, authorized))
+	s.events[transaction.ID] = append(s.events[transaction.ID], newEvent(&transaction, models.EventAuth, authorized))
+	transaction.Card = card
+	transaction.Merchant = merchant
+	return &transaction, nil
+}
+
+// Increases an auth, see SQLStore.Increment
+func (s *MemoryStore) Increment(ctx context.Context, transaction *models.Transaction, amount int64, currency string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.transactions[transaction.ID]
+	if !ok {
+		return models.NotFound
+	}
+	if err := stored.CheckOperation(models.EventIncrement); err != nil {
+		return err
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		return models.AuthExpired
+	}
+	converted, err := convertIncrement(&stored, amount, currency)
+	if err != nil {
+		return err
+	}
+	card, ok := s.cards[stored.CardID]
+	if !ok {
+		return models.NotFound
+	}
+	if err := card.CheckAuth(); err != nil {
+		return err
+	}
+	merchant := s.merchants[stored.MerchantID]
+	if err := s.cardRestrictions(card.ID).CheckAuth(&merchant); err != nil {
+		return err
+	}
+	if converted > (card.FullBalance - card.BlockedBalance) {
+		return models.InvalidCardBalance
+	}
+	if err := s.checkLimits(card.ID, &merchant, converted, stored.OriginalAmount + converted, false); err != nil {
+		return err
+	}
+	stored.MerchantAmount = stored.MerchantAmount + amount
+	stored.OriginalAmount = stored.OriginalAmount + converted
+	stored.AuthorizedAmount = stored.AuthorizedAmount + converted
+	stored.UpdatedAt = time.Now()
+	card.BlockedBalance = card.BlockedBalance + converted
+	s.transactions[stored.ID] = stored
+	s.cards[card.ID] = card
+	s.entries = append(s.entries, incrementEntry(&stored, converted))
+	s.events[stored.ID] = append(s.events[stored.ID], newEvent(&stored, models.EventIncrement, converted))
+	*transaction = stored
+	transaction.Card = &card
+	transaction.Merchant = &merchant
+	return nil
+}
+
+// Performs a transaction capture, see SQLStore.Capture
+func (s *MemoryStore) Capture(ctx context.Context, transaction *models.Transaction, amount int64, final bool) (*models.Capture, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.transactions[transaction.ID]
+	if !ok {
+		return nil, models.NotFound
+	}
+	if err := stored.CheckOperation(models.EventCapture); err != nil {
+		return nil, err
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		return nil, models.AuthExpired
+	}
+	card, ok := s.cards[stored.CardID]
+	if !ok {
+		return nil, models.NotFound
+	}
+	if err := card.CheckCapture(); err != nil {
+		return nil, err
+	}
+	merchant := s.merchants[stored.MerchantID]
+	authorized, over, err := splitCapture(s.options.OverCapture, &stored, merchant.MCC, s.captures[stored.ID], &card, amount)
+	if err != nil {
+		return nil, err
+	}
+	stored.AuthorizedAmount = stored.AuthorizedAmount - authorized
+	stored.CapturedAmount = stored.CapturedAmount + amount
+	stored.UpdatedAt = time.Now()
+	card.FullBalance = card.FullBalance - amount
+	card.BlockedBalance = card.BlockedBalance - authorized
+	if authorized > 0 {
+		s.entries = append(s.entries, captureEntry(&stored, authorized))
+	}
+	if over > 0 {
+		s.entries = append(s.entries, overCaptureEntry(&stored, over))
+	}
+	s.events[stored.ID] = append(s.events[stored.ID], newEvent(&stored, models.EventCapture, amount))
+	capture := newCapture(stored.ID, amount, final)
+	capture.OverCapturedAmount = over
+	s.captures[stored.ID] = append(s.captures[stored.ID], capture)
+	if leftover := stored.AuthorizedAmount; final && leftover > 0 {
+		stored.AuthorizedAmount = 0
+		card.BlockedBalance = card.BlockedBalance - leftover
+		s.entries = append(s.entries, reverseEntry(&stored, leftover))
+		s.events[stored.ID] = append(s.events[stored.ID], newEvent(&stored, models.EventReverse, leftover))
+	}
+	stored.UpdateStatus(models.EventCapture, refundedTotal(s.captures[stored.ID]))
+	s.transactions[stored.ID] = stored
+	s.cards[card.ID] = card
+	*transaction = stored
+	transaction.Card = &card
+	copied := *capture
+	return &copied, nil
+}
+
+func (s *MemoryStore) ListCaptures(ctx context.Context, transactionId string) (*models.CaptureList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.transactions[transactionId]; !ok {
+		return nil, models.NotFound
+	}
+	list := &models.CaptureList{Captures: []*models.Capture{}}
+	for _, capture := range s.captures[transactionId] {
+		copied := *capture
+		list.Captures = append(list.Captures, &copied)
+	}
+	return list, nil
+}
+
+// Performs a reverse on an auth, see SQLStore.Reverse
+func (s *MemoryStore) Reverse(ctx context.Context, transaction *models.Transaction, amount int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.transactions[transaction.ID]
+	if !ok {
+		return models.NotFound
+	}
+	if err := stored.CheckOperation(models.EventReverse); err != nil {
+		return err
+	}
+	if amount > stored.AuthorizedAmount {
+		return models.InvalidTransactionAuth
+	}
+	card, ok := s.cards[stored.CardID]
+	if !ok {
+		return models.NotFound
+	}
+	stored.AuthorizedAmount = stored.AuthorizedAmount - amount
+	stored.UpdateStatus(models.EventReverse, refundedTotal(s.captures[stored.ID]))
+	card.BlockedBalance = card.BlockedBalance - amount
+	s.transactions[stored.ID] = stored
+	s.cards[card.ID] = card
+	s.entries = append(s.entries, reverseEntry(&stored, amount))
+	s.events[stored.ID] = append(s.events[stored.ID], newEvent(&stored, models.EventReverse, amount))
+	*transaction = stored
+	transaction.Card = &card
+	return nil
+}
+
+// Performs a refund on captured funds, see SQLStore.Refund
+func (s *MemoryStore) Refund(ctx context.Context, transaction *models.Transaction, captureId string, amount int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.transactions[transaction.ID]
+	if !ok {
+		return models.NotFound
+	}
+	if err := stored.CheckOperation(models.EventRefund); err != nil {
+		return err
+	}
+	if amount > stored.CapturedAmount {
+		return models.InvalidTransactionCaptured
+	}
+	refunds, err := allocateRefund(s.captures[stored.ID], captureId, amount)
+	if err != nil {
+		return err
+	}
+	card, ok := s.cards[stored.CardID]
+	if !ok {
+		return models.NotFound
+	}
+	now := time.Now()
+	for _, capture := range s.captures[stored.ID] {
+		if refunds[capture.ID] > 0 {
+			capture.RefundedAmount = capture.RefundedAmount + refunds[capture.ID]
+			capture.UpdatedAt = now
+		}
+	}
+	stored.CapturedAmount = stored.CapturedAmount - amount
+	stored.UpdateStatus(models.EventRefund, refundedTotal(s.captures[stored.ID]))
+	card.FullBalance = card.FullBalance + amount
+	s.transactions[stored.ID] = stored
+	s.cards[card.ID] = card
+	s.entries = append(s.entries, refundEntry(&stored, amount))
+	s.events[stored.ID] = append(s.events[stored.ID], newEvent(&stored, models.EventRefund, amount))
+	*transaction = stored
+	return nil
+}
+
+// Releases the funds held by every auth that expired before now, see SQLStore.ExpireAuths
+func (s *MemoryStore) ExpireAuths(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := 0
+	for id, stored := range s.transactions {
+		amount := stored.AuthorizedAmount
+		if amount <= 0 || stored.ExpiresAt.After(now) {
+			continue
+		}
+		card, ok := s.cards[stored.CardID]
+		if !ok {
+			return expired, models.NotFound
+		}
+		stored.AuthorizedAmount = 0
+		stored.UpdateStatus(models.EventExpire, refundedTotal(s.captures[id]))
+		card.BlockedBalance = card.BlockedBalance - amount
+		s.transactions[id] = stored
+		s.cards[card.ID] = card
+		s.entries = append(s.entries, expireEntry(&stored, amount))
+		s.events[id] = append(s.events[id], newEvent(&stored, models.EventExpire, amount))
+		expired++
+	}
+	return expired, nil
+}
+
+// Moves amount from one card to another, see SQLStore.Transfer
+func (s *MemoryStore) Transfer(ctx context.Context, fromCardId string, toCardId string, amount int64) (*models.Transfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from, ok := s.cards[fromCardId]
+	if !ok {
+		return nil, models.NotFound
+	}
+	to, ok := s.cards[toCardId]
+	if !ok {
+		return nil, models.NotFound
+	}
+	if err := checkTransfer(&from, &to, amount); err != nil {
+		return nil, err
+	}
+	transfer := newTransfer(fromCardId, toCardId, amount)
+	transfer.Currency = from.Currency
+	from.FullBalance = from.FullBalance - amount
+	to.FullBalance = to.FullBalance + amount
+	s.cards[from.ID] = from
+	s.cards[to.ID] = to
+	s.transfers[transfer.ID] = *transfer
+	s.entries = append(s.entries, transferEntry(transfer))
+	transfer.FromCard = &from
+	transfer.ToCard = &to
+	return transfer, nil
+}
+
+func (s *MemoryStore) GetTransfer(ctx context.Context, transferId string) (*models.Transfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	transfer, ok := s.transfers[transferId]
+	if !ok {
+		return nil, models.NotFound
+	}
+	return &transfer, nil
+}
+
+func (s *MemoryStore) ListTransfers(ctx context.Context, cardId string, after string, limit int) (*models.TransferList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.cards[cardId]; !ok {
+		return nil, models.NotFound
+	}
+	var ids []string
+	for id, transfer := range s.transfers {
+		if id > after && (transfer.FromCardID == cardId || transfer.ToCardID == cardId) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	list := &models.TransferList{Transfers: []*models.Transfer{}}
+	for _, id := range ids {
+		if len(list.Transfers) == limit {
+			list.Next = list.Transfers[limit-1].ID
+			break
+		}
+		transfer := s.transfers[id]
+		list.Transfers = append(list.Transfers, &transfer)
+	}
+	return list, nil
+}
+
+// Moves a transfer's amount back to the card it came from, see SQLStore.ReverseTransfer
+func (s *MemoryStore) ReverseTransfer(ctx context.Context, transferId string) (*models.Transfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	transfer, ok := s.transfers[transferId]
+	if !ok {
+		return nil, models.NotFound
+	}
+	from, ok := s.cards[transfer.FromCardID]
+	if !ok {
+		return nil, models.NotFound
+	}
+	to, ok := s.cards[transfer.ToCardID]
+	if !ok {
+		return nil, models.NotFound
+	}
+	if err := checkTransferReversal(&transfer, &from, &to); err != nil {
+		return nil, err
+	}
+	reverseTransfer(&transfer, time.Now())
+	to.FullBalance = to.FullBalance - transfer.Amount
+	from.FullBalance = from.FullBalance + transfer.Amount
+	s.cards[from.ID] = from
+	s.cards[to.ID] = to
+	s.transfers[transfer.ID] = transfer
+	s.entries = append(s.entries, transferReversalEntry(&transfer))
+	transfer.FromCard = &from
+	transfer.ToCard = &to
+	return &transfer, nil
+}
+
+func (s *MemoryStore) CardLedger(ctx context.Context, cardId string) (*models.CardLedger, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	card, ok := s.cards[cardId]
+	if !ok {
+		return nil, models.NotFound
+	}
+	available := models.CardAvailableAccount(cardId)
+	blocked := models.CardBlockedAccount(cardId)
+	var entries []*models.JournalEntry
+	for _, entry := range s.entries {
+		for _, p := range entry.Postings {
+			if p.Account == available || p.Account == blocked {
+				entries = append(entries, entry)
+				break
+			}
+		}
+	}
+	return cardLedger(&card, entries), nil
+}
+
+func (s *MemoryStore) LedgerBalances(ctx context.Context) (*models.LedgerBalances, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	totals := make(map[models.AccountBalance]int64)
+	for _, entry := range s.entries {
+		for _, p := range entry.Postings {
+			key := models.AccountBalance{Account: p.Account, Currency: p.Currency}
+			totals[key] = totals[key] + p.Value()
+		}
+	}
+	var accounts []*models.AccountBalance
+	for key, balance := range totals {
+		accounts = append(accounts, &models.AccountBalance{Account: key.Account, Currency: key.Currency, Balance: balance})
+	}
+	return ledgerBalances(accounts), nil
+}
+
+func (s *MemoryStore) GetIdempotencyRecord(ctx context.Context, key string) (*models.IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.idempotency[key]
+	if !ok {
+		return nil, models.NotFound
+	}
+	return &record, nil
+}
+
+func (s *MemoryStore) CreateIdempotencyRecord(ctx context.Context, record *models.IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.idempotency[record.Key]; ok {
+		return models.IdempotencyKeyInProgress
+	}
+	record.CreatedAt = time.Now()
+	record.UpdatedAt = record.CreatedAt
+	s.idempotency[record.Key] = *record
+	return nil
+}
+
+// Takes over a claim on the key that has gone stale, see SQLStore.ReclaimIdempotencyRecord
+func (s *MemoryStore) ReclaimIdempotencyRecord(ctx context.Context, record *models.IdempotencyRecord, staleBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.idempotency[record.Key]
+	if !ok || existing.RequestHash != record.RequestHash || !existing.Stale(staleBefore) {
+		return models.IdempotencyKeyInProgress
+	}
+	existing.UpdatedAt = time.Now()
+	s.idempotency[record.Key] = existing
+	*record = existing
+	return nil
+}
+
+func (s *MemoryStore) CompleteIdempotencyRecord(ctx context.Context, record *models.IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record.UpdatedAt = time.Now()
+	s.idempotency[record.Key] = *record
+	return nil
+}
+
+func (s *MemoryStore) DeleteIdempotencyRecord(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.idempotency, key)
+	return nil
+}
+
+func (s *MemoryStore) ListCardLimits(ctx context.Context, cardId string) (*models.CardLimitList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.cards[cardId]; !ok {
+		return nil, models.NotFound
+	}
+	return &models.CardLimitList{Limits: s.cardLimits(cardId)}, nil
+}
+
+func (s *MemoryStore) GetCardLimit(ctx context.Context, cardId string, limitId string) (*models.CardLimit, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	limit, ok := s.limits[limitId]
+	if !ok || limit.CardID != cardId {
+		return nil, models.NotFound
+	}
+	return &limit, nil
+}
+
+func (s *MemoryStore) CreateCardLimit(ctx context.Context, newLimit *models.CardLimit) (*models.CardLimit, error) {
+	limit := *newLimit
+	if err := limit.Validate(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.cards[limit.CardID]; !ok {
+		return nil, models.NotFound
+	}
+	limit.CreatedAt = time.Now()
+	limit.UpdatedAt = limit.CreatedAt
+	limit.ID = newId(limit.CreatedAt).String()
+	s.limits[limit.ID] = limit
+	return &limit, nil
+}
+
+func (s *MemoryStore) UpdateCardLimit(ctx context.Context, newLimit *models.CardLimit) (*models.CardLimit, error) {
+	limit := *newLimit
+	if err := limit.Validate(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.limits[limit.ID]
+	if !ok || stored.CardID != limit.CardID {
+		return nil, models.NotFound
+	}
+	limit.CreatedAt = stored.CreatedAt
+	limit.UpdatedAt = time.Now()
+	s.limits[limit.ID] = limit
+	return &limit, nil
+}
+
+func (s *MemoryStore) DeleteCardLimit(ctx context.Context, cardId string, limitId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	limit, ok := s.limits[limitId]
+	if !ok || limit.CardID != cardId {
+		return models.NotFound
+	}
+	delete(s.limits, limitId)
+	return nil
+}
+
+// Returns the card's limits oldest first, s.mu must be held
+func (s *MemoryStore) cardLimits(cardId string) []*models.CardLimit {
+	limits := []*models.CardLimit{}
+	for _, limit := range s.limits {
+		if limit.CardID == cardId {
+			limit := limit
+			limits = append(limits, &limit)
+		}
+	}
+	sort.Slice(limits, func(i, j int) bool {
+		if limits[i].CreatedAt.Equal(limits[j].CreatedAt) {
+			return limits[i].ID < limits[j].ID
+		}
+		return limits[i].CreatedAt.Before(limits[j].CreatedAt)
+	})
+	return limits
+}
+
+// Checks an auth or increment against the card's limits, see SQLStore.checkLimits, s.mu must be held
+func (s *MemoryStore) checkLimits(cardId string, merchant *models.Merchant, amount int64, total int64, newAuth bool) error {
+	return checkLimits(s.cardLimits(cardId), merchant, amount, total, newAuth, time.Now().UTC(), func(limit *models.CardLimit, since time.Time) (int64, int64, error) {
+		var spent, auths int64
+		for _, transaction := range s.transactions {
+			if transaction.CardID != cardId || transaction.CreatedAt.Before(since) {
+				continue
+			}
+			merchant := s.merchants[transaction.MerchantID]
+			if !limit.AppliesTo(&merchant) {
+				continue
+			}
+			spent = spent + transaction.AuthorizedAmount + transaction.CapturedAmount
+			auths++
+		}
+		return spent, auths, nil
+	})
+}
+
+func (s *MemoryStore) GetCardRestrictions(ctx context.Context, cardId string) (*models.CardRestrictions, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.cards[cardId]; !ok {
+		return nil, models.NotFound
+	}
+	return s.cardRestrictions(cardId), nil
+}
+
+// Replaces every allow and deny entry on the card, see SQLStore.SetCardRestrictions
+func (s *MemoryStore) SetCardRestrictions(ctx context.Context, newRestrictions *models.CardRestrictions) (*models.CardRestrictions, error) {
+	restrictions := normaliseRestrictions(newRestrictions)
+	if err := restrictions.Validate(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.cards[restrictions.CardID]; !ok {
+		return nil, models.NotFound
+	}
+	s.restrictions[restrictions.CardID] = *restrictions
+	return restrictions, nil
+}
+
+// s.mu must be held
+func (s *MemoryStore) cardRestrictions(cardId string) *models.CardRestrictions {
+	restrictions, ok := s.restrictions[cardId]
+	if !ok {
+		return &models.CardRestrictions{CardID: cardId, Allow: []string{}, Deny: []string{}}
+	}
+	return normaliseRestrictions(&restrictions)
+}
+
+// Lists merchants that haven't been deleted by id, see SQLStore.ListMerchants
+func (s *MemoryStore) ListMerchants(ctx context.Context, after string, limit int) (*models.MerchantList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, merchant := range s.merchants {
+		if id > after && merchant.DeletedAt == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	list := &models.MerchantList{Merchants: []*models.Merchant{}}
+	for _, id := range ids {
+		if len(list.Merchants) == limit {
+			list.Next = list.Merchants[limit-1].ID
+			break
+		}
+		merchant := s.merchants[id]
+		list.Merchants = append(list.Merchants, &merchant)
+	}
+	return list, nil
+}
+
+func (s *MemoryStore) UpdateMerchant(ctx context.Context, newMerchant *models.Merchant) (*models.Merchant, error) {
+	merchant := new(models.Merchant)
+	*merchant = *newMerchant
+	if err := prepareMerchant(merchant); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.merchants[merchant.ID]
+	if !ok || stored.DeletedAt != nil {
+		return nil, models.NotFound
+	}
+	if s.merchantNameTaken(merchant) {
+		return nil, models.MerchantExists
+	}
+	merchant.CreatedAt = stored.CreatedAt
+	merchant.UpdatedAt = time.Now()
+	merchant.DeletedAt = nil
+	s.merchants[merchant.ID] = *merchant
+	return merchant, nil
+}
+
+// Soft deletes the merchant, see SQLStore.DeleteMerchant
+func (s *MemoryStore) DeleteMerchant(ctx context.Context, merchantId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	merchant, ok := s.merchants[merchantId]
+	if !ok || merchant.DeletedAt != nil {
+		return models.NotFound
+	}
+	now := time.Now()
+	merchant.DeletedAt = &now
+	merchant.UpdatedAt = now
+	s.merchants[merchantId] = merchant
+	return nil
+}
+
+// Reports whether another merchant that hasn't been deleted has the same name, s.mu must be held
+func (s *MemoryStore) merchantNameTaken(merchant *models.Merchant) bool {
+	for _, m := range s.merchants {
+		if m.ID != merchant.ID && m.Name == merchant.Name && m.DeletedAt == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// The memory store has nothing to release
+func (s *MemoryStore) Close() error {
+	return nil
+}
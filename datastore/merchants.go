@@ -0,0 +1,50 @@
+package datastore
+
+import (
+	"prepaidcard/mcc"
+	"prepaidcard/models"
+	"sort"
+	"strings"
+)
+
+// Checks a new or updated merchant's name, currency and MCC, falling back to the code's description for its category
+func prepareMerchant(merchant *models.Merchant) error {
+	if strings.TrimSpace(merchant.ID) == "" || strings.TrimSpace(merchant.Name) == "" {
+		return models.InvalidMerchant
+	}
+	var err error
+	merchant.Currency, err = currencyOrDefault(merchant.Currency)
+	if err != nil {
+		return err
+	}
+	code, ok := mcc.Lookup(merchant.MCC)
+	if !ok {
+		return models.InvalidMCC
+	}
+	if merchant.Category == "" {
+		merchant.Category = code.Description
+	}
+	return nil
+}
+
+// Copies restrictions with the duplicate entries dropped and the lists sorted
+func normaliseRestrictions(restrictions *models.CardRestrictions) *models.CardRestrictions {
+	return &models.CardRestrictions{
+		CardID: restrictions.CardID,
+		Allow: uniqueSorted(restrictions.Allow),
+		Deny: uniqueSorted(restrictions.Deny),
+	}
+}
+
+func uniqueSorted(values []string) []string {
+	seen := make(map[string]bool)
+	unique := []string{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
@@ -0,0 +1,746 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+/*
+	A numbered change to the schema, with the statements that make it and undo it.
+	Statements use the dialect's {{placeholders}}, and each migration runs in its own transaction
+	along with its row in schema_migrations. Add new migrations to the end, never edit applied ones.
+	Where a dialect needs different SQL, dialectUp and dialectDown hold it keyed by the dialect's name.
+	before and after, when set, run in the same transaction around the up statements.
+ */
+type migration struct {
+	version		int
+	name		string
+	up			[]string
+	down		[]string
+	dialectUp	map[string][]string
+	dialectDown	map[string][]string
+	before		func(s *SQLStore, ctx context.Context, tx *sqlx.Tx) error
+	after		func(s *SQLStore, ctx context.Context, tx *sqlx.Tx) error
+}
+
+func (m migration) upOn(d dialect) []string {
+	if statements, ok := m.dialectUp[d.name]; ok {
+		return statements
+	}
+	return m.up
+}
+
+func (m migration) downOn(d dialect) []string {
+	if statements, ok := m.dialectDown[d.name]; ok {
+		return statements
+	}
+	return m.down
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name: "initial schema",
+		// A database created before migrations existed has its rows carried over to this layout, see legacy_schema.go
+		before: (*SQLStore).setAsideBaselineTables,
+		after: (*SQLStore).restoreBaselineRows,
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS cards (
+				id varchar(256) NOT NULL PRIMARY KEY,
+				card_number varchar(256) NOT NULL UNIQUE,
+				full_balance bigint NOT NULL,
+				blocked_balance bigint NOT NULL,
+				status varchar(16) NOT NULL DEFAULT 'active',
+				currency varchar(3) NOT NULL DEFAULT 'GBP',
+				created_at {{timestamp}},
+				updated_at {{timestamp}}
+			);`,
+
+			`CREATE TABLE IF NOT EXISTS merchants (
+				id varchar(256) NOT NULL PRIMARY KEY,
+				name varchar(256) NOT NULL,
+				mcc varchar(4) NOT NULL,
+				category varchar(256) NOT NULL,
+				address text NOT NULL,
+				currency varchar(3) NOT NULL DEFAULT 'GBP',
+				created_at {{timestamp}},
+				updated_at {{timestamp}},
+				deleted_at {{timestamp}}
+			);`,
+
+			// Names only have to be unique among merchants that haven't been deleted
+			`CREATE UNIQUE INDEX IF NOT EXISTS merchants_name ON merchants (name) WHERE deleted_at IS NULL;`,
+
+			`CREATE TABLE IF NOT EXISTS transactions (
+				id varchar(256) NOT NULL PRIMARY KEY,
+				card_id varchar(256) NOT NULL,
+				merchant_id varchar(256) NOT NULL,
+				original_amount	bigint NOT NULL,
+				authorized_amount bigint NOT NULL,
+				captured_amount bigint NOT NULL,
+				currency varchar(3) NOT NULL DEFAULT 'GBP',
+				merchant_amount bigint NOT NULL DEFAULT 0,
+				merchant_currency varchar(3) NOT NULL DEFAULT 'GBP',
+				fx_rate varchar(64) NOT NULL DEFAULT '1',
+				expires_at {{timestamp}},
+				created_at {{timestamp}},
+				updated_at {{timestamp}}
+			);`,
+
+			`CREATE TABLE IF NOT EXISTS card_limits (
+				id varchar(256) NOT NULL PRIMARY KEY,
+				card_id varchar(256) NOT NULL,
+				kind varchar(32) NOT NULL,
+				limit_window varchar(16) NOT NULL,
+				mcc varchar(64) NOT NULL,
+				limit_value bigint NOT NULL,
+				created_at {{timestamp}},
+				updated_at {{timestamp}}
+			);`,
+
+			`CREATE TABLE IF NOT EXISTS card_mcc_rules (
+				card_id varchar(256) NOT NULL,
+				list varchar(16) NOT NULL,
+				rule varchar(64) NOT NULL,
+				PRIMARY KEY (card_id, list, rule)
+			);`,
+
+			`CREATE TABLE IF NOT EXISTS transaction_events (
+				id varchar(256) NOT NULL PRIMARY KEY,
+				transaction_id varchar(256) NOT NULL,
+				kind varchar(64) NOT NULL,
+				amount bigint NOT NULL,
+				authorized_amount bigint NOT NULL,
+				captured_amount bigint NOT NULL,
+				created_at {{timestamp}}
+			);`,
+
+			`CREATE TABLE IF NOT EXISTS idempotency_keys (
+				idempotency_key varchar(256) NOT NULL PRIMARY KEY,
+				request_hash varchar(64) NOT NULL,
+				status_code integer NOT NULL,
+				response text NOT NULL,
+				created_at {{timestamp}},
+				updated_at {{timestamp}}
+			);`,
+
+			`CREATE TABLE IF NOT EXISTS journal_entries (
+				id varchar(256) NOT NULL PRIMARY KEY,
+				kind varchar(64) NOT NULL,
+				reference varchar(256) NOT NULL,
+				created_at {{timestamp}}
+			);`,
+
+			`CREATE TABLE IF NOT EXISTS postings (
+				id varchar(256) NOT NULL PRIMARY KEY,
+				entry_id varchar(256) NOT NULL,
+				account varchar(256) NOT NULL,
+				direction varchar(16) NOT NULL,
+				amount bigint NOT NULL,
+				currency varchar(3) NOT NULL DEFAULT 'GBP'
+			);`,
+
+			`DROP VIEW IF EXISTS user_transaction_list;`,
+			transactionListView,
+		},
+		down: []string{
+			`DROP VIEW IF EXISTS user_transaction_list;`,
+			`DROP TABLE IF EXISTS postings;`,
+			`DROP TABLE IF EXISTS journal_entries;`,
+			`DROP TABLE IF EXISTS idempotency_keys;`,
+			`DROP TABLE IF EXISTS transaction_events;`,
+			`DROP TABLE IF EXISTS card_mcc_rules;`,
+			`DROP TABLE IF EXISTS card_limits;`,
+			`DROP TABLE IF EXISTS transactions;`,
+			`DROP TABLE IF EXISTS merchants;`,
+			`DROP TABLE IF EXISTS cards;`,
+		},
+	},
+	{
+		version: 2,
+		name: "constraints and indexes",
+		up: append([]string{
+			`ALTER TABLE cards
+				ADD CONSTRAINT cards_full_balance_check CHECK (full_balance >= 0),
+				ADD CONSTRAINT cards_blocked_balance_check CHECK (blocked_balance >= 0 AND blocked_balance <= full_balance),
+				ADD CONSTRAINT cards_status_check CHECK (status IN ('active', 'frozen', 'blocked', 'closed'));`,
+			`ALTER TABLE transactions
+				ADD CONSTRAINT transactions_card_fk FOREIGN KEY (card_id) REFERENCES cards (id),
+				ADD CONSTRAINT transactions_merchant_fk FOREIGN KEY (merchant_id) REFERENCES merchants (id),
+				ADD CONSTRAINT transactions_amount_check CHECK (original_amount >= 0 AND merchant_amount >= 0),
+				ADD CONSTRAINT transactions_authorized_check CHECK (authorized_amount >= 0),
+				ADD CONSTRAINT transactions_captured_check CHECK (captured_amount >= 0);`,
+			`ALTER TABLE card_limits
+				ADD CONSTRAINT card_limits_card_fk FOREIGN KEY (card_id) REFERENCES cards (id),
+				ADD CONSTRAINT card_limits_kind_check CHECK (kind IN ('max_auth', 'spend', 'auth_count')),
+				ADD CONSTRAINT card_limits_value_check CHECK (limit_value > 0);`,
+			`ALTER TABLE card_mcc_rules
+				ADD CONSTRAINT card_mcc_rules_card_fk FOREIGN KEY (card_id) REFERENCES cards (id),
+				ADD CONSTRAINT card_mcc_rules_list_check CHECK (list IN ('allow', 'deny'));`,
+			`ALTER TABLE transaction_events
+				ADD CONSTRAINT transaction_events_transaction_fk FOREIGN KEY (transaction_id) REFERENCES transactions (id),
+				ADD CONSTRAINT transaction_events_amount_check CHECK (amount >= 0 AND authorized_amount >= 0 AND captured_amount >= 0);`,
+			`ALTER TABLE postings
+				ADD CONSTRAINT postings_entry_fk FOREIGN KEY (entry_id) REFERENCES journal_entries (id),
+				ADD CONSTRAINT postings_direction_check CHECK (direction IN ('debit', 'credit')),
+				ADD CONSTRAINT postings_amount_check CHECK (amount >= 0);`,
+		}, constraintIndexes...),
+		down: append(dropConstraintIndexes, []string{
+			`ALTER TABLE postings
+				DROP CONSTRAINT IF EXISTS postings_entry_fk,
+				DROP CONSTRAINT IF EXISTS postings_direction_check,
+				DROP CONSTRAINT IF EXISTS postings_amount_check;`,
+			`ALTER TABLE transaction_events
+				DROP CONSTRAINT IF EXISTS transaction_events_transaction_fk,
+				DROP CONSTRAINT IF EXISTS transaction_events_amount_check;`,
+			`ALTER TABLE card_mcc_rules
+				DROP CONSTRAINT IF EXISTS card_mcc_rules_card_fk,
+				DROP CONSTRAINT IF EXISTS card_mcc_rules_list_check;`,
+			`ALTER TABLE card_limits
+				DROP CONSTRAINT IF EXISTS card_limits_card_fk,
+				DROP CONSTRAINT IF EXISTS card_limits_kind_check,
+				DROP CONSTRAINT IF EXISTS card_limits_value_check;`,
+			`ALTER TABLE transactions
+				DROP CONSTRAINT IF EXISTS transactions_card_fk,
+				DROP CONSTRAINT IF EXISTS transactions_merchant_fk,
+				DROP CONSTRAINT IF EXISTS transactions_amount_check,
+				DROP CONSTRAINT IF EXISTS transactions_authorized_check,
+				DROP CONSTRAINT IF EXISTS transactions_captured_check;`,
+			`ALTER TABLE cards
+				DROP CONSTRAINT IF EXISTS cards_full_balance_check,
+				DROP CONSTRAINT IF EXISTS cards_blocked_balance_check,
+				DROP CONSTRAINT IF EXISTS cards_status_check;`,
+		}...),
+		// SQLite can't add constraints to a table, so it rebuilds them instead
+		dialectUp: map[string][]string{
+			sqliteDialect.name: rebuildSQLiteTables(constrainedTables, constraintIndexes),
+		},
+		dialectDown: map[string][]string{
+			sqliteDialect.name: rebuildSQLiteTables(unconstrainedTables, nil),
+		},
+	},
+	{
+		version: 3,
+		name: "spending filters",
+		// Adds the merchant and a status to the view, and pages each card's transactions off one index
+		up: []string{
+			`DROP VIEW IF EXISTS user_transaction_list;`,
+			spendingFiltersView,
+			`CREATE INDEX IF NOT EXISTS transactions_card_id_id ON transactions (card_id, id);`,
+			`DROP INDEX IF EXISTS transactions_card_id;`,
+		},
+		down: []string{
+			`CREATE INDEX IF NOT EXISTS transactions_card_id ON transactions (card_id);`,
+			`DROP INDEX IF EXISTS transactions_card_id_id;`,
+			`DROP VIEW IF EXISTS user_transaction_list;`,
+			transactionListView,
+		},
+	},
+	{
+		version: 4,
+		name: "captures",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS captures (
+				id varchar(256) NOT NULL PRIMARY KEY,
+				transaction_id varchar(256) NOT NULL,
+				amount bigint NOT NULL,
+				refunded_amount bigint NOT NULL DEFAULT 0,
+				final boolean NOT NULL DEFAULT FALSE,
+				created_at {{timestamp}},
+				updated_at {{timestamp}},
+				CONSTRAINT captures_transaction_fk FOREIGN KEY (transaction_id) REFERENCES transactions (id),
+				CONSTRAINT captures_amount_check CHECK (amount > 0),
+				CONSTRAINT captures_refunded_check CHECK (refunded_amount >= 0 AND refunded_amount <= amount)
+			);`,
+			`CREATE INDEX IF NOT EXISTS captures_transaction_id ON captures (transaction_id);`,
+			// Whatever was captured before captures were recorded becomes one capture with the transaction's id,
+			// carrying the refunds made against it so far
+			`INSERT INTO captures (id, transaction_id, amount, refunded_amount, final, created_at, updated_at)
+				SELECT id, id, captured_amount + refunded, refunded, FALSE, updated_at, updated_at FROM (
+					SELECT transactions.id, transactions.captured_amount, transactions.updated_at,
+						COALESCE((SELECT SUM(amount) FROM transaction_events WHERE transaction_id = transactions.id AND kind = 'refund'), 0) refunded
+					FROM transactions
+				) captured WHERE captured_amount + refunded > 0;`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS captures;`,
+		},
+	},
+	{
+		version: 5,
+		name: "over-captures",
+		up: []string{
+			`ALTER TABLE captures ADD COLUMN over_captured_amount bigint NOT NULL DEFAULT 0
+				CONSTRAINT captures_over_captured_check CHECK (over_captured_amount >= 0 AND over_captured_amount <= amount);`,
+		},
+		down: []string{
+			`ALTER TABLE captures DROP COLUMN IF EXISTS over_captured_amount;`,
+		},
+		// The SQLite bundled with the driver can't drop columns, so the table is rebuilt as migration 4 made it
+		dialectDown: map[string][]string{
+			sqliteDialect.name: {
+				`ALTER TABLE captures RENAME TO captures_old;`,
+				`CREATE TABLE captures (
+					id varchar(256) NOT NULL PRIMARY KEY,
+					transaction_id varchar(256) NOT NULL,
+					amount bigint NOT NULL,
+					refunded_amount bigint NOT NULL DEFAULT 0,
+					final boolean NOT NULL DEFAULT FALSE,
+					created_at {{timestamp}},
+					updated_at {{timestamp}},
+					CONSTRAINT captures_transaction_fk FOREIGN KEY (transaction_id) REFERENCES transactions (id),
+					CONSTRAINT captures_amount_check CHECK (amount > 0),
+					CONSTRAINT captures_refunded_check CHECK (refunded_amount >= 0 AND refunded_amount <= amount)
+				);`,
+				`INSERT INTO captures SELECT id, transaction_id, amount, refunded_amount, final, created_at, updated_at FROM captures_old;`,
+				`DROP TABLE captures_old;`,
+				`CREATE INDEX IF NOT EXISTS captures_transaction_id ON captures (transaction_id);`,
+			},
+		},
+	},
+	{
+		version: 6,
+		name: "transaction status",
+		// Existing transactions get the status their amounts, refunds and expiry give them, see Transaction.UpdateStatus
+		up: []string{
+			`ALTER TABLE transactions ADD COLUMN status varchar(32) NOT NULL DEFAULT 'pending'
+				CONSTRAINT transactions_status_check CHECK (status IN ('pending', 'partially_captured', 'captured', 'partially_refunded', 'refunded', 'reversed', 'expired'));`,
+			fmt.Sprintf(`UPDATE transactions SET status = CASE
+				WHEN authorized_amount > 0 AND captured_amount + %[1]s = 0 THEN 'pending'
+				WHEN authorized_amount > 0 THEN 'partially_captured'
+				WHEN captured_amount + %[1]s = 0 AND EXISTS (SELECT 1 FROM transaction_events WHERE transaction_id = transactions.id AND kind = 'expire') THEN 'expired'
+				WHEN captured_amount + %[1]s = 0 THEN 'reversed'
+				WHEN captured_amount = 0 THEN 'refunded'
+				WHEN %[1]s > 0 THEN 'partially_refunded'
+				ELSE 'captured' END;`,
+				`COALESCE((SELECT SUM(refunded_amount) FROM captures WHERE transaction_id = transactions.id), 0)`),
+			`DROP VIEW IF EXISTS user_transaction_list;`,
+			`CREATE VIEW user_transaction_list AS
+				SELECT cards.id card_id, cards.card_number card_number, transactions.id transaction_id, merchants.id merchant_id, merchants.mcc merchant_mcc, merchants.category merchant_category, merchants.name merchant_name, transactions.original_amount auth_amount, transactions.captured_amount amount, transactions.currency currency,
+					transactions.status status, transactions.created_at auth_time FROM transactions
+				JOIN merchants ON transactions.merchant_id = merchants.id
+				JOIN cards ON transactions.card_id = cards.id;`,
+		},
+		down: []string{
+			`DROP VIEW IF EXISTS user_transaction_list;`,
+			`ALTER TABLE transactions DROP COLUMN IF EXISTS status;`,
+			spendingFiltersView,
+		},
+		/*
+			SQLite can't drop the column, so transactions is rebuilt as migration 2 made it, along with the tables
+			whose foreign keys point at it, in the same way as rebuildSQLiteTables
+		 */
+		dialectDown: map[string][]string{
+			sqliteDialect.name: {
+				`DROP VIEW IF EXISTS user_transaction_list;`,
+				`ALTER TABLE transactions RENAME TO transactions_old;`,
+				`ALTER TABLE transaction_events RENAME TO transaction_events_old;`,
+				`ALTER TABLE captures RENAME TO captures_old;`,
+				"CREATE TABLE transactions (" + constrainedTables[1].columns + "\n);",
+				"CREATE TABLE transaction_events (" + constrainedTables[4].columns + "\n);",
+				`CREATE TABLE captures (
+					id varchar(256) NOT NULL PRIMARY KEY,
+					transaction_id varchar(256) NOT NULL,
+					amount bigint NOT NULL,
+					refunded_amount bigint NOT NULL DEFAULT 0,
+					final boolean NOT NULL DEFAULT FALSE,
+					created_at {{timestamp}},
+					updated_at {{timestamp}},
+					over_captured_amount bigint NOT NULL DEFAULT 0,
+					CONSTRAINT captures_transaction_fk FOREIGN KEY (transaction_id) REFERENCES transactions (id),
+					CONSTRAINT captures_amount_check CHECK (amount > 0),
+					CONSTRAINT captures_refunded_check CHECK (refunded_amount >= 0 AND refunded_amount <= amount),
+					CONSTRAINT captures_over_captured_check CHECK (over_captured_amount >= 0 AND over_captured_amount <= amount)
+				);`,
+				`INSERT INTO transactions SELECT id, card_id, merchant_id, original_amount, authorized_amount, captured_amount, currency,
+					merchant_amount, merchant_currency, fx_rate, expires_at, created_at, updated_at FROM transactions_old;`,
+				`INSERT INTO transaction_events SELECT * FROM transaction_events_old;`,
+				`INSERT INTO captures SELECT * FROM captures_old;`,
+				`DROP TABLE captures_old;`,
+				`DROP TABLE transaction_events_old;`,
+				`DROP TABLE transactions_old;`,
+				`CREATE INDEX IF NOT EXISTS transactions_card_id_id ON transactions (card_id, id);`,
+				`CREATE INDEX IF NOT EXISTS transactions_merchant_id ON transactions (merchant_id);`,
+				`CREATE INDEX IF NOT EXISTS transactions_expires_at ON transactions (expires_at) WHERE authorized_amount > 0;`,
+				`CREATE INDEX IF NOT EXISTS transaction_events_transaction_id ON transaction_events (transaction_id);`,
+				`CREATE INDEX IF NOT EXISTS captures_transaction_id ON captures (transaction_id);`,
+				spendingFiltersView,
+			},
+		},
+	},
+	{
+		version: 7,
+		name: "transfers",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS transfers (
+				id varchar(256) NOT NULL PRIMARY KEY,
+				from_card_id varchar(256) NOT NULL,
+				to_card_id varchar(256) NOT NULL,
+				amount bigint NOT NULL,
+				currency varchar(3) NOT NULL,
+				status varchar(16) NOT NULL DEFAULT 'completed',
+				created_at {{timestamp}},
+				updated_at {{timestamp}},
+				reversed_at {{timestamp}},
+				CONSTRAINT transfers_from_card_fk FOREIGN KEY (from_card_id) REFERENCES cards (id),
+				CONSTRAINT transfers_to_card_fk FOREIGN KEY (to_card_id) REFERENCES cards (id),
+				CONSTRAINT transfers_cards_check CHECK (from_card_id <> to_card_id),
+				CONSTRAINT transfers_amount_check CHECK (amount > 0),
+				CONSTRAINT transfers_status_check CHECK (status IN ('completed', 'reversed'))
+			);`,
+			// Each card's transfers are listed in id order, whichever side of them it was on
+			`CREATE INDEX IF NOT EXISTS transfers_from_card_id_id ON transfers (from_card_id, id);`,
+			`CREATE INDEX IF NOT EXISTS transfers_to_card_id_id ON transfers (to_card_id, id);`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS transfers;`,
+		},
+	},
+}
+
+// The view as migrations 1 and 2 left it
+const transactionListView = `CREATE VIEW user_transaction_list AS
+	SELECT cards.id card_id, cards.card_number card_number, transactions.id transaction_id, merchants.mcc merchant_mcc, merchants.category merchant_category, merchants.name merchant_name, transactions.original_amount auth_amount, transactions.captured_amount amount, transactions.currency currency, transactions.created_at auth_time FROM transactions
+	JOIN merchants ON transactions.merchant_id = merchants.id
+	JOIN cards ON transactions.card_id = cards.id;`
+
+// The view as migration 3 left it, with the merchant and a status worked out from the amounts
+const spendingFiltersView = `CREATE VIEW user_transaction_list AS
+	SELECT cards.id card_id, cards.card_number card_number, transactions.id transaction_id, merchants.id merchant_id, merchants.mcc merchant_mcc, merchants.category merchant_category, merchants.name merchant_name, transactions.original_amount auth_amount, transactions.captured_amount amount, transactions.currency currency,
+		CASE WHEN transactions.authorized_amount > 0 THEN 'pending' WHEN transactions.captured_amount > 0 THEN 'settled' ELSE 'closed' END status,
+		transactions.created_at auth_time FROM transactions
+	JOIN merchants ON transactions.merchant_id = merchants.id
+	JOIN cards ON transactions.card_id = cards.id;`
+
+// Indexes on the columns the store filters and joins on, foreign keys aren't indexed by themselves
+var constraintIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS transactions_card_id ON transactions (card_id);`,
+	`CREATE INDEX IF NOT EXISTS transactions_merchant_id ON transactions (merchant_id);`,
+	`CREATE INDEX IF NOT EXISTS transactions_expires_at ON transactions (expires_at) WHERE authorized_amount > 0;`,
+	`CREATE INDEX IF NOT EXISTS card_limits_card_id ON card_limits (card_id);`,
+	`CREATE INDEX IF NOT EXISTS transaction_events_transaction_id ON transaction_events (transaction_id);`,
+	`CREATE INDEX IF NOT EXISTS postings_entry_id ON postings (entry_id);`,
+	`CREATE INDEX IF NOT EXISTS postings_account ON postings (account);`,
+}
+
+var dropConstraintIndexes = []string{
+	`DROP INDEX IF EXISTS postings_account;`,
+	`DROP INDEX IF EXISTS postings_entry_id;`,
+	`DROP INDEX IF EXISTS transaction_events_transaction_id;`,
+	`DROP INDEX IF EXISTS card_limits_card_id;`,
+	`DROP INDEX IF EXISTS transactions_expires_at;`,
+	`DROP INDEX IF EXISTS transactions_merchant_id;`,
+	`DROP INDEX IF EXISTS transactions_card_id;`,
+}
+
+// The definition of a table for rebuildSQLiteTables, columns is everything between the brackets of its CREATE TABLE
+type tableDefinition struct {
+	name	string
+	columns	string
+}
+
+// The tables migration 2 rebuilds on SQLite, parents first, with the same constraints it adds on postgres
+var constrainedTables = []tableDefinition{
+	{"cards", `
+		id varchar(256) NOT NULL PRIMARY KEY,
+		card_number varchar(256) NOT NULL UNIQUE,
+		full_balance bigint NOT NULL,
+		blocked_balance bigint NOT NULL,
+		status varchar(16) NOT NULL DEFAULT 'active',
+		currency varchar(3) NOT NULL DEFAULT 'GBP',
+		created_at {{timestamp}},
+		updated_at {{timestamp}},
+		CONSTRAINT cards_full_balance_check CHECK (full_balance >= 0),
+		CONSTRAINT cards_blocked_balance_check CHECK (blocked_balance >= 0 AND blocked_balance <= full_balance),
+		CONSTRAINT cards_status_check CHECK (status IN ('active', 'frozen', 'blocked', 'closed'))`},
+	{"transactions", `
+		id varchar(256) NOT NULL PRIMARY KEY,
+		card_id varchar(256) NOT NULL,
+		merchant_id varchar(256) NOT NULL,
+		original_amount	bigint NOT NULL,
+		authorized_amount bigint NOT NULL,
+		captured_amount bigint NOT NULL,
+		currency varchar(3) NOT NULL DEFAULT 'GBP',
+		merchant_amount bigint NOT NULL DEFAULT 0,
+		merchant_currency varchar(3) NOT NULL DEFAULT 'GBP',
+		fx_rate varchar(64) NOT NULL DEFAULT '1',
+		expires_at {{timestamp}},
+		created_at {{timestamp}},
+		updated_at {{timestamp}},
+		CONSTRAINT transactions_card_fk FOREIGN KEY (card_id) REFERENCES cards (id),
+		CONSTRAINT transactions_merchant_fk FOREIGN KEY (merchant_id) REFERENCES merchants (id),
+		CONSTRAINT transactions_amount_check CHECK (original_amount >= 0 AND merchant_amount >= 0),
+		CONSTRAINT transactions_authorized_check CHECK (authorized_amount >= 0),
+		CONSTRAINT transactions_captured_check CHECK (captured_amount >= 0)`},
+	{"card_limits", `
+		id varchar(256) NOT NULL PRIMARY KEY,
+		card_id varchar(256) NOT NULL,
+		kind varchar(32) NOT NULL,
+		limit_window varchar(16) NOT NULL,
+		mcc varchar(64) NOT NULL,
+		limit_value bigint NOT NULL,
+		created_at {{timestamp}},
+		updated_at {{timestamp}},
+		CONSTRAINT card_limits_card_fk FOREIGN KEY (card_id) REFERENCES cards (id),
+		CONSTRAINT card_limits_kind_check CHECK (kind IN ('max_auth', 'spend', 'auth_count')),
+		CONSTRAINT card_limits_value_check CHECK (limit_value > 0)`},
+	{"card_mcc_rules", `
+		card_id varchar(256) NOT NULL,
+		list varchar(16) NOT NULL,
+		rule varchar(64) NOT NULL,
+		PRIMARY KEY (card_id, list, rule),
+		CONSTRAINT card_mcc_rules_card_fk FOREIGN KEY (card_id) REFERENCES cards (id),
+		CONSTRAINT card_mcc_rules_list_check CHECK (list IN ('allow', 'deny'))`},
+	{"transaction_events", `
+		id varchar(256) NOT NULL PRIMARY KEY,
+		transaction_id varchar(256) NOT NULL,
+		kind varchar(64) NOT NULL,
+		amount bigint NOT NULL,
+		authorized_amount bigint NOT NULL,
+		captured_amount bigint NOT NULL,
+		created_at {{timestamp}},
+		CONSTRAINT transaction_events_transaction_fk FOREIGN KEY (transaction_id) REFERENCES transactions (id),
+		CONSTRAINT transaction_events_amount_check CHECK (amount >= 0 AND authorized_amount >= 0 AND captured_amount >= 0)`},
+	{"postings", `
+		id varchar(256) NOT NULL PRIMARY KEY,
+		entry_id varchar(256) NOT NULL,
+		account varchar(256) NOT NULL,
+		direction varchar(16) NOT NULL,
+		amount bigint NOT NULL,
+		currency varchar(3) NOT NULL DEFAULT 'GBP',
+		CONSTRAINT postings_entry_fk FOREIGN KEY (entry_id) REFERENCES journal_entries (id),
+		CONSTRAINT postings_direction_check CHECK (direction IN ('debit', 'credit')),
+		CONSTRAINT postings_amount_check CHECK (amount >= 0)`},
+}
+
+// The same tables as they were in migration 1, for reverting migration 2 on SQLite
+var unconstrainedTables = []tableDefinition{
+	{"cards", `
+		id varchar(256) NOT NULL PRIMARY KEY,
+		card_number varchar(256) NOT NULL UNIQUE,
+		full_balance bigint NOT NULL,
+		blocked_balance bigint NOT NULL,
+		status varchar(16) NOT NULL DEFAULT 'active',
+		currency varchar(3) NOT NULL DEFAULT 'GBP',
+		created_at {{timestamp}},
+		updated_at {{timestamp}}`},
+	{"transactions", `
+		id varchar(256) NOT NULL PRIMARY KEY,
+		card_id varchar(256) NOT NULL,
+		merchant_id varchar(256) NOT NULL,
+		original_amount	bigint NOT NULL,
+		authorized_amount bigint NOT NULL,
+		captured_amount bigint NOT NULL,
+		currency varchar(3) NOT NULL DEFAULT 'GBP',
+		merchant_amount bigint NOT NULL DEFAULT 0,
+		merchant_currency varchar(3) NOT NULL DEFAULT 'GBP',
+		fx_rate varchar(64) NOT NULL DEFAULT '1',
+		expires_at {{timestamp}},
+		created_at {{timestamp}},
+		updated_at {{timestamp}}`},
+	{"card_limits", `
+		id varchar(256) NOT NULL PRIMARY KEY,
+		card_id varchar(256) NOT NULL,
+		kind varchar(32) NOT NULL,
+		limit_window varchar(16) NOT NULL,
+		mcc varchar(64) NOT NULL,
+		limit_value bigint NOT NULL,
+		created_at {{timestamp}},
+		updated_at {{timestamp}}`},
+	{"card_mcc_rules", `
+		card_id varchar(256) NOT NULL,
+		list varchar(16) NOT NULL,
+		rule varchar(64) NOT NULL,
+		PRIMARY KEY (card_id, list, rule)`},
+	{"transaction_events", `
+		id varchar(256) NOT NULL PRIMARY KEY,
+		transaction_id varchar(256) NOT NULL,
+		kind varchar(64) NOT NULL,
+		amount bigint NOT NULL,
+		authorized_amount bigint NOT NULL,
+		captured_amount bigint NOT NULL,
+		created_at {{timestamp}}`},
+	{"postings", `
+		id varchar(256) NOT NULL PRIMARY KEY,
+		entry_id varchar(256) NOT NULL,
+		account varchar(256) NOT NULL,
+		direction varchar(16) NOT NULL,
+		amount bigint NOT NULL,
+		currency varchar(3) NOT NULL DEFAULT 'GBP'`},
+}
+
+/*
+	The statements that replace SQLite tables with new definitions, keeping their rows
+	Every table is renamed out of the way before any are created, so the new foreign keys point at the new tables,
+	then each is refilled parents first and the old copies dropped children first. Columns must keep their order.
+	The view is dropped and made again around the rebuild, and indexes are created once the new tables are filled.
+ */
+func rebuildSQLiteTables(tables []tableDefinition, indexes []string) []string {
+	statements := []string{`DROP VIEW IF EXISTS user_transaction_list;`}
+	for _, table := range tables {
+		statements = append(statements, fmt.Sprintf(`ALTER TABLE %s RENAME TO %s_old;`, table.name, table.name))
+	}
+	for _, table := range tables {
+		statements = append(statements, fmt.Sprintf("CREATE TABLE %s (%s\n);", table.name, table.columns))
+	}
+	for _, table := range tables {
+		statements = append(statements, fmt.Sprintf(`INSERT INTO %s SELECT * FROM %s_old;`, table.name, table.name))
+	}
+	for i := len(tables) - 1; i >= 0; i-- {
+		statements = append(statements, fmt.Sprintf(`DROP TABLE %s_old;`, tables[i].name))
+	}
+	statements = append(statements, indexes...)
+	return append(statements, transactionListView)
+}
+
+const schemaMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version integer NOT NULL PRIMARY KEY,
+	name varchar(256) NOT NULL,
+	applied_at {{timestamp}}
+);`
+
+// A migration and when it was applied, AppliedAt is nil while it is pending
+type MigrationStatus struct {
+	Version		int
+	Name		string
+	AppliedAt	*time.Time
+}
+
+// Returned when the database is missing migrations the app needs
+type ErrSchemaBehind struct {
+	Current	int
+	Latest	int
+}
+
+func (e ErrSchemaBehind) Error() string {
+	return fmt.Sprintf("database schema is at version %d but this build needs version %d, run `prepaidcard migrate up`", e.Current, e.Latest)
+}
+
+// Lists every migration the app knows about, and whether it has been applied
+func (s *SQLStore) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	if _, err := s.db.ExecContext(ctx, s.dialect.placeholders.Replace(schemaMigrationsTable)); err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Version		int			`db:"version"`
+		AppliedAt	time.Time	`db:"applied_at"`
+	}
+	err := s.db.SelectContext(ctx, &rows, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]time.Time)
+	for _, row := range rows {
+		applied[row.Version] = row.AppliedAt
+	}
+	var statuses []MigrationStatus
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.version, Name: m.name}
+		if at, ok := applied[m.version]; ok {
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Applies every pending migration in order, returning the ones it applied
+func (s *SQLStore) MigrateUp(ctx context.Context) ([]MigrationStatus, error) {
+	statuses, err := s.MigrationStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var applied []MigrationStatus
+	for i, status := range statuses {
+		if status.AppliedAt != nil {
+			continue
+		}
+		m := migrations[i]
+		now := time.Now()
+		err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+			if m.before != nil {
+				if err := m.before(s, ctx, tx); err != nil {
+					return err
+				}
+			}
+			if err := s.execAll(ctx, tx, m.upOn(s.dialect)); err != nil {
+				return err
+			}
+			if m.after != nil {
+				if err := m.after(s, ctx, tx); err != nil {
+					return err
+				}
+			}
+			query := tx.Rebind(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`)
+			_, err := tx.ExecContext(ctx, query, m.version, m.name, now)
+			return err
+		})
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+		}
+		status.AppliedAt = &now
+		applied = append(applied, status)
+	}
+	return applied, nil
+}
+
+// Reverts the latest steps applied migrations, newest first, returning the ones it reverted
+func (s *SQLStore) MigrateDown(ctx context.Context, steps int) ([]MigrationStatus, error) {
+	statuses, err := s.MigrationStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var reverted []MigrationStatus
+	for i := len(statuses) - 1; i >= 0 && len(reverted) < steps; i-- {
+		if statuses[i].AppliedAt == nil {
+			continue
+		}
+		m := migrations[i]
+		err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+			if err := s.execAll(ctx, tx, m.downOn(s.dialect)); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, tx.Rebind(`DELETE FROM schema_migrations WHERE version=?`), m.version)
+			return err
+		})
+		if err != nil {
+			return reverted, fmt.Errorf("reverting migration %d (%s): %v", m.version, m.name, err)
+		}
+		status := statuses[i]
+		status.AppliedAt = nil
+		reverted = append(reverted, status)
+	}
+	return reverted, nil
+}
+
+// Returns ErrSchemaBehind unless every migration has been applied
+func (s *SQLStore) CheckSchema(ctx context.Context) error {
+	statuses, err := s.MigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+	current := 0
+	pending := false
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			pending = true
+		} else if status.Version > current {
+			current = status.Version
+		}
+	}
+	if pending {
+		return ErrSchemaBehind{Current: current, Latest: migrations[len(migrations)-1].version}
+	}
+	return nil
+}
+
+func (s *SQLStore) execAll(ctx context.Context, tx *sqlx.Tx, statements []string) error {
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, s.dialect.placeholders.Replace(statement)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
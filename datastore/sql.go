@@ -1,126 +1,176 @@
 package datastore
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
 	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid"
-	"math/rand"
 	"prepaidcard/models"
 	"time"
 )
 
-var tables = [...]string{
-	`CREATE TABLE IF NOT EXISTS cards (
-	card_number varchar(256) NOT NULL PRIMARY KEY,
-	full_balance bigint NOT NULL,
-	blocked_balance bigint NOT NULL,
-	created_at timestamp without time zone,
-	updated_at timestamp without time zone
-);`,
-
-	`CREATE TABLE IF NOT EXISTS merchants (
-	id varchar(256) NOT NULL PRIMARY KEY,
-	name varchar(256) NOT NULL UNIQUE,
-	type varchar(256) NOT NULL,
-	address text NOT NULL,
-	created_at timestamp without time zone,
-	updated_at timestamp without time zone
-);`,
-
-	`CREATE TABLE IF NOT EXISTS transactions (
-	id varchar(256) NOT NULL PRIMARY KEY,
-	card_id varchar(256) NOT NULL,
-	merchant_id varchar(256) NOT NULL,
-	original_amount	bigint NOT NULL,
-	authorized_amount bigint NOT NULL,
-	captured_amount bigint NOT NULL,
-	created_at timestamp without time zone,
-	updated_at timestamp without time zone
-);`,
-
-	`CREATE OR REPLACE VIEW user_transaction_list AS
-	SELECT cards.card_number card_id, transactions.id transaction_id, merchants.type merchant_type, merchants.name merchant_name, transactions.original_amount auth_amount, transactions.captured_amount amount, transactions.created_at auth_time FROM transactions
-	JOIN merchants ON transactions.merchant_id = merchants.id
-	JOIN cards ON transactions.card_id = cards.card_number
-;`,
-}
-
 const (
-	cardNumberLength = 16
-	cardNumbers = "0123456789"
-	cardIdSelector = `SELECT * FROM cards WHERE card_number=?`
-	merchantIdSelector = `SELECT * FROM merchants WHERE id=?`
+	maxCardNumberAttempts = 5
+	cardIdSelector = `SELECT * FROM cards WHERE id=?`
+	cardNumberSelector = `SELECT * FROM cards WHERE card_number=?`
+	merchantIdSelector = `SELECT * FROM merchants WHERE id=? AND deleted_at IS NULL`
+	merchantListQuery = `SELECT * FROM merchants WHERE deleted_at IS NULL AND id > ? ORDER BY id LIMIT ?`
 	transactionIdSelector = `SELECT * FROM transactions WHERE id=?`
-	transactionListQuery = `SELECT * FROM user_transaction_list WHERE card_id=? ORDER BY user_transaction_list.auth_time DESC`
+	expiredAuthsQuery = `SELECT id FROM transactions WHERE authorized_amount > 0 AND expires_at <= ? ORDER BY expires_at`
+	transactionEventsQuery = `SELECT * FROM transaction_events WHERE transaction_id=? ORDER BY created_at, id`
 )
 
 type SQLStore struct {
-	db	*sqlx.DB
+	db		*sqlx.DB
+	dialect	dialect
+	options	Options
 }
 
 func newId(createdTime time.Time) ulid.ULID {
 	now := ulid.Timestamp(createdTime)
-	id, _ := ulid.New(now, nil) // Only err if createdTime > max time in unix ms
+	id, _ := ulid.New(now, rand.Reader) // Only err if createdTime > max time in unix ms
 	return id
 }
 
-func InitDB(db *sqlx.DB) (*SQLStore, error) {
-	ds := &SQLStore{db: db}
-	tx, err := ds.db.Beginx()
+// Wraps db in a store, the schema must already be up to date, see MigrateUp
+func NewSQLStore(db *sqlx.DB) (*SQLStore, error) {
+	d, err := dialectFor(db.DriverName())
 	if err != nil {
 		return nil, err
 	}
-	for _, v := range tables {
-		_, err := tx.Exec(v)
-		if err != nil {
-			tx.Rollback()
-			return nil, err
-		}
-	}
+	return &SQLStore{db: db, dialect: d, options: Options{}.withDefaults()}, nil
+}
+
+/*
+	Runs fn inside a DB transaction, committing if it succeeds and rolling back if it returns an error or ctx is cancelled
+	Constraint violations from fn or the commit come back as ApiErrors, see constraintError.
+ */
+func (s *SQLStore) inTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
 	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
 		tx.Rollback()
+		return constraintError(err)
+	}
+	return constraintError(tx.Commit())
+}
+
+// Reads a card inside tx, holding a row lock on it until tx finishes
+func (s *SQLStore) lockCard(ctx context.Context, tx *sqlx.Tx, cardId string) (*models.PrepaidCard, error) {
+	var card models.PrepaidCard
+	query := tx.Rebind(s.dialect.forUpdate(cardIdSelector))
+	err := tx.QueryRowxContext(ctx, query, cardId).StructScan(&card)
+	if err == sql.ErrNoRows {
+		return nil, models.NotFound
+	}
+	if err != nil {
 		return nil, err
 	}
-	tx.Commit()
-	return ds, nil
+	return &card, nil
 }
 
-func (s *SQLStore) CreateCard() (*models.PrepaidCard, error) {
+// Reads a transaction inside tx, holding a row lock on it until tx finishes
+func (s *SQLStore) lockTransaction(ctx context.Context, tx *sqlx.Tx, transactionId string) (*models.Transaction, error) {
+	var transaction models.Transaction
+	query := tx.Rebind(s.dialect.forUpdate(transactionIdSelector))
+	err := tx.QueryRowxContext(ctx, query, transactionId).StructScan(&transaction)
+	if err == sql.ErrNoRows {
+		return nil, models.NotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+func (s *SQLStore) CreateCard(ctx context.Context, currency string) (*models.PrepaidCard, error) {
+	return s.CreateCardWithID(ctx, "", currency, 0)
+}
+
+/*
+	Creates a new card with a freshly generated number, and cardId as its id unless it's empty
+	A balance above 0 is loaded onto the card in the same transaction, so the card never exists without it.
+	Numbers are random, so on the rare collision with an existing card a new one is generated and the insert retried.
+	A collision on a chosen id is CardExists.
+ */
+func (s *SQLStore) CreateCardWithID(ctx context.Context, cardId string, currency string, balance int64) (*models.PrepaidCard, error) {
 	var card models.PrepaidCard
+	var err error
+	card.Currency, err = currencyOrDefault(currency)
+	if err != nil {
+		return nil, err
+	}
+	if balance < 0 {
+		return nil, models.InvalidAmount
+	}
 	card.CreatedAt = time.Now()
 	card.UpdatedAt = card.CreatedAt
-	// TODO: Feels kind of hacky, but gets the job done for now
-	newNumberBytes := make([]byte, cardNumberLength)
-	rand.Seed(time.Now().Unix())
-	for i := range newNumberBytes {
-		newNumberBytes[i] = cardNumbers[rand.Intn(len(cardNumbers))]
+	card.Status = models.CardActive
+	card.FullBalance = balance
+	card.ID = cardId
+	if card.ID == "" {
+		card.ID = newId(card.CreatedAt).String()
 	}
-	card.CardNumber = string(newNumberBytes)
 	query := s.db.Rebind(`INSERT INTO cards (
+			id,
 			card_number,
 			full_balance,
 			blocked_balance,
+			status,
+			currency,
 			created_at,
 			updated_at
 	)
 	VALUES (
+			:id,
 			:card_number,
 			:full_balance,
 			:blocked_balance,
+			:status,
+			:currency,
 			:created_at,
 			:updated_at
 	);`)
-	_, err := s.db.NamedExec(query, &card)
-	if err != nil {
-		return nil, err
+	for attempt := 0; attempt < maxCardNumberAttempts; attempt++ {
+		number, err := s.options.CardNumbers.Generate()
+		if err != nil {
+			return nil, err
+		}
+		card.CardNumber = number
+		err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+			_, err := tx.NamedExecContext(ctx, query, &card)
+			if isUniqueViolation(err) {
+				return errCardCollision
+			}
+			if err != nil {
+				return err
+			}
+			if balance > 0 {
+				return s.postEntry(ctx, tx, loadEntry(&card, balance))
+			}
+			return nil
+		})
+		if err == errCardCollision {
+			if _, getErr := s.GetCard(ctx, card.ID); getErr == nil {
+				return nil, models.CardExists
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &card, nil
 	}
-	return &card, nil
+	return nil, errCardNumberCollision
 }
 
-func (s *SQLStore) GetCard(cardId string) (*models.PrepaidCard, error) {
+func (s *SQLStore) GetCard(ctx context.Context, cardId string) (*models.PrepaidCard, error) {
 	var card models.PrepaidCard
 	query := s.db.Rebind(cardIdSelector)
-	row := s.db.QueryRowx(query, cardId)
+	row := s.db.QueryRowxContext(ctx, query, cardId)
 	err := row.StructScan(&card)
 	if err == sql.ErrNoRows {
 		return nil, models.NotFound
@@ -131,10 +181,10 @@ func (s *SQLStore) GetCard(cardId string) (*models.PrepaidCard, error) {
 	return &card, err
 }
 
-func (s *SQLStore) LoadCard(cardId string, amount int64) (*models.PrepaidCard, error) {
+func (s *SQLStore) GetCardByNumber(ctx context.Context, cardNumber string) (*models.PrepaidCard, error) {
 	var card models.PrepaidCard
-	query := s.db.Rebind(cardIdSelector)
-	row := s.db.QueryRowx(query, cardId)
+	query := s.db.Rebind(cardNumberSelector)
+	row := s.db.QueryRowxContext(ctx, query, cardNumber)
 	err := row.StructScan(&card)
 	if err == sql.ErrNoRows {
 		return nil, models.NotFound
@@ -142,85 +192,107 @@ func (s *SQLStore) LoadCard(cardId string, amount int64) (*models.PrepaidCard, e
 	if err != nil {
 		return nil, err
 	}
-	card.FullBalance = card.FullBalance + amount
-	query = s.db.Rebind(`UPDATE cards SET full_balance=:full_balance WHERE card_number=:card_number`)
-	_, err = s.db.NamedExec(query, card)
-	if err != nil {
-		return nil, err
-	}
-	return &card, nil
+	return &card, err
 }
 
-func (s *SQLStore) TransactionList(cardId string) (*models.SpendingList, error) {
-	var listModel models.SpendingList
-	list, err := s.transactionList(cardId)
-	listModel.SpendingList = list
-	if err == sql.ErrNoRows {
-		return &listModel, nil
-	}
+func (s *SQLStore) LoadCard(ctx context.Context, cardId string, amount int64) (*models.PrepaidCard, error) {
+	var card *models.PrepaidCard
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		card, err = s.lockCard(ctx, tx, cardId)
+		if err != nil {
+			return err
+		}
+		if err = card.CheckLoad(); err != nil {
+			return err
+		}
+		query := tx.Rebind(`UPDATE cards SET full_balance=full_balance + ? WHERE id=?`)
+		_, err = tx.ExecContext(ctx, query, amount, cardId)
+		if err != nil {
+			return err
+		}
+		if err = s.postEntry(ctx, tx, loadEntry(card, amount)); err != nil {
+			return err
+		}
+		card.FullBalance = card.FullBalance + amount
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	return &listModel, nil
+	return card, nil
 }
 
-func (s *SQLStore) transactionList(cardId string) ([]*models.Spending, error) {
-	var list []*models.Spending
-	query := s.db.Rebind(transactionListQuery)
-	rows, err := s.db.Queryx(query, cardId)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var spending models.Spending
-		err := rows.StructScan(&spending)
+// Moves a card to a new status if its current status allows it
+func (s *SQLStore) SetCardStatus(ctx context.Context, cardId string, status string) (*models.PrepaidCard, error) {
+	var card *models.PrepaidCard
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		card, err = s.lockCard(ctx, tx, cardId)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				return list, nil
-			}
-			return list, err
+			return err
 		}
-		list = append(list, &spending)
-	}
-	if err := rows.Err(); err != nil {
-		return list, err
+		if err = card.CheckTransition(status); err != nil {
+			return err
+		}
+		card.Status = status
+		card.UpdatedAt = time.Now()
+		query := tx.Rebind(`UPDATE cards SET status=?, updated_at=? WHERE id=?`)
+		_, err = tx.ExecContext(ctx, query, card.Status, card.UpdatedAt, cardId)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return list, nil
+	return card, nil
 }
 
-func (s *SQLStore) CreateMerchant(newMerchant *models.Merchant) (*models.Merchant, error) {
+func (s *SQLStore) CreateMerchant(ctx context.Context, newMerchant *models.Merchant) (*models.Merchant, error) {
 	merchant := new(models.Merchant)
 	*merchant = *newMerchant
 	merchant.CreatedAt = time.Now()
 	merchant.UpdatedAt = merchant.CreatedAt
+	if merchant.ID == "" {
+		merchant.ID = newId(merchant.CreatedAt).String()
+	}
+	err := prepareMerchant(merchant)
+	if err != nil {
+		return nil, err
+	}
 	query := s.db.Rebind(`INSERT INTO merchants (
 			id,
 			name,
-			type,
+			mcc,
+			category,
 			address,
+			currency,
 			created_at,
 			updated_at
 	)
 	VALUES (
 			:id,
 			:name,
-			:type,
+			:mcc,
+			:category,
 			:address,
+			:currency,
 			:created_at,
 			:updated_at
 	);`)
-	_, err := s.db.NamedExec(query, merchant)
+	_, err = s.db.NamedExecContext(ctx, query, merchant)
+	if isUniqueViolation(err) {
+		return nil, models.MerchantExists
+	}
 	if err != nil {
-		return nil, err
+		return nil, constraintError(err)
 	}
 	return merchant, nil
 }
 
-func (s *SQLStore) GetMerchant (merchantId string) (*models.Merchant, error) {
+func (s *SQLStore) GetMerchant (ctx context.Context, merchantId string) (*models.Merchant, error) {
 	var merchant models.Merchant
 	query := s.db.Rebind(merchantIdSelector)
-	row := s.db.QueryRowx(query, merchantId)
+	row := s.db.QueryRowxContext(ctx, query, merchantId)
 	err := row.StructScan(&merchant)
 	if err == sql.ErrNoRows {
 		return nil, models.NotFound
@@ -231,10 +303,10 @@ func (s *SQLStore) GetMerchant (merchantId string) (*models.Merchant, error) {
 	return &merchant, err
 }
 
-func (s *SQLStore) GetTransaction(transactionId string) (*models.Transaction, error) {
+func (s *SQLStore) GetTransaction(ctx context.Context, transactionId string) (*models.Transaction, error) {
 	var transaction models.Transaction
 	query := s.db.Rebind(transactionIdSelector)
-	row := s.db.QueryRowx(query, transactionId)
+	row := s.db.QueryRowxContext(ctx, query, transactionId)
 	err := row.StructScan(&transaction)
 	if err == sql.ErrNoRows {
 		return nil, models.NotFound
@@ -245,209 +317,519 @@ func (s *SQLStore) GetTransaction(transactionId string) (*models.Transaction, er
 	return &transaction, err
 }
 
-/*
-	Performs a card Auth
-	- Check that amount < full_balance - blocked_balance
-	- Create transaction with amount for Card & Merchant
-	- Add amount to the blocked_balance
- */
-func (s *SQLStore) Auth(card *models.PrepaidCard, merchant *models.Merchant, amount int64) (*models.Transaction, error) {
-	var transaction models.Transaction
-	transaction.CreatedAt = time.Now()
-	transaction.UpdatedAt = transaction.CreatedAt
-	transaction.ID = newId(transaction.CreatedAt).String()
-	transaction.OriginalAmount = amount
-	transaction.AuthorizedAmount = amount
-	tx, err:= s.db.Beginx()
-	if err != nil {
-		tx.Rollback()
+func (s *SQLStore) TransactionEvents(ctx context.Context, transactionId string) (*models.TransactionEventList, error) {
+	if _, err := s.GetTransaction(ctx, transactionId); err != nil {
 		return nil, err
 	}
-	if amount > (card.FullBalance - card.BlockedBalance) { // Should be checked in the API, but let's make it defensive
-		tx.Rollback()
-		return nil, models.InvalidCardBalance
+	var list models.TransactionEventList
+	err := s.db.SelectContext(ctx, &list.Events, s.db.Rebind(transactionEventsQuery), transactionId)
+	if err != nil {
+		return nil, err
 	}
-	card.BlockedBalance = card.BlockedBalance + amount
-	transaction.CardID = card.CardNumber
-	transaction.Card = card
-	transaction.MerchantID = merchant.ID
-	transaction.Merchant = merchant
-	query := tx.Rebind(`INSERT INTO transactions (
+	return &list, nil
+}
+
+func (s *SQLStore) recordEvent(ctx context.Context, tx *sqlx.Tx, event *models.TransactionEvent) error {
+	query := tx.Rebind(`INSERT INTO transaction_events (
 			id,
-			card_id,
-			merchant_id,
-			original_amount,
+			transaction_id,
+			kind,
+			amount,
 			authorized_amount,
 			captured_amount,
-			created_at,
-			updated_at
+			created_at
 	)
 	VALUES (
 			:id,
-			:card_id,
-			:merchant_id,
-			:original_amount,
+			:transaction_id,
+			:kind,
+			:amount,
 			:authorized_amount,
 			:captured_amount,
-			:created_at,
-			:updated_at
+			:created_at
 	);`)
-	_, err = tx.NamedExec(query, transaction)
-	if err != nil {
-		tx.Rollback()
-		return nil, err
+	_, err := tx.NamedExecContext(ctx, query, event)
+	return err
+}
+
+// Moves the transaction to its status after an operation of kind, see models.Transaction.UpdateStatus
+func (s *SQLStore) updateStatus(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, kind string, refunded int64) error {
+	transaction.UpdateStatus(kind, refunded)
+	_, err := tx.ExecContext(ctx, tx.Rebind(`UPDATE transactions SET status=? WHERE id=?`), transaction.Status, transaction.ID)
+	return err
+}
+
+/*
+	Performs a card Auth
+	- Lock the card row and check the merchant's category against the card's restrictions
+	- Convert amount from currency (the merchant's when empty) into the card's currency
+	- Check that the converted amount <= full_balance - blocked_balance, and that it is within the card's limits
+	- Create transaction with amount for Card & Merchant
+	- Add amount to the blocked_balance
+	The auth blocks the funds until expiresAt, after which ExpireAuths releases whatever is left.
+	The card passed in is only used for its number, and is updated with the locked balances.
+ */
+func (s *SQLStore) Auth(ctx context.Context, card *models.PrepaidCard, merchant *models.Merchant, amount int64, currency string, expiresAt time.Time) (*models.Transaction, error) {
+	var transaction models.Transaction
+	transaction.CreatedAt = time.Now().UTC()
+	transaction.UpdatedAt = transaction.CreatedAt
+	transaction.ID = newId(transaction.CreatedAt).String()
+	transaction.ExpiresAt = expiresAt
+	if currency == "" {
+		currency = merchant.Currency
 	}
-	query = tx.Rebind(`UPDATE cards SET blocked_balance=:blocked_balance WHERE card_number=:card_number`)
-	_, err = tx.NamedExec(query, card)
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		locked, err := s.lockCard(ctx, tx, card.ID)
+		if err != nil {
+			return err
+		}
+		if err = locked.CheckAuth(); err != nil {
+			return err
+		}
+		restrictions, err := s.cardRestrictions(ctx, tx, locked.ID)
+		if err != nil {
+			return err
+		}
+		if err = restrictions.CheckAuth(merchant); err != nil {
+			return err
+		}
+		if err = convertAuth(s.options.Rates, &transaction, locked, amount, currency); err != nil {
+			return err
+		}
+		if transaction.AuthorizedAmount > (locked.FullBalance - locked.BlockedBalance) {
+			return models.InvalidCardBalance
+		}
+		if err = s.checkLimits(ctx, tx, locked.ID, merchant, transaction.AuthorizedAmount, transaction.AuthorizedAmount, true); err != nil {
+			return err
+		}
+		transaction.CardID = locked.ID
+		transaction.MerchantID = merchant.ID
+		transaction.UpdateStatus(models.EventAuth, 0)
+		query := tx.Rebind(`INSERT INTO transactions (
+				id,
+				card_id,
+				merchant_id,
+				original_amount,
+				authorized_amount,
+				captured_amount,
+				status,
+				currency,
+				merchant_amount,
+				merchant_currency,
+				fx_rate,
+				expires_at,
+				created_at,
+				updated_at
+		)
+		VALUES (
+				:id,
+				:card_id,
+				:merchant_id,
+				:original_amount,
+				:authorized_amount,
+				:captured_amount,
+				:status,
+				:currency,
+				:merchant_amount,
+				:merchant_currency,
+				:fx_rate,
+				:expires_at,
+				:created_at,
+				:updated_at
+		);`)
+		_, err = tx.NamedExecContext(ctx, query, transaction)
+		if err != nil {
+			return err
+		}
+		authorized := transaction.AuthorizedAmount
+		query = tx.Rebind(`UPDATE cards SET blocked_balance=blocked_balance + ? WHERE id=?`)
+		_, err = tx.ExecContext(ctx, query, authorized, locked.ID)
+		if err != nil {
+			return err
+		}
+		if err = s.postEntry(ctx, tx, authEntry(&transaction, authorized)); err != nil {
+			return err
+		}
+		if err = s.recordEvent(ctx, tx, newEvent(&transaction, models.EventAuth, authorized)); err != nil {
+			return err
+		}
+		locked.BlockedBalance = locked.BlockedBalance + authorized
+		*card = *locked
+		return nil
+	})
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
-	tx.Commit()
+	transaction.Card = card
+	transaction.Merchant = merchant
 	return &transaction, nil
 }
 
+/*
+	Increases an auth, for merchants such as hotels and car hire that need to hold more
+	- Lock the transaction and check its status allows an increment and it hasn't expired
+	- Check currency is the merchant's currency and convert amount from it at the rate the auth used
+	- Lock the card and check its status, restrictions, available balance and limits, as for a new auth
+	- Add amount to the transaction's merchant, original and authorized amounts and to the card's blocked_balance
+ */
+func (s *SQLStore) Increment(ctx context.Context, transaction *models.Transaction, amount int64, currency string) error {
+	return s.inTx(ctx, func(tx *sqlx.Tx) error {
+		locked, err := s.lockTransaction(ctx, tx, transaction.ID)
+		if err != nil {
+			return err
+		}
+		if err = locked.CheckOperation(models.EventIncrement); err != nil {
+			return err
+		}
+		if time.Now().After(locked.ExpiresAt) {
+			return models.AuthExpired
+		}
+		converted, err := convertIncrement(locked, amount, currency)
+		if err != nil {
+			return err
+		}
+		card, err := s.lockCard(ctx, tx, locked.CardID)
+		if err != nil {
+			return err
+		}
+		if err = card.CheckAuth(); err != nil {
+			return err
+		}
+		var merchant models.Merchant
+		err = tx.GetContext(ctx, &merchant, tx.Rebind(`SELECT * FROM merchants WHERE id=?`), locked.MerchantID)
+		if err != nil {
+			return err
+		}
+		restrictions, err := s.cardRestrictions(ctx, tx, card.ID)
+		if err != nil {
+			return err
+		}
+		if err = restrictions.CheckAuth(&merchant); err != nil {
+			return err
+		}
+		if converted > (card.FullBalance - card.BlockedBalance) {
+			return models.InvalidCardBalance
+		}
+		if err = s.checkLimits(ctx, tx, card.ID, &merchant, converted, locked.OriginalAmount + converted, false); err != nil {
+			return err
+		}
+		locked.MerchantAmount = locked.MerchantAmount + amount
+		locked.OriginalAmount = locked.OriginalAmount + converted
+		locked.AuthorizedAmount = locked.AuthorizedAmount + converted
+		locked.UpdatedAt = time.Now()
+		query := tx.Rebind(`UPDATE transactions SET merchant_amount=?, original_amount=?, authorized_amount=?, updated_at=? WHERE id=?`)
+		_, err = tx.ExecContext(ctx, query, locked.MerchantAmount, locked.OriginalAmount, locked.AuthorizedAmount, locked.UpdatedAt, locked.ID)
+		if err != nil {
+			return err
+		}
+		query = tx.Rebind(`UPDATE cards SET blocked_balance=blocked_balance + ? WHERE id=?`)
+		_, err = tx.ExecContext(ctx, query, converted, card.ID)
+		if err != nil {
+			return err
+		}
+		if err = s.postEntry(ctx, tx, incrementEntry(locked, converted)); err != nil {
+			return err
+		}
+		if err = s.recordEvent(ctx, tx, newEvent(locked, models.EventIncrement, converted)); err != nil {
+			return err
+		}
+		card.BlockedBalance = card.BlockedBalance + converted
+		*transaction = *locked
+		transaction.Card = card
+		transaction.Merchant = &merchant
+		return nil
+	})
+}
+
 /*
 	Performs a transaction capture
-	- Check amount >= authorized_amount
-	- Remove amount from authed and append to captured
-	- Remove amount from card Full + Blocked balances
+	- Lock the transaction and check its status allows a capture, it hasn't expired and amount <= authorized_amount,
+	  or that the merchant's MCC lets it over-capture the rest, see splitCapture
+	- Remove the authorized part from authed and append amount to captured
+	- Remove amount from card Full balance and the authorized part from Blocked
+	- Record the capture, and if it's final reverse what's left of the auth
+	- Update the transaction's status
  */
-func (s *SQLStore) Capture(transaction *models.Transaction, amount int64) error {
-	tx, err:= s.db.Beginx()
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	if amount > transaction.AuthorizedAmount {
-		tx.Rollback()
-		return models.InvalidTransactionAuth
-	}
-	// Need to update the card amount within the transaction
-	var card models.PrepaidCard
-	query := tx.Rebind(cardIdSelector)
-	row := tx.QueryRowx(query, transaction.CardID)
-	err = row.StructScan(&card)
-	if err == sql.ErrNoRows {
-		tx.Rollback()
-		return models.NotFound
-	}
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	transaction.AuthorizedAmount = transaction.AuthorizedAmount - amount
-	transaction.CapturedAmount = transaction.CapturedAmount + amount
-	query = tx.Rebind(`UPDATE transactions SET authorized_amount=:authorized_amount, captured_amount=:captured_amount WHERE id=:id`)
-	_, err = tx.NamedExec(query, transaction)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	card.FullBalance = card.FullBalance - amount
-	card.BlockedBalance = card.BlockedBalance - amount
-	query = tx.Rebind(`UPDATE cards SET blocked_balance=:blocked_balance, full_balance=:full_balance WHERE card_number=:card_number`)
-	_, err = tx.NamedExec(query, card)
+func (s *SQLStore) Capture(ctx context.Context, transaction *models.Transaction, amount int64, final bool) (*models.Capture, error) {
+	capture := newCapture(transaction.ID, amount, final)
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		locked, err := s.lockTransaction(ctx, tx, transaction.ID)
+		if err != nil {
+			return err
+		}
+		if err = locked.CheckOperation(models.EventCapture); err != nil {
+			return err
+		}
+		if time.Now().After(locked.ExpiresAt) {
+			return models.AuthExpired
+		}
+		card, err := s.lockCard(ctx, tx, locked.CardID)
+		if err != nil {
+			return err
+		}
+		if err = card.CheckCapture(); err != nil {
+			return err
+		}
+		var merchantMCC string
+		err = tx.GetContext(ctx, &merchantMCC, tx.Rebind(`SELECT mcc FROM merchants WHERE id=?`), locked.MerchantID)
+		if err != nil {
+			return err
+		}
+		captures, err := s.captures(ctx, tx, locked.ID)
+		if err != nil {
+			return err
+		}
+		authorized, over, err := splitCapture(s.options.OverCapture, locked, merchantMCC, captures, card, amount)
+		if err != nil {
+			return err
+		}
+		locked.UpdatedAt = time.Now()
+		query := tx.Rebind(`UPDATE transactions SET authorized_amount=authorized_amount - ?, captured_amount=captured_amount + ?, updated_at=? WHERE id=?`)
+		_, err = tx.ExecContext(ctx, query, authorized, amount, locked.UpdatedAt, locked.ID)
+		if err != nil {
+			return err
+		}
+		query = tx.Rebind(`UPDATE cards SET blocked_balance=blocked_balance - ?, full_balance=full_balance - ? WHERE id=?`)
+		_, err = tx.ExecContext(ctx, query, authorized, amount, card.ID)
+		if err != nil {
+			return err
+		}
+		if authorized > 0 {
+			if err = s.postEntry(ctx, tx, captureEntry(locked, authorized)); err != nil {
+				return err
+			}
+		}
+		if over > 0 {
+			if err = s.postEntry(ctx, tx, overCaptureEntry(locked, over)); err != nil {
+				return err
+			}
+		}
+		locked.AuthorizedAmount = locked.AuthorizedAmount - authorized
+		locked.CapturedAmount = locked.CapturedAmount + amount
+		card.FullBalance = card.FullBalance - amount
+		card.BlockedBalance = card.BlockedBalance - authorized
+		if err = s.recordEvent(ctx, tx, newEvent(locked, models.EventCapture, amount)); err != nil {
+			return err
+		}
+		capture.OverCapturedAmount = over
+		if err = s.insertCapture(ctx, tx, capture); err != nil {
+			return err
+		}
+		if leftover := locked.AuthorizedAmount; final && leftover > 0 {
+			query = tx.Rebind(`UPDATE transactions SET authorized_amount=0 WHERE id=?`)
+			_, err = tx.ExecContext(ctx, query, locked.ID)
+			if err != nil {
+				return err
+			}
+			query = tx.Rebind(`UPDATE cards SET blocked_balance=blocked_balance - ? WHERE id=?`)
+			_, err = tx.ExecContext(ctx, query, leftover, card.ID)
+			if err != nil {
+				return err
+			}
+			if err = s.postEntry(ctx, tx, reverseEntry(locked, leftover)); err != nil {
+				return err
+			}
+			locked.AuthorizedAmount = 0
+			card.BlockedBalance = card.BlockedBalance - leftover
+			if err = s.recordEvent(ctx, tx, newEvent(locked, models.EventReverse, leftover)); err != nil {
+				return err
+			}
+		}
+		if err = s.updateStatus(ctx, tx, locked, models.EventCapture, refundedTotal(captures)); err != nil {
+			return err
+		}
+		*transaction = *locked
+		transaction.Card = card
+		return nil
+	})
 	if err != nil {
-		tx.Rollback()
-		return err
+		return nil, err
 	}
-	transaction.Card = &card
-	tx.Commit()
-	return nil
+	return capture, nil
 }
 
 /*
 	Performs a reverse on an auth
-	- Check amount <= authorized_amount
+	- Lock the transaction and check its status allows a reverse and amount <= authorized_amount
 	- Remove amount from authed
 	- Remove amount from Blocked balance
+	- Update the transaction's status
  */
-func (s *SQLStore) Reverse(transaction *models.Transaction, amount int64) error {
-	tx, err:= s.db.Beginx()
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	if amount > transaction.AuthorizedAmount {
-		tx.Rollback()
-		return models.InvalidTransactionAuth
-	}
-	transaction.AuthorizedAmount = transaction.AuthorizedAmount - amount
-	// Need to update the card amount within the transaction
-	var card models.PrepaidCard
-	query := tx.Rebind(cardIdSelector)
-	row := tx.QueryRowx(query, transaction.CardID)
-	err = row.StructScan(&card)
-	if err == sql.ErrNoRows {
-		tx.Rollback()
-		return models.NotFound
-	}
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	card.BlockedBalance = card.BlockedBalance - amount
-	query = tx.Rebind(`UPDATE transactions SET authorized_amount=:authorized_amount WHERE id=:id`)
-	_, err = tx.NamedExec(query, transaction)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	query = tx.Rebind(`UPDATE cards SET blocked_balance=:blocked_balance WHERE card_number=:card_number`)
-	_, err = tx.NamedExec(query, card)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	transaction.Card = &card
-	tx.Commit()
-	return nil
+func (s *SQLStore) Reverse(ctx context.Context, transaction *models.Transaction, amount int64) error {
+	return s.inTx(ctx, func(tx *sqlx.Tx) error {
+		locked, err := s.lockTransaction(ctx, tx, transaction.ID)
+		if err != nil {
+			return err
+		}
+		if err = locked.CheckOperation(models.EventReverse); err != nil {
+			return err
+		}
+		if amount > locked.AuthorizedAmount {
+			return models.InvalidTransactionAuth
+		}
+		card, err := s.lockCard(ctx, tx, locked.CardID)
+		if err != nil {
+			return err
+		}
+		query := tx.Rebind(`UPDATE transactions SET authorized_amount=authorized_amount - ? WHERE id=?`)
+		_, err = tx.ExecContext(ctx, query, amount, locked.ID)
+		if err != nil {
+			return err
+		}
+		query = tx.Rebind(`UPDATE cards SET blocked_balance=blocked_balance - ? WHERE id=?`)
+		_, err = tx.ExecContext(ctx, query, amount, card.ID)
+		if err != nil {
+			return err
+		}
+		if err = s.postEntry(ctx, tx, reverseEntry(locked, amount)); err != nil {
+			return err
+		}
+		locked.AuthorizedAmount = locked.AuthorizedAmount - amount
+		card.BlockedBalance = card.BlockedBalance - amount
+		if err = s.recordEvent(ctx, tx, newEvent(locked, models.EventReverse, amount)); err != nil {
+			return err
+		}
+		refunded, err := s.refunded(ctx, tx, locked.ID)
+		if err != nil {
+			return err
+		}
+		if err = s.updateStatus(ctx, tx, locked, models.EventReverse, refunded); err != nil {
+			return err
+		}
+		*transaction = *locked
+		transaction.Card = card
+		return nil
+	})
 }
 
 /*
 	Performs a refund on captured funds
-	- Check amount <= captured_amount
+	- Lock the transaction and check its status allows a refund and amount <= captured_amount
+	- Take amount off the capture with captureId, or off the captures oldest first when it's empty
 	- Add to card full_balance
 	- remove captured amount
+	- Update the transaction's status
  */
-func (s *SQLStore) Refund(transaction *models.Transaction, amount int64) error {
-	tx, err:= s.db.Beginx()
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	if amount > transaction.CapturedAmount {
-		tx.Rollback()
-		return models.InvalidTransactionCaptured
-	}
-	transaction.CapturedAmount = transaction.CapturedAmount - amount
-	// Need to update the card amount within the transaction
-	var card models.PrepaidCard
-	query := tx.Rebind(cardIdSelector)
-	row := tx.QueryRowx(query, transaction.CardID)
-	err = row.StructScan(&card)
-	if err == sql.ErrNoRows {
-		tx.Rollback()
-		return models.NotFound
-	}
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	card.FullBalance = card.FullBalance + amount
-	query = tx.Rebind(`UPDATE cards SET full_balance=:full_balance WHERE card_number=:card_number`)
-	_, err = tx.NamedExec(query, card)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	query = tx.Rebind(`UPDATE transactions SET captured_amount=:captured_amount WHERE id=:id`)
-	_, err = tx.NamedExec(query, transaction)
+func (s *SQLStore) Refund(ctx context.Context, transaction *models.Transaction, captureId string, amount int64) error {
+	return s.inTx(ctx, func(tx *sqlx.Tx) error {
+		locked, err := s.lockTransaction(ctx, tx, transaction.ID)
+		if err != nil {
+			return err
+		}
+		if err = locked.CheckOperation(models.EventRefund); err != nil {
+			return err
+		}
+		if amount > locked.CapturedAmount {
+			return models.InvalidTransactionCaptured
+		}
+		captures, err := s.captures(ctx, tx, locked.ID)
+		if err != nil {
+			return err
+		}
+		refunds, err := allocateRefund(captures, captureId, amount)
+		if err != nil {
+			return err
+		}
+		card, err := s.lockCard(ctx, tx, locked.CardID)
+		if err != nil {
+			return err
+		}
+		query := tx.Rebind(`UPDATE cards SET full_balance=full_balance + ? WHERE id=?`)
+		_, err = tx.ExecContext(ctx, query, amount, card.ID)
+		if err != nil {
+			return err
+		}
+		query = tx.Rebind(`UPDATE transactions SET captured_amount=captured_amount - ? WHERE id=?`)
+		_, err = tx.ExecContext(ctx, query, amount, locked.ID)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		query = tx.Rebind(`UPDATE captures SET refunded_amount=refunded_amount + ?, updated_at=? WHERE id=?`)
+		for _, capture := range captures {
+			if refunds[capture.ID] == 0 {
+				continue
+			}
+			if _, err = tx.ExecContext(ctx, query, refunds[capture.ID], now, capture.ID); err != nil {
+				return err
+			}
+		}
+		if err = s.postEntry(ctx, tx, refundEntry(locked, amount)); err != nil {
+			return err
+		}
+		locked.CapturedAmount = locked.CapturedAmount - amount
+		if err = s.recordEvent(ctx, tx, newEvent(locked, models.EventRefund, amount)); err != nil {
+			return err
+		}
+		if err = s.updateStatus(ctx, tx, locked, models.EventRefund, refundedTotal(captures) + amount); err != nil {
+			return err
+		}
+		*transaction = *locked
+		return nil
+	})
+}
+
+/*
+	Releases the funds held by every auth that expired before now
+	- Find transactions past expires_at with authorized_amount left
+	- Reverse each one in its own DB transaction, recording an expire event
+	Returns how many auths were expired.
+ */
+func (s *SQLStore) ExpireAuths(ctx context.Context, now time.Time) (int, error) {
+	var ids []string
+	err := s.db.SelectContext(ctx, &ids, s.db.Rebind(expiredAuthsQuery), now)
 	if err != nil {
-		tx.Rollback()
-		return err
+		return 0, err
+	}
+	expired := 0
+	for _, id := range ids {
+		err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+			locked, err := s.lockTransaction(ctx, tx, id)
+			if err != nil {
+				return err
+			}
+			amount := locked.AuthorizedAmount
+			if amount <= 0 || locked.ExpiresAt.After(now) {
+				return nil // Captured or reversed since the select
+			}
+			card, err := s.lockCard(ctx, tx, locked.CardID)
+			if err != nil {
+				return err
+			}
+			query := tx.Rebind(`UPDATE transactions SET authorized_amount=0 WHERE id=?`)
+			_, err = tx.ExecContext(ctx, query, locked.ID)
+			if err != nil {
+				return err
+			}
+			query = tx.Rebind(`UPDATE cards SET blocked_balance=blocked_balance - ? WHERE id=?`)
+			_, err = tx.ExecContext(ctx, query, amount, card.ID)
+			if err != nil {
+				return err
+			}
+			if err = s.postEntry(ctx, tx, expireEntry(locked, amount)); err != nil {
+				return err
+			}
+			locked.AuthorizedAmount = 0
+			if err = s.recordEvent(ctx, tx, newEvent(locked, models.EventExpire, amount)); err != nil {
+				return err
+			}
+			refunded, err := s.refunded(ctx, tx, locked.ID)
+			if err != nil {
+				return err
+			}
+			if err = s.updateStatus(ctx, tx, locked, models.EventExpire, refunded); err != nil {
+				return err
+			}
+			expired++
+			return nil
+		})
+		if err != nil {
+			return expired, err
+		}
 	}
-	tx.Commit()
-	return nil
+	return expired, nil
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
 }
@@ -0,0 +1,64 @@
+package datastore
+
+import (
+	"context"
+	"github.com/jmoiron/sqlx"
+	"prepaidcard/models"
+)
+
+const capturesQuery = `SELECT * FROM captures WHERE transaction_id=? ORDER BY created_at, id`
+
+func (s *SQLStore) ListCaptures(ctx context.Context, transactionId string) (*models.CaptureList, error) {
+	if _, err := s.GetTransaction(ctx, transactionId); err != nil {
+		return nil, err
+	}
+	captures, err := s.captures(ctx, s.db, transactionId)
+	if err != nil {
+		return nil, err
+	}
+	return &models.CaptureList{Captures: captures}, nil
+}
+
+// Reads the transaction's captures oldest first with q, which is the tx inside a store operation
+func (s *SQLStore) captures(ctx context.Context, q sqlx.QueryerContext, transactionId string) ([]*models.Capture, error) {
+	captures := []*models.Capture{}
+	err := sqlx.SelectContext(ctx, q, &captures, s.db.Rebind(capturesQuery), transactionId)
+	if err != nil {
+		return nil, err
+	}
+	return captures, nil
+}
+
+// The total refunded off the transaction's captures, for working out its status
+func (s *SQLStore) refunded(ctx context.Context, q sqlx.QueryerContext, transactionId string) (int64, error) {
+	captures, err := s.captures(ctx, q, transactionId)
+	if err != nil {
+		return 0, err
+	}
+	return refundedTotal(captures), nil
+}
+
+func (s *SQLStore) insertCapture(ctx context.Context, tx *sqlx.Tx, capture *models.Capture) error {
+	query := tx.Rebind(`INSERT INTO captures (
+			id,
+			transaction_id,
+			amount,
+			refunded_amount,
+			final,
+			over_captured_amount,
+			created_at,
+			updated_at
+	)
+	VALUES (
+			:id,
+			:transaction_id,
+			:amount,
+			:refunded_amount,
+			:final,
+			:over_captured_amount,
+			:created_at,
+			:updated_at
+	);`)
+	_, err := tx.NamedExecContext(ctx, query, capture)
+	return err
+}
@@ -0,0 +1,83 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"prepaidcard/models"
+	"time"
+)
+
+const idempotencyKeySelector = `SELECT * FROM idempotency_keys WHERE idempotency_key=?`
+
+func (s *SQLStore) GetIdempotencyRecord(ctx context.Context, key string) (*models.IdempotencyRecord, error) {
+	var record models.IdempotencyRecord
+	err := s.db.QueryRowxContext(ctx, s.db.Rebind(idempotencyKeySelector), key).StructScan(&record)
+	if err == sql.ErrNoRows {
+		return nil, models.NotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Claims the key for a new request, returns IdempotencyKeyInProgress if it is already taken
+func (s *SQLStore) CreateIdempotencyRecord(ctx context.Context, record *models.IdempotencyRecord) error {
+	record.CreatedAt = time.Now()
+	record.UpdatedAt = record.CreatedAt
+	query := s.db.Rebind(`INSERT INTO idempotency_keys (
+			idempotency_key,
+			request_hash,
+			status_code,
+			response,
+			created_at,
+			updated_at
+	)
+	VALUES (
+			:idempotency_key,
+			:request_hash,
+			:status_code,
+			:response,
+			:created_at,
+			:updated_at
+	);`)
+	_, err := s.db.NamedExecContext(ctx, query, record)
+	if isUniqueViolation(err) {
+		return models.IdempotencyKeyInProgress
+	}
+	return err
+}
+
+/*
+	Takes over a claim on the key that has gone stale, see IdempotencyRecord.Stale
+	Only one request can take it over, the rest get IdempotencyKeyInProgress, as do requests for a claim
+	that was completed or touched since staleBefore.
+ */
+func (s *SQLStore) ReclaimIdempotencyRecord(ctx context.Context, record *models.IdempotencyRecord, staleBefore time.Time) error {
+	record.UpdatedAt = time.Now()
+	query := s.db.Rebind(`UPDATE idempotency_keys SET updated_at=? WHERE idempotency_key=? AND request_hash=? AND status_code=0 AND updated_at < ?`)
+	result, err := s.db.ExecContext(ctx, query, record.UpdatedAt, record.Key, record.RequestHash, staleBefore)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return models.IdempotencyKeyInProgress
+	}
+	return nil
+}
+
+func (s *SQLStore) CompleteIdempotencyRecord(ctx context.Context, record *models.IdempotencyRecord) error {
+	record.UpdatedAt = time.Now()
+	query := s.db.Rebind(`UPDATE idempotency_keys SET status_code=:status_code, response=:response, updated_at=:updated_at WHERE idempotency_key=:idempotency_key`)
+	_, err := s.db.NamedExecContext(ctx, query, record)
+	return err
+}
+
+func (s *SQLStore) DeleteIdempotencyRecord(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, s.db.Rebind(`DELETE FROM idempotency_keys WHERE idempotency_key=?`), key)
+	return err
+}
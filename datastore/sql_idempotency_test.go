@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"context"
+	"prepaidcard/models"
+	"testing"
+	"time"
+)
+
+// A key is claimed once, completed or released, and a stale claim can be taken over by the same request only
+func TestIdempotencyRecords(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if _, err := store.GetIdempotencyRecord(ctx, "key"); err != models.NotFound {
+				t.Errorf("getting an unused key returned %v", err)
+			}
+			record := &models.IdempotencyRecord{Key: "key", RequestHash: "hash"}
+			if err := store.CreateIdempotencyRecord(ctx, record); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.CreateIdempotencyRecord(ctx, &models.IdempotencyRecord{Key: "key", RequestHash: "hash"}); err == nil {
+				t.Errorf("claimed a key twice")
+			}
+
+			past := time.Now().Add(-time.Minute)
+			future := time.Now().Add(time.Minute)
+			if err := store.ReclaimIdempotencyRecord(ctx, record, past); err != models.IdempotencyKeyInProgress {
+				t.Errorf("took over a fresh claim: %v", err)
+			}
+			other := &models.IdempotencyRecord{Key: "key", RequestHash: "other"}
+			if err := store.ReclaimIdempotencyRecord(ctx, other, future); err != models.IdempotencyKeyInProgress {
+				t.Errorf("took over a claim for another request: %v", err)
+			}
+			if err := store.ReclaimIdempotencyRecord(ctx, record, future); err != nil {
+				t.Errorf("taking over a stale claim: %v", err)
+			}
+
+			record.StatusCode = 200
+			record.Response = `{"id": "card"}`
+			if err := store.CompleteIdempotencyRecord(ctx, record); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := store.GetIdempotencyRecord(ctx, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.StatusCode != 200 || stored.Response != record.Response || stored.RequestHash != "hash" {
+				t.Errorf("completed record was stored as %+v", stored)
+			}
+			if err = store.ReclaimIdempotencyRecord(ctx, record, future); err != models.IdempotencyKeyInProgress {
+				t.Errorf("took over a completed record: %v", err)
+			}
+
+			if err = store.DeleteIdempotencyRecord(ctx, "key"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.GetIdempotencyRecord(ctx, "key"); err != models.NotFound {
+				t.Errorf("getting a deleted key returned %v", err)
+			}
+		})
+	}
+}
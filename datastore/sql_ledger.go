@@ -0,0 +1,100 @@
+package datastore
+
+import (
+	"context"
+	"github.com/jmoiron/sqlx"
+	"prepaidcard/models"
+)
+
+const (
+	cardEntriesQuery = `SELECT DISTINCT journal_entries.* FROM journal_entries
+	JOIN postings ON postings.entry_id = journal_entries.id
+	WHERE postings.account IN (?, ?)
+	ORDER BY journal_entries.created_at, journal_entries.id`
+	cardPostingsQuery = `SELECT * FROM postings WHERE entry_id IN (SELECT entry_id FROM postings WHERE account IN (?, ?)) ORDER BY entry_id, direction DESC`
+	accountBalancesQuery = `SELECT account, currency, SUM(CASE WHEN direction='debit' THEN -amount ELSE amount END) balance FROM postings GROUP BY account, currency`
+)
+
+// Writes a journal entry and its postings as part of tx
+func (s *SQLStore) postEntry(ctx context.Context, tx *sqlx.Tx, entry *models.JournalEntry) error {
+	if err := checkBalanced(entry); err != nil {
+		return err
+	}
+	query := tx.Rebind(`INSERT INTO journal_entries (
+			id,
+			kind,
+			reference,
+			created_at
+	)
+	VALUES (
+			:id,
+			:kind,
+			:reference,
+			:created_at
+	);`)
+	_, err := tx.NamedExecContext(ctx, query, entry)
+	if err != nil {
+		return err
+	}
+	for _, p := range entry.Postings {
+		query = tx.Rebind(`INSERT INTO postings (
+				id,
+				entry_id,
+				account,
+				direction,
+				amount,
+				currency
+		)
+		VALUES (
+				:id,
+				:entry_id,
+				:account,
+				:direction,
+				:amount,
+				:currency
+		);`)
+		_, err = tx.NamedExecContext(ctx, query, p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) CardLedger(ctx context.Context, cardId string) (*models.CardLedger, error) {
+	card, err := s.GetCard(ctx, cardId)
+	if err != nil {
+		return nil, err
+	}
+	available := models.CardAvailableAccount(cardId)
+	blocked := models.CardBlockedAccount(cardId)
+	var entries []*models.JournalEntry
+	err = s.db.SelectContext(ctx, &entries, s.db.Rebind(cardEntriesQuery), available, blocked)
+	if err != nil {
+		return nil, err
+	}
+	var postings []*models.Posting
+	err = s.db.SelectContext(ctx, &postings, s.db.Rebind(cardPostingsQuery), available, blocked)
+	if err != nil {
+		return nil, err
+	}
+	byEntry := make(map[string]*models.JournalEntry)
+	for _, entry := range entries {
+		byEntry[entry.ID] = entry
+	}
+	for _, p := range postings {
+		if entry, ok := byEntry[p.EntryID]; ok {
+			entry.Postings = append(entry.Postings, p)
+		}
+	}
+	return cardLedger(card, entries), nil
+}
+
+func (s *SQLStore) LedgerBalances(ctx context.Context) (*models.LedgerBalances, error) {
+	var accounts []*models.AccountBalance
+	err := s.db.SelectContext(ctx, &accounts, s.db.Rebind(accountBalancesQuery))
+	if err != nil {
+		return nil, err
+	}
+	return ledgerBalances(accounts), nil
+}
@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	"prepaidcard/models"
+	"time"
+)
+
+const (
+	cardLimitsQuery = `SELECT * FROM card_limits WHERE card_id=? ORDER BY created_at, id`
+	cardLimitSelector = `SELECT * FROM card_limits WHERE card_id=? AND id=?`
+	limitUsageQuery = `SELECT transactions.authorized_amount, transactions.captured_amount, merchants.mcc FROM transactions
+	JOIN merchants ON transactions.merchant_id = merchants.id
+	WHERE transactions.card_id=? AND transactions.created_at >= ?`
+)
+
+func (s *SQLStore) ListCardLimits(ctx context.Context, cardId string) (*models.CardLimitList, error) {
+	if _, err := s.GetCard(ctx, cardId); err != nil {
+		return nil, err
+	}
+	var list models.CardLimitList
+	err := s.db.SelectContext(ctx, &list.Limits, s.db.Rebind(cardLimitsQuery), cardId)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (s *SQLStore) GetCardLimit(ctx context.Context, cardId string, limitId string) (*models.CardLimit, error) {
+	var limit models.CardLimit
+	err := s.db.QueryRowxContext(ctx, s.db.Rebind(cardLimitSelector), cardId, limitId).StructScan(&limit)
+	if err == sql.ErrNoRows {
+		return nil, models.NotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &limit, nil
+}
+
+func (s *SQLStore) CreateCardLimit(ctx context.Context, newLimit *models.CardLimit) (*models.CardLimit, error) {
+	limit := new(models.CardLimit)
+	*limit = *newLimit
+	if err := limit.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := s.GetCard(ctx, limit.CardID); err != nil {
+		return nil, err
+	}
+	limit.CreatedAt = time.Now()
+	limit.UpdatedAt = limit.CreatedAt
+	limit.ID = newId(limit.CreatedAt).String()
+	query := s.db.Rebind(`INSERT INTO card_limits (
+			id,
+			card_id,
+			kind,
+			limit_window,
+			mcc,
+			limit_value,
+			created_at,
+			updated_at
+	)
+	VALUES (
+			:id,
+			:card_id,
+			:kind,
+			:limit_window,
+			:mcc,
+			:limit_value,
+			:created_at,
+			:updated_at
+	);`)
+	_, err := s.db.NamedExecContext(ctx, query, limit)
+	if err != nil {
+		return nil, constraintError(err)
+	}
+	return limit, nil
+}
+
+func (s *SQLStore) UpdateCardLimit(ctx context.Context, newLimit *models.CardLimit) (*models.CardLimit, error) {
+	limit := new(models.CardLimit)
+	*limit = *newLimit
+	if err := limit.Validate(); err != nil {
+		return nil, err
+	}
+	limit.UpdatedAt = time.Now()
+	query := s.db.Rebind(`UPDATE card_limits SET kind=:kind, limit_window=:limit_window, mcc=:mcc, limit_value=:limit_value, updated_at=:updated_at WHERE card_id=:card_id AND id=:id`)
+	result, err := s.db.NamedExecContext(ctx, query, limit)
+	if err != nil {
+		return nil, constraintError(err)
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return nil, models.NotFound
+	}
+	return s.GetCardLimit(ctx, limit.CardID, limit.ID)
+}
+
+func (s *SQLStore) DeleteCardLimit(ctx context.Context, cardId string, limitId string) error {
+	result, err := s.db.ExecContext(ctx, s.db.Rebind(`DELETE FROM card_limits WHERE card_id=? AND id=?`), cardId, limitId)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return models.NotFound
+	}
+	return nil
+}
+
+// Checks an auth or increment against the card's limits inside tx, the card row must already be locked
+func (s *SQLStore) checkLimits(ctx context.Context, tx *sqlx.Tx, cardId string, merchant *models.Merchant, amount int64, total int64, newAuth bool) error {
+	var limits []*models.CardLimit
+	err := tx.SelectContext(ctx, &limits, tx.Rebind(cardLimitsQuery), cardId)
+	if err != nil {
+		return err
+	}
+	// created_at is stored in UTC, and SQLite compares timestamps as text, so the window has to start in UTC too
+	return checkLimits(limits, merchant, amount, total, newAuth, time.Now().UTC(), func(limit *models.CardLimit, since time.Time) (int64, int64, error) {
+		var auths []struct {
+			AuthorizedAmount	int64	`db:"authorized_amount"`
+			CapturedAmount		int64	`db:"captured_amount"`
+			MCC					string	`db:"mcc"`
+		}
+		err := tx.SelectContext(ctx, &auths, tx.Rebind(limitUsageQuery), cardId, since)
+		if err != nil {
+			return 0, 0, err
+		}
+		var spent, count int64
+		for _, auth := range auths {
+			if limit.AppliesTo(&models.Merchant{MCC: auth.MCC}) {
+				spent = spent + auth.AuthorizedAmount + auth.CapturedAmount
+				count++
+			}
+		}
+		return spent, count, nil
+	})
+}
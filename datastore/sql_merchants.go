@@ -0,0 +1,60 @@
+package datastore
+
+import (
+	"context"
+	"prepaidcard/models"
+	"time"
+)
+
+// Lists merchants that haven't been deleted by id, starting after the given id
+func (s *SQLStore) ListMerchants(ctx context.Context, after string, limit int) (*models.MerchantList, error) {
+	list := &models.MerchantList{Merchants: []*models.Merchant{}}
+	err := s.db.SelectContext(ctx, &list.Merchants, s.db.Rebind(merchantListQuery), after, limit + 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Merchants) > limit {
+		list.Merchants = list.Merchants[:limit]
+		list.Next = list.Merchants[limit-1].ID
+	}
+	return list, nil
+}
+
+func (s *SQLStore) UpdateMerchant(ctx context.Context, newMerchant *models.Merchant) (*models.Merchant, error) {
+	merchant := new(models.Merchant)
+	*merchant = *newMerchant
+	if err := prepareMerchant(merchant); err != nil {
+		return nil, err
+	}
+	merchant.UpdatedAt = time.Now()
+	query := s.db.Rebind(`UPDATE merchants SET name=:name, mcc=:mcc, category=:category, address=:address, currency=:currency, updated_at=:updated_at WHERE id=:id AND deleted_at IS NULL`)
+	result, err := s.db.NamedExecContext(ctx, query, merchant)
+	if isUniqueViolation(err) {
+		return nil, models.MerchantExists
+	}
+	if err != nil {
+		return nil, constraintError(err)
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return nil, models.NotFound
+	}
+	return s.GetMerchant(ctx, merchant.ID)
+}
+
+/*
+	Soft deletes the merchant
+	The row is kept so user_transaction_list still shows it against past transactions,
+	but GetMerchant no longer finds it, so it can't take new auths.
+ */
+func (s *SQLStore) DeleteMerchant(ctx context.Context, merchantId string) error {
+	now := time.Now()
+	query := s.db.Rebind(`UPDATE merchants SET deleted_at=?, updated_at=? WHERE id=? AND deleted_at IS NULL`)
+	result, err := s.db.ExecContext(ctx, query, now, now, merchantId)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return models.NotFound
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package datastore
+
+import (
+	"context"
+	"github.com/jmoiron/sqlx"
+	"prepaidcard/models"
+)
+
+const (
+	mccAllow = "allow"
+	mccDeny = "deny"
+	cardMCCRulesQuery = `SELECT list, rule FROM card_mcc_rules WHERE card_id=? ORDER BY list, rule`
+)
+
+type mccRule struct {
+	List	string	`db:"list"`
+	Rule	string	`db:"rule"`
+}
+
+func (s *SQLStore) GetCardRestrictions(ctx context.Context, cardId string) (*models.CardRestrictions, error) {
+	if _, err := s.GetCard(ctx, cardId); err != nil {
+		return nil, err
+	}
+	return s.cardRestrictions(ctx, s.db, cardId)
+}
+
+// Replaces every allow and deny entry on the card
+func (s *SQLStore) SetCardRestrictions(ctx context.Context, newRestrictions *models.CardRestrictions) (*models.CardRestrictions, error) {
+	restrictions := normaliseRestrictions(newRestrictions)
+	if err := restrictions.Validate(); err != nil {
+		return nil, err
+	}
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		if _, err := s.lockCard(ctx, tx, restrictions.CardID); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, tx.Rebind(`DELETE FROM card_mcc_rules WHERE card_id=?`), restrictions.CardID)
+		if err != nil {
+			return err
+		}
+		insert := tx.Rebind(`INSERT INTO card_mcc_rules (card_id, list, rule) VALUES (?, ?, ?)`)
+		for _, rule := range restrictions.Allow {
+			if _, err := tx.ExecContext(ctx, insert, restrictions.CardID, mccAllow, rule); err != nil {
+				return err
+			}
+		}
+		for _, rule := range restrictions.Deny {
+			if _, err := tx.ExecContext(ctx, insert, restrictions.CardID, mccDeny, rule); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return restrictions, nil
+}
+
+// Reads the card's restrictions with q, which is the tx during an auth
+func (s *SQLStore) cardRestrictions(ctx context.Context, q sqlx.QueryerContext, cardId string) (*models.CardRestrictions, error) {
+	var rules []mccRule
+	err := sqlx.SelectContext(ctx, q, &rules, s.db.Rebind(cardMCCRulesQuery), cardId)
+	if err != nil {
+		return nil, err
+	}
+	restrictions := &models.CardRestrictions{CardID: cardId, Allow: []string{}, Deny: []string{}}
+	for _, rule := range rules {
+		switch rule.List {
+		case mccAllow:
+			restrictions.Allow = append(restrictions.Allow, rule.Rule)
+		case mccDeny:
+			restrictions.Deny = append(restrictions.Deny, rule.Rule)
+		}
+	}
+	return restrictions, nil
+}
@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"context"
+	"prepaidcard/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Restrictions are stored normalised and decline auths at merchants they don't allow, in both stores
+func TestRestrictionsDeclineAuths(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			card, err := store.CreateCard(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.LoadCard(ctx, card.ID, 10000); err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.SetCardRestrictions(ctx, &models.CardRestrictions{CardID: card.ID, Allow: []string{"groceries", "fuel", "groceries"}, Deny: []string{"5541"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			restrictions, err := store.GetCardRestrictions(ctx, card.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := &models.CardRestrictions{CardID: card.ID, Allow: []string{"fuel", "groceries"}, Deny: []string{"5541"}}
+			if !reflect.DeepEqual(restrictions, expected) {
+				t.Errorf("restrictions were stored as %+v, expected %+v", restrictions, expected)
+			}
+			if _, err = store.SetCardRestrictions(ctx, &models.CardRestrictions{CardID: card.ID, Deny: []string{"casinos"}}); err != models.InvalidMCC {
+				t.Errorf("setting an unknown group returned %v", err)
+			}
+			if _, err = store.SetCardRestrictions(ctx, &models.CardRestrictions{CardID: "missing"}); err != models.NotFound {
+				t.Errorf("setting restrictions on a missing card returned %v", err)
+			}
+
+			merchants := []struct {
+				mcc		string
+				allowed	bool
+			}{
+				{"5411", true},
+				{"5542", true},
+				{"5541", false},
+				{"5812", false},
+			}
+			for _, m := range merchants {
+				merchant, err := store.CreateMerchant(ctx, &models.Merchant{Name: "Merchant " + m.mcc, MCC: m.mcc, Address: "High Street"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = store.Auth(ctx, card, merchant, 100, "", time.Now().Add(time.Hour))
+				if (err == nil) != m.allowed {
+					t.Errorf("auth at %s returned %v, expected allowed %v", m.mcc, err, m.allowed)
+				}
+			}
+		})
+	}
+}
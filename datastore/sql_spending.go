@@ -0,0 +1,99 @@
+package datastore
+
+import (
+	"context"
+	"prepaidcard/mcc"
+	"prepaidcard/models"
+	"strings"
+)
+
+/*
+	Returns a page of the card's spending matching filter, and the totals over every match
+	The page and the summary are each a single query against user_transaction_list,
+	so nothing beyond the page is loaded.
+ */
+func (s *SQLStore) TransactionList(ctx context.Context, cardId string, filter *models.SpendingFilter) (*models.SpendingList, error) {
+	card, err := s.GetCard(ctx, cardId)
+	if err != nil {
+		return nil, err
+	}
+	where, args := spendingConditions(cardId, filter)
+	list := &models.SpendingList{SpendingList: []*models.Spending{}}
+	summaryQuery := `SELECT COUNT(*) count, COALESCE(SUM(auth_amount), 0) authorized_total, COALESCE(SUM(amount), 0) captured_total FROM user_transaction_list WHERE ` + where
+	err = s.db.GetContext(ctx, &list.Summary, s.db.Rebind(summaryQuery), args...)
+	if err != nil {
+		return nil, err
+	}
+	list.Summary.Currency = card.Currency
+
+	order := "DESC"
+	cursor := " AND transaction_id < ?"
+	if filter.Order == models.SortOldest {
+		order = "ASC"
+		cursor = " AND transaction_id > ?"
+	}
+	if filter.After != "" {
+		where = where + cursor
+		args = append(args, filter.After)
+	}
+	pageQuery := `SELECT * FROM user_transaction_list WHERE ` + where + ` ORDER BY transaction_id ` + order + ` LIMIT ?`
+	err = s.db.SelectContext(ctx, &list.SpendingList, s.db.Rebind(pageQuery), append(args, filter.Limit + 1)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(list.SpendingList) > filter.Limit {
+		list.SpendingList = list.SpendingList[:filter.Limit]
+		list.Next = list.SpendingList[filter.Limit-1].TransactionId
+	}
+	for _, spending := range list.SpendingList {
+		spending.CardNumber = models.MaskPAN(spending.CardNumber)
+	}
+	return list, nil
+}
+
+// Builds the WHERE clause for the filter, leaving out the cursor
+func spendingConditions(cardId string, filter *models.SpendingFilter) (string, []interface{}) {
+	conditions := []string{"card_id = ?"}
+	args := []interface{}{cardId}
+	if filter.From != nil {
+		conditions = append(conditions, "auth_time >= ?")
+		args = append(args, filter.From.UTC())
+	}
+	if filter.To != nil {
+		conditions = append(conditions, "auth_time < ?")
+		args = append(args, filter.To.UTC())
+	}
+	if filter.MerchantID != "" {
+		conditions = append(conditions, "merchant_id = ?")
+		args = append(args, filter.MerchantID)
+	}
+	if filter.MCC != "" {
+		codes, ranges := mcc.Expand(filter.MCC)
+		var matches []string
+		if len(codes) > 0 {
+			matches = append(matches, "merchant_mcc IN (?" + strings.Repeat(", ?", len(codes) - 1) + ")")
+			for _, code := range codes {
+				args = append(args, code)
+			}
+		}
+		// Codes are always four digits, so comparing them as strings keeps numeric order
+		for _, r := range ranges {
+			matches = append(matches, "merchant_mcc BETWEEN ? AND ?")
+			args = append(args, r.From, r.To)
+		}
+		conditions = append(conditions, "(" + strings.Join(matches, " OR ") + ")")
+	}
+	if filter.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.MinAmount != nil {
+		conditions = append(conditions, "auth_amount >= ?")
+		args = append(args, *filter.MinAmount)
+	}
+	if filter.MaxAmount != nil {
+		conditions = append(conditions, "auth_amount <= ?")
+		args = append(args, *filter.MaxAmount)
+	}
+	return strings.Join(conditions, " AND "), args
+}
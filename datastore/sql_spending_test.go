@@ -0,0 +1,156 @@
+package datastore
+
+import (
+	"context"
+	"prepaidcard/models"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Pages through the card's spending in order, following Next until it runs out
+func spendingPages(t *testing.T, store models.CardStore, cardId string, filter models.SpendingFilter) []string {
+	t.Helper()
+	var ids []string
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatalf("paging didn't end, at %v", ids)
+		}
+		list, err := store.TransactionList(context.Background(), cardId, &filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.SpendingList) > filter.Limit {
+			t.Fatalf("page of %d has %d rows", filter.Limit, len(list.SpendingList))
+		}
+		for _, spending := range list.SpendingList {
+			ids = append(ids, spending.TransactionId)
+		}
+		if list.Next == "" {
+			return ids
+		}
+		filter.After = list.Next
+	}
+}
+
+// Cursor pages cover every match once in either order, while the summary covers every match whatever the page
+func TestTransactionListPaging(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			card, err := store.CreateCard(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.LoadCard(ctx, card.ID, 10000); err != nil {
+				t.Fatal(err)
+			}
+			grocer, err := store.CreateMerchant(ctx, &models.Merchant{Name: "Corner Shop", MCC: "5411", Address: "High Street"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			station, err := store.CreateMerchant(ctx, &models.Merchant{Name: "Petrol Station", MCC: "5541", Address: "Ring Road"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var all, groceries []string
+			for i, merchant := range []*models.Merchant{grocer, station, grocer, station, grocer} {
+				transaction, err := store.Auth(ctx, card, merchant, int64(100 * (i + 1)), "", time.Now().Add(time.Hour))
+				if err != nil {
+					t.Fatal(err)
+				}
+				all = append(all, transaction.ID)
+				if merchant == grocer {
+					groceries = append(groceries, transaction.ID)
+				}
+			}
+			sort.Strings(all)
+			sort.Strings(groceries)
+
+			oldest := spendingPages(t, store, card.ID, models.SpendingFilter{Limit: 2, Order: models.SortOldest})
+			if !equalIds(oldest, all) {
+				t.Errorf("oldest first paged %v, expected %v", oldest, all)
+			}
+			newest := spendingPages(t, store, card.ID, models.SpendingFilter{Limit: 2, Order: models.SortNewest})
+			for i, j := 0, len(newest) - 1; i < j; i, j = i + 1, j - 1 {
+				newest[i], newest[j] = newest[j], newest[i]
+			}
+			if !equalIds(newest, all) {
+				t.Errorf("newest first paged %v reversed, expected %v", newest, all)
+			}
+			filtered := spendingPages(t, store, card.ID, models.SpendingFilter{Limit: 1, Order: models.SortOldest, MCC: "groceries"})
+			if !equalIds(filtered, groceries) {
+				t.Errorf("groceries paged %v, expected %v", filtered, groceries)
+			}
+
+			min := int64(200)
+			list, err := store.TransactionList(ctx, card.ID, &models.SpendingFilter{Limit: 1, Order: models.SortNewest, MinAmount: &min, After: all[4]})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if list.Summary.Count != 4 || list.Summary.AuthorizedTotal != 1400 || list.Summary.Currency != card.Currency {
+				t.Errorf("summary of auths of at least 200 is %+v, expected 4 of them for 1400", list.Summary)
+			}
+			if _, err = store.TransactionList(ctx, "missing", &models.SpendingFilter{Limit: 1, Order: models.SortNewest}); err != models.NotFound {
+				t.Errorf("listing a missing card returned %v", err)
+			}
+		})
+	}
+}
+
+func equalIds(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Time bounds given outside UTC select the same auths as in UTC
+func TestTransactionListTimeFilterOutsideUTC(t *testing.T) {
+	tokyo := time.FixedZone("UTC+9", 9 * 60 * 60)
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			card, err := store.CreateCard(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.LoadCard(ctx, card.ID, 10000); err != nil {
+				t.Fatal(err)
+			}
+			merchant, err := store.CreateMerchant(ctx, &models.Merchant{Name: "Corner Shop", MCC: "5411", Address: "High Street"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make(map[time.Time]string)
+			times := []time.Time{
+				time.Date(2018, 10, 1, 2, 0, 0, 0, time.UTC),
+				time.Date(2018, 10, 1, 4, 0, 0, 0, time.UTC),
+				time.Date(2018, 10, 1, 6, 0, 0, 0, time.UTC),
+			}
+			for _, then := range times {
+				transaction, err := store.Auth(ctx, card, merchant, 100, "", time.Now().Add(time.Hour))
+				if err != nil {
+					t.Fatal(err)
+				}
+				backdate(t, store, transaction.ID, then)
+				ids[then] = transaction.ID
+			}
+			// 12:00 to 15:00 in Tokyo is 03:00 to 06:00 UTC
+			from := time.Date(2018, 10, 1, 12, 0, 0, 0, tokyo)
+			to := time.Date(2018, 10, 1, 15, 0, 0, 0, tokyo)
+			list, err := store.TransactionList(ctx, card.ID, &models.SpendingFilter{Limit: 10, Order: models.SortOldest, From: &from, To: &to})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list.SpendingList) != 1 || list.SpendingList[0].TransactionId != ids[times[1]] {
+				t.Errorf("spending between %s and %s is %d rows, expected only the auth at %s", from, to, len(list.SpendingList), times[1])
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package datastore
+
+import (
+	"context"
+	"prepaidcard/models"
+	"testing"
+	"time"
+)
+
+// The stored status follows each operation, and can be filtered on in the spending list
+func TestTransactionStatusIsStored(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			card, err := store.CreateCard(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.LoadCard(ctx, card.ID, 10000); err != nil {
+				t.Fatal(err)
+			}
+			merchant, err := store.CreateMerchant(ctx, &models.Merchant{Name: "Corner Shop", MCC: "5411", Address: "High Street"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			transaction, err := store.Auth(ctx, card, merchant, 1000, "", time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			steps := []struct {
+				operation	func() error
+				status		string
+			}{
+				{func() error { return nil }, models.TransactionPending},
+				{func() error { _, err := store.Capture(ctx, transaction, 400, false); return err }, models.TransactionPartiallyCaptured},
+				{func() error { return store.Reverse(ctx, transaction, 600) }, models.TransactionCaptured},
+				{func() error { return store.Refund(ctx, transaction, "", 100) }, models.TransactionPartiallyRefunded},
+				{func() error { return store.Refund(ctx, transaction, "", 300) }, models.TransactionRefunded},
+			}
+			for _, step := range steps {
+				if err = step.operation(); err != nil {
+					t.Fatal(err)
+				}
+				stored, err := store.GetTransaction(ctx, transaction.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stored.Status != step.status || transaction.Status != step.status {
+					t.Errorf("transaction is stored as %s and returned as %s, expected %s", stored.Status, transaction.Status, step.status)
+				}
+				list, err := store.TransactionList(ctx, card.ID, &models.SpendingFilter{Limit: 10, Order: models.SortNewest, Status: step.status})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(list.SpendingList) != 1 || list.SpendingList[0].Status != step.status {
+					t.Errorf("spending with status %s is %+v", step.status, list.SpendingList)
+				}
+			}
+		})
+	}
+}
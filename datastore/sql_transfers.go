@@ -0,0 +1,180 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	"prepaidcard/models"
+	"time"
+)
+
+const (
+	transferIdSelector = `SELECT * FROM transfers WHERE id=?`
+	cardTransfersQuery = `SELECT * FROM transfers WHERE (from_card_id=? OR to_card_id=?) AND id > ? ORDER BY id LIMIT ?`
+)
+
+// Locks both cards of a transfer, always in id order so two transfers between the same cards can't deadlock
+func (s *SQLStore) lockCardPair(ctx context.Context, tx *sqlx.Tx, fromCardId string, toCardId string) (*models.PrepaidCard, *models.PrepaidCard, error) {
+	firstId, secondId := fromCardId, toCardId
+	if secondId < firstId {
+		firstId, secondId = secondId, firstId
+	}
+	first, err := s.lockCard(ctx, tx, firstId)
+	if err != nil {
+		return nil, nil, err
+	}
+	second, err := s.lockCard(ctx, tx, secondId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if first.ID == fromCardId {
+		return first, second, nil
+	}
+	return second, first, nil
+}
+
+/*
+	Moves amount from one card to another
+	- Lock both cards and check the transfer is allowed, see checkTransfer
+	- Record the transfer
+	- Remove amount from the first card's full_balance and add it to the second's
+ */
+func (s *SQLStore) Transfer(ctx context.Context, fromCardId string, toCardId string, amount int64) (*models.Transfer, error) {
+	transfer := newTransfer(fromCardId, toCardId, amount)
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		from, to, err := s.lockCardPair(ctx, tx, fromCardId, toCardId)
+		if err != nil {
+			return err
+		}
+		if err = checkTransfer(from, to, amount); err != nil {
+			return err
+		}
+		transfer.Currency = from.Currency
+		query := tx.Rebind(`INSERT INTO transfers (
+				id,
+				from_card_id,
+				to_card_id,
+				amount,
+				currency,
+				status,
+				created_at,
+				updated_at
+		)
+		VALUES (
+				:id,
+				:from_card_id,
+				:to_card_id,
+				:amount,
+				:currency,
+				:status,
+				:created_at,
+				:updated_at
+		);`)
+		_, err = tx.NamedExecContext(ctx, query, transfer)
+		if err != nil {
+			return err
+		}
+		if err = s.moveBalance(ctx, tx, from, to, amount); err != nil {
+			return err
+		}
+		if err = s.postEntry(ctx, tx, transferEntry(transfer)); err != nil {
+			return err
+		}
+		transfer.FromCard = from
+		transfer.ToCard = to
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transfer, nil
+}
+
+// Takes amount off from's full_balance and adds it to to's, updating both
+func (s *SQLStore) moveBalance(ctx context.Context, tx *sqlx.Tx, from *models.PrepaidCard, to *models.PrepaidCard, amount int64) error {
+	query := tx.Rebind(`UPDATE cards SET full_balance=full_balance - ? WHERE id=?`)
+	if _, err := tx.ExecContext(ctx, query, amount, from.ID); err != nil {
+		return err
+	}
+	query = tx.Rebind(`UPDATE cards SET full_balance=full_balance + ? WHERE id=?`)
+	if _, err := tx.ExecContext(ctx, query, amount, to.ID); err != nil {
+		return err
+	}
+	from.FullBalance = from.FullBalance - amount
+	to.FullBalance = to.FullBalance + amount
+	return nil
+}
+
+func (s *SQLStore) GetTransfer(ctx context.Context, transferId string) (*models.Transfer, error) {
+	var transfer models.Transfer
+	err := s.db.GetContext(ctx, &transfer, s.db.Rebind(transferIdSelector), transferId)
+	if err == sql.ErrNoRows {
+		return nil, models.NotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &transfer, nil
+}
+
+func (s *SQLStore) ListTransfers(ctx context.Context, cardId string, after string, limit int) (*models.TransferList, error) {
+	if _, err := s.GetCard(ctx, cardId); err != nil {
+		return nil, err
+	}
+	list := &models.TransferList{Transfers: []*models.Transfer{}}
+	err := s.db.SelectContext(ctx, &list.Transfers, s.db.Rebind(cardTransfersQuery), cardId, cardId, after, limit + 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Transfers) > limit {
+		list.Transfers = list.Transfers[:limit]
+		list.Next = list.Transfers[limit-1].ID
+	}
+	return list, nil
+}
+
+/*
+	Moves a transfer's amount back to the card it came from
+	- Lock the transfer and both cards and check it can be reversed, see checkTransferReversal
+	- Mark the transfer reversed
+	- Remove amount from the second card's full_balance and add it back to the first's
+ */
+func (s *SQLStore) ReverseTransfer(ctx context.Context, transferId string) (*models.Transfer, error) {
+	var transfer models.Transfer
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		query := tx.Rebind(s.dialect.forUpdate(transferIdSelector))
+		err := tx.GetContext(ctx, &transfer, query, transferId)
+		if err == sql.ErrNoRows {
+			return models.NotFound
+		}
+		if err != nil {
+			return err
+		}
+		from, to, err := s.lockCardPair(ctx, tx, transfer.FromCardID, transfer.ToCardID)
+		if err != nil {
+			return err
+		}
+		if err = checkTransferReversal(&transfer, from, to); err != nil {
+			return err
+		}
+		reverseTransfer(&transfer, time.Now())
+		query = tx.Rebind(`UPDATE transfers SET status=?, reversed_at=?, updated_at=? WHERE id=?`)
+		_, err = tx.ExecContext(ctx, query, transfer.Status, transfer.ReversedAt, transfer.UpdatedAt, transfer.ID)
+		if err != nil {
+			return err
+		}
+		if err = s.moveBalance(ctx, tx, to, from, transfer.Amount); err != nil {
+			return err
+		}
+		if err = s.postEntry(ctx, tx, transferReversalEntry(&transfer)); err != nil {
+			return err
+		}
+		transfer.FromCard = from
+		transfer.ToCard = to
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &transfer, nil
+}
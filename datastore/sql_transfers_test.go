@@ -0,0 +1,152 @@
+package datastore
+
+import (
+	"context"
+	"prepaidcard/models"
+	"testing"
+	"time"
+)
+
+// Fails the test unless each card's balances match its ledger and the ledger sums to 0
+func checkCardLedgers(t *testing.T, store models.CardStore, cardIds ...string) {
+	t.Helper()
+	ctx := context.Background()
+	for _, cardId := range cardIds {
+		card, err := store.GetCard(ctx, cardId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ledger, err := store.CardLedger(ctx, cardId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ledger.FullBalance != card.FullBalance || ledger.BlockedBalance != card.BlockedBalance {
+			t.Errorf("card %s has full %d blocked %d, its ledger %d and %d", cardId, card.FullBalance, card.BlockedBalance,
+				ledger.FullBalance, ledger.BlockedBalance)
+		}
+	}
+	balances, err := store.LedgerBalances(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for currency, sum := range balances.Totals {
+		if sum != 0 {
+			t.Errorf("ledger sums to %d %s", sum, currency)
+		}
+	}
+}
+
+func checkBalance(t *testing.T, store models.CardStore, cardId string, full int64) {
+	t.Helper()
+	card, err := store.GetCard(context.Background(), cardId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.FullBalance != full {
+		t.Errorf("card %s has full %d, expected %d", cardId, card.FullBalance, full)
+	}
+}
+
+func TestTransfers(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			var cards []*models.PrepaidCard
+			for _, currency := range []string{"GBP", "GBP", "EUR"} {
+				card, err := store.CreateCard(ctx, currency)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cards = append(cards, card)
+			}
+			from, to, euro := cards[0].ID, cards[1].ID, cards[2].ID
+			if _, err := store.LoadCard(ctx, from, 5000); err != nil {
+				t.Fatal(err)
+			}
+
+			rejected := []struct {
+				from	string
+				to		string
+				amount	int64
+				err		error
+			}{
+				{from, from, 100, models.InvalidTransfer},
+				{from, euro, 100, models.TransferCurrencyMismatch},
+				{from, "missing", 100, models.NotFound},
+				{"missing", to, 100, models.NotFound},
+				{from, to, 5001, models.InvalidCardBalance},
+			}
+			for _, r := range rejected {
+				if _, err := store.Transfer(ctx, r.from, r.to, r.amount); err != r.err {
+					t.Errorf("transfer of %d from %s to %s returned %v, expected %v", r.amount, r.from, r.to, err, r.err)
+				}
+			}
+
+			// Money can go to a frozen card, but not leave one
+			if _, err := store.SetCardStatus(ctx, to, models.CardFrozen); err != nil {
+				t.Fatal(err)
+			}
+			transfer, err := store.Transfer(ctx, from, to, 2000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if transfer.Status != models.TransferCompleted || transfer.Currency != "GBP" || transfer.Amount != 2000 {
+				t.Errorf("transfer was made as %+v", transfer)
+			}
+			if _, err = store.Transfer(ctx, to, from, 100); err == nil {
+				t.Errorf("transfer from a frozen card went through")
+			}
+			if _, err = store.SetCardStatus(ctx, to, models.CardActive); err != nil {
+				t.Fatal(err)
+			}
+			checkBalance(t, store, from, 3000)
+			checkBalance(t, store, to, 2000)
+			for _, cardId := range []string{from, to} {
+				list, err := store.ListTransfers(ctx, cardId, "", 10)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(list.Transfers) != 1 || list.Transfers[0].ID != transfer.ID {
+					t.Errorf("card %s lists transfers %+v", cardId, list.Transfers)
+				}
+			}
+
+			reversed, err := store.ReverseTransfer(ctx, transfer.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reversed.Status != models.TransferReversed || reversed.ReversedAt == nil {
+				t.Errorf("transfer was reversed as %+v", reversed)
+			}
+			if _, err = store.ReverseTransfer(ctx, transfer.ID); err != models.TransferAlreadyReversed {
+				t.Errorf("reversing a transfer twice returned %v", err)
+			}
+			checkBalance(t, store, from, 5000)
+			checkBalance(t, store, to, 0)
+
+			// A transfer whose money has been spent where it went can't be reversed
+			transfer, err = store.Transfer(ctx, from, to, 2000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			merchant, err := store.CreateMerchant(ctx, &models.Merchant{Name: "Corner Shop", MCC: "5411", Address: "High Street"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			toCard, err := store.GetCard(ctx, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.Auth(ctx, toCard, merchant, 1500, "", time.Now().Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.ReverseTransfer(ctx, transfer.ID); err != models.InvalidCardBalance {
+				t.Errorf("reversing a spent transfer returned %v", err)
+			}
+			if _, err = store.ReverseTransfer(ctx, "missing"); err != models.NotFound {
+				t.Errorf("reversing a missing transfer returned %v", err)
+			}
+			checkCardLedgers(t, store, from, to, euro)
+		})
+	}
+}
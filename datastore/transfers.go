@@ -0,0 +1,67 @@
+package datastore
+
+import (
+	"prepaidcard/models"
+	"time"
+)
+
+func newTransfer(fromCardId string, toCardId string, amount int64) *models.Transfer {
+	transfer := &models.Transfer{
+		FromCardID: fromCardId,
+		ToCardID: toCardId,
+		Amount: amount,
+		Status: models.TransferCompleted,
+		CreatedAt: time.Now(),
+	}
+	transfer.UpdatedAt = transfer.CreatedAt
+	transfer.ID = newId(transfer.CreatedAt).String()
+	return transfer
+}
+
+/*
+	Checks amount can move between the cards, which must be different and in the same currency
+	The money leaves like an auth, so the card it comes from must be active and have it available,
+	and arrives like a load, so the card it goes to can be frozen.
+ */
+func checkTransfer(from *models.PrepaidCard, to *models.PrepaidCard, amount int64) error {
+	if from.ID == to.ID {
+		return models.InvalidTransfer
+	}
+	if from.Currency != to.Currency {
+		return models.TransferCurrencyMismatch
+	}
+	if err := from.CheckAuth(); err != nil {
+		return err
+	}
+	if err := to.CheckLoad(); err != nil {
+		return err
+	}
+	if amount > from.FullBalance - from.BlockedBalance {
+		return models.InvalidCardBalance
+	}
+	return nil
+}
+
+// Checks the transfer can be moved back, which needs both cards open and the amount still available where it went
+func checkTransferReversal(transfer *models.Transfer, from *models.PrepaidCard, to *models.PrepaidCard) error {
+	if transfer.Status == models.TransferReversed {
+		return models.TransferAlreadyReversed
+	}
+	if err := to.CheckLoad(); err != nil {
+		return err
+	}
+	if err := from.CheckLoad(); err != nil {
+		return err
+	}
+	if transfer.Amount > to.FullBalance - to.BlockedBalance {
+		return models.InvalidCardBalance
+	}
+	return nil
+}
+
+// Marks the transfer reversed at now
+func reverseTransfer(transfer *models.Transfer, now time.Time) {
+	transfer.Status = models.TransferReversed
+	transfer.ReversedAt = &now
+	transfer.UpdatedAt = now
+}
@@ -0,0 +1,83 @@
+package fx
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+// Supplies the rate to convert an amount in one currency into another
+type RateProvider interface {
+	// Returns how many units of to one unit of from buys
+	Rate(from string, to string) (*big.Rat, error)
+}
+
+/*
+	StaticRates serves a fixed table of rates keyed by "FROM/TO", e.g. {"EUR/GBP": "0.86"}.
+	Converting between a pair in the opposite direction uses the inverse of the rate.
+ */
+type StaticRates struct {
+	rates	map[string]*big.Rat
+}
+
+type ErrNoRate struct {
+	From	string
+	To		string
+}
+
+func (e ErrNoRate) Error() string {
+	return fmt.Sprintf("no exchange rate from %s to %s", e.From, e.To)
+}
+
+func NewStaticRates(rates map[string]string) (*StaticRates, error) {
+	static := &StaticRates{rates: make(map[string]*big.Rat)}
+	for pair, value := range rates {
+		currencies := strings.Split(pair, "/")
+		if len(currencies) != 2 {
+			return nil, fmt.Errorf("invalid currency pair %q, expected FROM/TO", pair)
+		}
+		rate, ok := new(big.Rat).SetString(value)
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid rate %q for %s", value, pair)
+		}
+		static.rates[strings.ToUpper(pair)] = rate
+	}
+	return static, nil
+}
+
+// Reads a JSON file of rates in the format NewStaticRates takes
+func LoadRates(path string) (*StaticRates, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rates map[string]string
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return nil, fmt.Errorf("invalid rates file %s: %v", path, err)
+	}
+	return NewStaticRates(rates)
+}
+
+func (s *StaticRates) Rate(from string, to string) (*big.Rat, error) {
+	if from == to {
+		return big.NewRat(1, 1), nil
+	}
+	if rate, ok := s.rates[from + "/" + to]; ok {
+		return new(big.Rat).Set(rate), nil
+	}
+	if rate, ok := s.rates[to + "/" + from]; ok {
+		return new(big.Rat).Inv(rate), nil
+	}
+	return nil, ErrNoRate{From: from, To: to}
+}
+
+// Formats a rate as a plain decimal for storing alongside the amounts it converted
+func FormatRate(rate *big.Rat) string {
+	text := rate.FloatString(10)
+	if strings.Contains(text, ".") {
+		text = strings.TrimRight(strings.TrimRight(text, "0"), ".")
+	}
+	return text
+}
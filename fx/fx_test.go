@@ -0,0 +1,52 @@
+package fx
+
+import (
+	"math/big"
+	"testing"
+)
+
+// Rates are looked up either way round, with the inverse for the opposite direction
+func TestStaticRates(t *testing.T) {
+	rates, err := NewStaticRates(map[string]string{"eur/gbp": "0.8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		from	string
+		to		string
+		rate	*big.Rat
+	}{
+		{"EUR", "GBP", big.NewRat(4, 5)},
+		{"GBP", "EUR", big.NewRat(5, 4)},
+		{"USD", "USD", big.NewRat(1, 1)},
+	}
+	for _, c := range cases {
+		rate, err := rates.Rate(c.from, c.to)
+		if err != nil {
+			t.Errorf("%s/%s: %v", c.from, c.to, err)
+		} else if rate.Cmp(c.rate) != 0 {
+			t.Errorf("%s/%s is %s, expected %s", c.from, c.to, rate.RatString(), c.rate.RatString())
+		}
+	}
+	if _, err = rates.Rate("USD", "GBP"); err != (ErrNoRate{From: "USD", To: "GBP"}) {
+		t.Errorf("USD/GBP failed with %v, expected no rate", err)
+	}
+}
+
+func TestNewStaticRatesRejectsInvalidRates(t *testing.T) {
+	for _, rates := range []map[string]string{{"EURGBP": "0.8"}, {"EUR/GBP": "abc"}, {"EUR/GBP": "0"}, {"EUR/GBP": "-1"}} {
+		if _, err := NewStaticRates(rates); err == nil {
+			t.Errorf("rates %v were accepted", rates)
+		}
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	cases := map[string]string{"1": "1", "0.86": "0.86", "5/4": "1.25", "1/3": "0.3333333333"}
+	for value, formatted := range cases {
+		rate, _ := new(big.Rat).SetString(value)
+		if FormatRate(rate) != formatted {
+			t.Errorf("FormatRate(%s) = %s, expected %s", value, FormatRate(rate), formatted)
+		}
+	}
+}
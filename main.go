@@ -1,65 +1,196 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"github.com/lib/pq"
+	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"net/http"
 	"os"
+	"os/signal"
+	"prepaidcard/cardnumber"
+	"prepaidcard/config"
 	"prepaidcard/datastore"
-	"prepaidcard/models"
+	"prepaidcard/fx"
+	"prepaidcard/seed"
 	"prepaidcard/server"
+	"prepaidcard/worker"
+	"strconv"
+	"syscall"
+	"time"
 )
 
-var merchants = [...]models.Merchant{
-	{
-		ID: "amazon",
-		Name: "Amazon",
-		Type: "Shopping",
-		Address: "Money Trail",
-	},
-	{
-		ID: "apple",
-		Name: "Apple",
-		Type: "Technology",
-		Address: "Lotsa Money Trail",
-	},
-	{
-		ID: "mcdonalds",
-		Name: "Mcdonalds",
-		Type: "Food & Drink",
-		Address: "Less Money Trail, but still got Money",
-	},
+const usage = `usage:
+  prepaidcard [flags]                      serve the API
+  prepaidcard migrate [flags] up           apply every pending migration
+  prepaidcard migrate [flags] down [n]     revert the last n migrations, 1 by default
+  prepaidcard migrate [flags] status       list the migrations and when they were applied`
+
+func main() {
+	args := os.Args[1:]
+	command := run
+	if len(args) > 0 && args[0] == "migrate" {
+		command = migrate
+		args = args[1:]
+	}
+	cfg, err := config.Load(args, os.LookupEnv)
+	if err == flag.ErrHelp {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := command(cfg); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
 }
 
-func duplicateHelper(err error) bool {
-	switch dbErr := err.(type) {
-	case *pq.Error:
-		if dbErr.Code == "23505" {
-			return true
+func run(cfg *config.Config) error {
+	if len(cfg.Args) > 0 {
+		return fmt.Errorf("unknown command %q\n%s", cfg.Args[0], usage)
+	}
+	level, _ := log.ParseLevel(cfg.Log.Level)
+	log.SetLevel(level)
+	if level < log.DebugLevel {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	numbers, err := cardnumber.NewGenerator(cfg.Cards.BINRange, cardnumber.DefaultLength)
+	if err != nil {
+		return err
+	}
+	options := datastore.Options{CardNumbers: numbers, OverCapture: cfg.Capture.Policy()}
+	if cfg.FX.RatesFile != "" {
+		rates, err := fx.LoadRates(cfg.FX.RatesFile)
+		if err != nil {
+			return err
 		}
+		options.Rates = rates
 	}
-	return false
+	ds, err := datastore.New(cfg.Database.Type, cfg.Database.ConnString(), options)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := ds.Close(); err != nil {
+			log.WithError(err).Error("failed to close the datastore")
+		}
+	}()
+	if migrator, ok := ds.(datastore.Migrator); ok {
+		if err := migrator.CheckSchema(context.Background()); err != nil {
+			return err
+		}
+	}
+	if cfg.Seed != "" {
+		fixture, err := seed.Load(cfg.Seed)
+		if err != nil {
+			return err
+		}
+		report, err := seed.Apply(context.Background(), ds, fixture)
+		if err != nil {
+			return err
+		}
+		log.Infof("seeded merchants: %s", report.Merchants)
+		log.Infof("seeded cards: %s", report.Cards)
+	}
+	expiryWorker := worker.NewExpiryWorker(ds, cfg.Auth.ExpiryInterval)
+	expiryWorker.Start()
+	defer expiryWorker.Stop()
+	apiServer := server.InitServer(ds)
+	apiServer.AuthExpiry = cfg.Auth.Policy()
+	apiServer.PANRevealToken = cfg.Server.PANRevealToken
+	apiServer.DBTimeout = cfg.Database.Timeout
+	apiServer.IdempotencyClaimTTL = cfg.Server.IdempotencyClaimTTL
+	httpServer := &http.Server{
+		Addr: cfg.Server.Addr,
+		Handler: apiServer.Router,
+		ReadTimeout: cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout: cfg.Server.IdleTimeout,
+	}
+	return serve(httpServer, cfg.Server.ShutdownTimeout)
 }
 
-func main() {
-	value, ok := os.LookupEnv("DB_HOST")
-	if ok == false || value == "" {
-		value = "localhost"
+// Serves until SIGTERM or SIGINT, then stops taking connections and waits for in-flight requests to finish
+func serve(httpServer *http.Server, shutdownTimeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		log.Infof("listening on %s", httpServer.Addr)
+		errs <- httpServer.ListenAndServe()
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		log.Infof("received %s, shutting down", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		return fmt.Errorf("requests still running after %s: %v", shutdownTimeout, err)
 	}
-	connStr := fmt.Sprintf("user=postgres host=%s dbname=postgres sslmode=disable", value)
-	ds, err := datastore.New("postgres", connStr)
+	log.Info("shut down cleanly")
+	return nil
+}
+
+// Runs the migrate subcommand against the configured database
+func migrate(cfg *config.Config) error {
+	if len(cfg.Args) == 0 {
+		return fmt.Errorf("migrate needs up, down or status\n%s", usage)
+	}
+	ds, err := datastore.New(cfg.Database.Type, cfg.Database.ConnString(), datastore.Options{})
 	if err != nil {
-		panic(err)
+		return err
+	}
+	defer ds.Close()
+	migrator, ok := ds.(datastore.Migrator)
+	if !ok {
+		return fmt.Errorf("the %s datastore has no schema to migrate", cfg.Database.Type)
 	}
-	for _, m := range merchants{
-		 _, err := ds.CreateMerchant(&m)
-		 if err != nil {
-		 	if duplicateHelper(err) {
-		 		continue
+	ctx := context.Background()
+	switch action := cfg.Args[0]; action {
+	case "up":
+		applied, err := migrator.MigrateUp(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied %d %s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("already up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(cfg.Args) > 1 {
+			steps, err = strconv.Atoi(cfg.Args[1])
+			if err != nil || steps <= 0 {
+				return fmt.Errorf("migrate down takes a positive number of migrations, not %q", cfg.Args[1])
+			}
+		}
+		reverted, err := migrator.MigrateDown(ctx, steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %d %s\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		statuses, err := migrator.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range statuses {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = "applied " + m.AppliedAt.Format(time.RFC3339)
 			}
-			log.Fatal(err)
-		 }
+			fmt.Printf("%4d  %-30s %s\n", m.Version, m.Name, applied)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate action %q\n%s", action, usage)
 	}
-	apiServer := server.InitServer(ds)
-	apiServer.Router.Run(":8080")
 }
@@ -0,0 +1,228 @@
+package mcc
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// An ISO 18245 merchant category code, with a human label and the group it falls in
+type Code struct {
+	Code		string	`json:"code"`
+	Description	string	`json:"description"`
+	Group		string	`json:"group"`
+}
+
+const (
+	GroupTravel = "travel"
+	GroupTransport = "transport"
+	GroupFuel = "fuel"
+	GroupGroceries = "groceries"
+	GroupRestaurants = "restaurants"
+	GroupRetail = "retail"
+	GroupDigital = "digital"
+	GroupEntertainment = "entertainment"
+	GroupHealthcare = "healthcare"
+	GroupEducation = "education"
+	GroupUtilities = "utilities"
+	GroupServices = "services"
+	GroupCash = "cash"
+	GroupGambling = "gambling"
+	GroupGovernment = "government"
+	GroupCharity = "charity"
+)
+
+var codes = map[string]Code{
+	"0742": {Description: "Veterinary Services", Group: GroupServices},
+	"1520": {Description: "General Contractors, Residential and Commercial", Group: GroupServices},
+	"4111": {Description: "Local and Suburban Commuter Passenger Transportation", Group: GroupTransport},
+	"4112": {Description: "Passenger Railways", Group: GroupTransport},
+	"4121": {Description: "Taxicabs and Limousines", Group: GroupTransport},
+	"4131": {Description: "Bus Lines", Group: GroupTransport},
+	"4411": {Description: "Cruise Lines", Group: GroupTravel},
+	"4511": {Description: "Airlines and Air Carriers", Group: GroupTravel},
+	"4722": {Description: "Travel Agencies and Tour Operators", Group: GroupTravel},
+	"4784": {Description: "Tolls and Bridge Fees", Group: GroupTransport},
+	"4789": {Description: "Transportation Services", Group: GroupTransport},
+	"4812": {Description: "Telecommunication Equipment and Telephone Sales", Group: GroupUtilities},
+	"4814": {Description: "Telecommunication Services", Group: GroupUtilities},
+	"4899": {Description: "Cable, Satellite and Other Pay Television and Radio", Group: GroupUtilities},
+	"4900": {Description: "Utilities, Electric, Gas, Water and Sanitary", Group: GroupUtilities},
+	"5200": {Description: "Home Supply Warehouse Stores", Group: GroupRetail},
+	"5311": {Description: "Department Stores", Group: GroupRetail},
+	"5331": {Description: "Variety Stores", Group: GroupRetail},
+	"5411": {Description: "Grocery Stores and Supermarkets", Group: GroupGroceries},
+	"5422": {Description: "Freezer and Locker Meat Provisioners", Group: GroupGroceries},
+	"5441": {Description: "Candy, Nut and Confectionery Stores", Group: GroupGroceries},
+	"5451": {Description: "Dairy Products Stores", Group: GroupGroceries},
+	"5462": {Description: "Bakeries", Group: GroupGroceries},
+	"5499": {Description: "Miscellaneous Food Stores", Group: GroupGroceries},
+	"5541": {Description: "Service Stations", Group: GroupFuel},
+	"5542": {Description: "Automated Fuel Dispensers", Group: GroupFuel},
+	"5651": {Description: "Family Clothing Stores", Group: GroupRetail},
+	"5661": {Description: "Shoe Stores", Group: GroupRetail},
+	"5691": {Description: "Men's and Women's Clothing Stores", Group: GroupRetail},
+	"5712": {Description: "Furniture and Home Furnishings Stores", Group: GroupRetail},
+	"5732": {Description: "Electronics Stores", Group: GroupRetail},
+	"5734": {Description: "Computer Software Stores", Group: GroupRetail},
+	"5812": {Description: "Eating Places and Restaurants", Group: GroupRestaurants},
+	"5813": {Description: "Drinking Places, Bars and Nightclubs", Group: GroupRestaurants},
+	"5814": {Description: "Fast Food Restaurants", Group: GroupRestaurants},
+	"5815": {Description: "Digital Goods: Media, Books, Movies and Music", Group: GroupDigital},
+	"5816": {Description: "Digital Goods: Games", Group: GroupDigital},
+	"5817": {Description: "Digital Goods: Applications", Group: GroupDigital},
+	"5818": {Description: "Digital Goods: Large Digital Goods Merchant", Group: GroupDigital},
+	"5912": {Description: "Drug Stores and Pharmacies", Group: GroupHealthcare},
+	"5921": {Description: "Package Stores, Beer, Wine and Liquor", Group: GroupRetail},
+	"5942": {Description: "Book Stores", Group: GroupRetail},
+	"5943": {Description: "Stationery, Office and School Supply Stores", Group: GroupRetail},
+	"5945": {Description: "Hobby, Toy and Game Shops", Group: GroupRetail},
+	"5977": {Description: "Cosmetic Stores", Group: GroupRetail},
+	"5992": {Description: "Florists", Group: GroupRetail},
+	"5999": {Description: "Miscellaneous and Specialty Retail Stores", Group: GroupRetail},
+	"6010": {Description: "Financial Institutions, Manual Cash Disbursements", Group: GroupCash},
+	"6011": {Description: "Financial Institutions, Automated Cash Disbursements", Group: GroupCash},
+	"6051": {Description: "Non-Financial Institutions, Foreign Currency and Quasi Cash", Group: GroupCash},
+	"6540": {Description: "Non-Financial Institutions, Stored Value Card Purchase and Load", Group: GroupCash},
+	"7011": {Description: "Lodging, Hotels, Motels and Resorts", Group: GroupTravel},
+	"7230": {Description: "Beauty and Barber Shops", Group: GroupServices},
+	"7298": {Description: "Health and Beauty Spas", Group: GroupServices},
+	"7512": {Description: "Automobile Rental Agency", Group: GroupTravel},
+	"7523": {Description: "Parking Lots and Garages", Group: GroupTransport},
+	"7538": {Description: "Automotive Service Shops", Group: GroupServices},
+	"7832": {Description: "Motion Picture Theaters", Group: GroupEntertainment},
+	"7922": {Description: "Theatrical Producers and Ticket Agencies", Group: GroupEntertainment},
+	"7941": {Description: "Commercial Sports and Athletic Fields", Group: GroupEntertainment},
+	"7991": {Description: "Tourist Attractions and Exhibits", Group: GroupEntertainment},
+	"7995": {Description: "Betting, Lottery Tickets and Casino Gaming Chips", Group: GroupGambling},
+	"7997": {Description: "Membership Clubs, Sports and Recreation", Group: GroupEntertainment},
+	"8011": {Description: "Doctors", Group: GroupHealthcare},
+	"8021": {Description: "Dentists and Orthodontists", Group: GroupHealthcare},
+	"8042": {Description: "Optometrists and Ophthalmologists", Group: GroupHealthcare},
+	"8062": {Description: "Hospitals", Group: GroupHealthcare},
+	"8099": {Description: "Medical Services and Health Practitioners", Group: GroupHealthcare},
+	"8211": {Description: "Elementary and Secondary Schools", Group: GroupEducation},
+	"8220": {Description: "Colleges and Universities", Group: GroupEducation},
+	"8299": {Description: "Schools and Educational Services", Group: GroupEducation},
+	"8398": {Description: "Charitable and Social Service Organizations", Group: GroupCharity},
+	"9211": {Description: "Court Costs, Including Alimony and Child Support", Group: GroupGovernment},
+	"9222": {Description: "Fines", Group: GroupGovernment},
+	"9311": {Description: "Tax Payments", Group: GroupGovernment},
+	"9399": {Description: "Government Services", Group: GroupGovernment},
+}
+
+// Codes assigned to individual airlines, car rental agencies and hotel chains
+var travelRanges = []struct {
+	from, to	int
+	description	string
+}{
+	{3000, 3350, "Airlines"},
+	{3351, 3500, "Car Rental Agencies"},
+	{3501, 3999, "Hotels and Motels"},
+}
+
+// Looks up a four digit code, e.g. "5411"
+func Lookup(code string) (Code, bool) {
+	if c, ok := codes[code]; ok {
+		c.Code = code
+		return c, true
+	}
+	if len(code) != 4 {
+		return Code{}, false
+	}
+	n, err := strconv.Atoi(code)
+	if err != nil {
+		return Code{}, false
+	}
+	for _, r := range travelRanges {
+		if n >= r.from && n <= r.to {
+			return Code{Code: code, Description: r.description, Group: GroupTravel}, true
+		}
+	}
+	return Code{}, false
+}
+
+func Valid(code string) bool {
+	_, ok := Lookup(code)
+	return ok
+}
+
+func IsGroup(name string) bool {
+	for _, group := range Groups() {
+		if group == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Every group name, sorted
+func Groups() []string {
+	seen := make(map[string]bool)
+	var groups []string
+	for _, c := range codes {
+		if !seen[c.Group] {
+			seen[c.Group] = true
+			groups = append(groups, c.Group)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// The reference table, sorted by code, with the travel ranges as their first code
+func Codes() []Code {
+	var list []Code
+	for code := range codes {
+		c, _ := Lookup(code)
+		list = append(list, c)
+	}
+	for _, r := range travelRanges {
+		list = append(list, Code{Code: fmt.Sprintf("%04d", r.from), Description: fmt.Sprintf("%s (%d-%d)", r.description, r.from, r.to), Group: GroupTravel})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Code < list[j].Code
+	})
+	return list
+}
+
+// Reports whether a code or group name in a card rule, limit or policy covers code
+func Matches(rule string, code string) bool {
+	if rule == code {
+		return true
+	}
+	c, ok := Lookup(code)
+	return ok && c.Group == rule
+}
+
+// Reports whether rule names a known code or group
+func ValidRule(rule string) bool {
+	return Valid(rule) || IsGroup(rule)
+}
+
+// A run of codes, both ends included
+type Range struct {
+	From	string
+	To		string
+}
+
+// The codes a rule covers, as single codes and ranges, for matching them in SQL
+func Expand(rule string) ([]string, []Range) {
+	if !IsGroup(rule) {
+		return []string{rule}, nil
+	}
+	var list []string
+	for code, c := range codes {
+		if c.Group == rule {
+			list = append(list, code)
+		}
+	}
+	sort.Strings(list)
+	var ranges []Range
+	if rule == GroupTravel {
+		for _, r := range travelRanges {
+			ranges = append(ranges, Range{From: fmt.Sprintf("%04d", r.from), To: fmt.Sprintf("%04d", r.to)})
+		}
+	}
+	return list, ranges
+}
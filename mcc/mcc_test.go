@@ -0,0 +1,83 @@
+package mcc
+
+import "testing"
+
+func TestLookup(t *testing.T) {
+	cases := map[string]string{
+		"5411": GroupGroceries,
+		"5541": GroupFuel,
+		"3000": GroupTravel,
+		"3400": GroupTravel,
+		"3999": GroupTravel,
+	}
+	for code, group := range cases {
+		if c, ok := Lookup(code); !ok || c.Code != code || c.Group != group {
+			t.Errorf("Lookup(%q) = %+v, %v, expected group %s", code, c, ok, group)
+		}
+	}
+	for _, code := range []string{"", "0000", "2999", "54a1", "541", "54110"} {
+		if _, ok := Lookup(code); ok {
+			t.Errorf("Lookup(%q) found a code", code)
+		}
+	}
+}
+
+// A rule matches its own code, and a group matches every code in it, travel ranges included
+func TestMatches(t *testing.T) {
+	cases := []struct {
+		rule	string
+		code	string
+		matches	bool
+	}{
+		{"5411", "5411", true},
+		{"5411", "5422", false},
+		{GroupGroceries, "5411", true},
+		{GroupGroceries, "5541", false},
+		{GroupTravel, "3501", true},
+		{GroupTravel, "0000", false},
+	}
+	for _, c := range cases {
+		if Matches(c.rule, c.code) != c.matches {
+			t.Errorf("Matches(%q, %q) = %v, expected %v", c.rule, c.code, !c.matches, c.matches)
+		}
+	}
+}
+
+func TestValidRule(t *testing.T) {
+	for _, rule := range []string{"5411", "3456", GroupGambling} {
+		if !ValidRule(rule) {
+			t.Errorf("%q is not a valid rule", rule)
+		}
+	}
+	for _, rule := range []string{"", "0000", "casinos"} {
+		if ValidRule(rule) {
+			t.Errorf("%q is a valid rule", rule)
+		}
+	}
+}
+
+// Expanding a group covers the same codes Matches does
+func TestExpand(t *testing.T) {
+	for _, group := range Groups() {
+		codes, ranges := Expand(group)
+		if len(codes) == 0 {
+			t.Errorf("%s expands to no codes", group)
+		}
+		for _, code := range codes {
+			if !Matches(group, code) {
+				t.Errorf("%s expands to %s, which it doesn't match", group, code)
+			}
+		}
+		if (group == GroupTravel) != (len(ranges) > 0) {
+			t.Errorf("%s expands to ranges %v", group, ranges)
+		}
+		for _, r := range ranges {
+			if !Matches(group, r.From) || !Matches(group, r.To) {
+				t.Errorf("%s expands to range %v, which it doesn't match", group, r)
+			}
+		}
+	}
+	if codes, ranges := Expand("5411"); len(codes) != 1 || codes[0] != "5411" || ranges != nil {
+		t.Errorf("5411 expands to %v and %v", codes, ranges)
+	}
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+/*
+	One capture against a transaction
+	Refunds come off a particular capture, RefundedAmount is how much of it has been refunded so far.
+	A Final capture released whatever was left of the auth when it was made.
+	OverCapturedAmount is the part of Amount that went over the auth, see OverCapturePolicy,
+	which came out of the card's available balance rather than its blocked funds.
+ */
+type Capture struct {
+	ID				string		`json:"id" db:"id"`
+	TransactionID	string		`json:"transaction_id" db:"transaction_id"`
+	Amount			int64		`json:"amount" db:"amount"`
+	RefundedAmount	int64		`json:"refunded_amount" db:"refunded_amount"`
+	Final			bool		`json:"final" db:"final"`
+	OverCapturedAmount	int64	`json:"over_captured_amount" db:"over_captured_amount"`
+	CreatedAt		time.Time	`json:"created_at" db:"created_at"`
+	UpdatedAt		time.Time	`json:"updated_at" db:"updated_at"`
+}
+
+type CaptureList struct {
+	Captures	[]*Capture	`json:"captures"`
+}
+
+// What's left of the capture to refund
+func (c *Capture) Refundable() int64 {
+	return c.Amount - c.RefundedAmount
+}
@@ -1,16 +1,55 @@
 package models
 
+import (
+	"context"
+	"time"
+)
 
+/*
+	CardStore is implemented by every datastore.
+	Each method runs its database work under ctx, so it is abandoned, and any transaction rolled back,
+	once ctx is cancelled or its deadline passes.
+ */
 type CardStore interface {
-	CreateCard() (*PrepaidCard, error)
-	GetCard(cardId string) (*PrepaidCard, error)
-	LoadCard(cardId string, amount int64) (*PrepaidCard, error)
-	TransactionList(cardId string) (*SpendingList, error)
-	CreateMerchant(newMerchant *Merchant) (*Merchant, error)
-	GetMerchant(merchantId string) (*Merchant, error)
-	GetTransaction(transactionId string) (*Transaction, error)
-	Auth(card *PrepaidCard, merchant *Merchant, amount int64) (*Transaction, error)
-	Capture(transaction *Transaction, amount int64) error
-	Reverse(transaction *Transaction, amount int64) error
-	Refund(transaction *Transaction, amount int64) error
+	CreateCard(ctx context.Context, currency string) (*PrepaidCard, error)
+	CreateCardWithID(ctx context.Context, cardId string, currency string, balance int64) (*PrepaidCard, error)
+	GetCard(ctx context.Context, cardId string) (*PrepaidCard, error)
+	GetCardByNumber(ctx context.Context, cardNumber string) (*PrepaidCard, error)
+	LoadCard(ctx context.Context, cardId string, amount int64) (*PrepaidCard, error)
+	SetCardStatus(ctx context.Context, cardId string, status string) (*PrepaidCard, error)
+	ListCardLimits(ctx context.Context, cardId string) (*CardLimitList, error)
+	GetCardLimit(ctx context.Context, cardId string, limitId string) (*CardLimit, error)
+	CreateCardLimit(ctx context.Context, limit *CardLimit) (*CardLimit, error)
+	UpdateCardLimit(ctx context.Context, limit *CardLimit) (*CardLimit, error)
+	DeleteCardLimit(ctx context.Context, cardId string, limitId string) error
+	GetCardRestrictions(ctx context.Context, cardId string) (*CardRestrictions, error)
+	SetCardRestrictions(ctx context.Context, restrictions *CardRestrictions) (*CardRestrictions, error)
+	TransactionList(ctx context.Context, cardId string, filter *SpendingFilter) (*SpendingList, error)
+	CreateMerchant(ctx context.Context, newMerchant *Merchant) (*Merchant, error)
+	GetMerchant(ctx context.Context, merchantId string) (*Merchant, error)
+	ListMerchants(ctx context.Context, after string, limit int) (*MerchantList, error)
+	UpdateMerchant(ctx context.Context, merchant *Merchant) (*Merchant, error)
+	DeleteMerchant(ctx context.Context, merchantId string) error
+	GetTransaction(ctx context.Context, transactionId string) (*Transaction, error)
+	TransactionEvents(ctx context.Context, transactionId string) (*TransactionEventList, error)
+	Auth(ctx context.Context, card *PrepaidCard, merchant *Merchant, amount int64, currency string, expiresAt time.Time) (*Transaction, error)
+	Increment(ctx context.Context, transaction *Transaction, amount int64, currency string) error
+	Capture(ctx context.Context, transaction *Transaction, amount int64, final bool) (*Capture, error)
+	ListCaptures(ctx context.Context, transactionId string) (*CaptureList, error)
+	Reverse(ctx context.Context, transaction *Transaction, amount int64) error
+	Refund(ctx context.Context, transaction *Transaction, captureId string, amount int64) error
+	ExpireAuths(ctx context.Context, now time.Time) (int, error)
+	Transfer(ctx context.Context, fromCardId string, toCardId string, amount int64) (*Transfer, error)
+	GetTransfer(ctx context.Context, transferId string) (*Transfer, error)
+	ListTransfers(ctx context.Context, cardId string, after string, limit int) (*TransferList, error)
+	ReverseTransfer(ctx context.Context, transferId string) (*Transfer, error)
+	GetIdempotencyRecord(ctx context.Context, key string) (*IdempotencyRecord, error)
+	CreateIdempotencyRecord(ctx context.Context, record *IdempotencyRecord) error
+	ReclaimIdempotencyRecord(ctx context.Context, record *IdempotencyRecord, staleBefore time.Time) error
+	CompleteIdempotencyRecord(ctx context.Context, record *IdempotencyRecord) error
+	DeleteIdempotencyRecord(ctx context.Context, key string) error
+	CardLedger(ctx context.Context, cardId string) (*CardLedger, error)
+	LedgerBalances(ctx context.Context) (*LedgerBalances, error)
+	// Releases the store's database connections
+	Close() error
 }
@@ -1,16 +1,36 @@
 package models
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var (
 	NotFound = ApiError{
 		code: 404,
 		error: errors.New("object not found"),
 	}
+	Forbidden = ApiError{
+		code: 403,
+		error: errors.New("forbidden"),
+	}
 	InvalidAmount = ApiError{
 		code: 400,
 		error: errors.New("invalid amount"),
 	}
+	InvalidCurrency = ApiError{
+		code: 400,
+		error: errors.New("invalid currency"),
+	}
+	NoExchangeRate = ApiError{
+		code: 422,
+		error: errors.New("no exchange rate for the currency pair"),
+	}
+	InvalidCardNumber = ApiError{
+		code: 400,
+		error: errors.New("invalid card number"),
+	}
 	InvalidCardBalance = ApiError{
 		code: 409,
 		error: errors.New("invalid balance on card"),
@@ -23,8 +43,124 @@ var (
 		code: 409,
 		error: errors.New("invalid captured amount on transaction"),
 	}
+	InvalidCardStatus = ApiError{
+		code: 409,
+		error: errors.New("operation not allowed for the card's status"),
+	}
+	InvalidCardStatusChange = ApiError{
+		code: 409,
+		error: errors.New("card can't be moved to that status"),
+	}
+	CardHasBlockedFunds = ApiError{
+		code: 409,
+		error: errors.New("card still has blocked funds"),
+	}
+	CardExists = ApiError{
+		code: 409,
+		error: errors.New("a card with that id already exists"),
+	}
+	InvalidMerchant = ApiError{
+		code: 400,
+		error: errors.New("invalid merchant"),
+	}
+	MerchantExists = ApiError{
+		code: 409,
+		error: errors.New("a merchant with that id or name already exists"),
+	}
+	InvalidPagination = ApiError{
+		code: 400,
+		error: errors.New("invalid pagination parameters"),
+	}
+	InvalidFilter = ApiError{
+		code: 400,
+		error: errors.New("invalid filter parameters"),
+	}
+	InvalidMCC = ApiError{
+		code: 400,
+		error: errors.New("invalid merchant category code"),
+	}
+	InvalidLimit = ApiError{
+		code: 400,
+		error: errors.New("invalid card limit"),
+	}
+	ConstraintViolation = ApiError{
+		code: 409,
+		error: errors.New("the change would leave the data inconsistent"),
+	}
+	OverCaptureExceeded = ApiError{
+		code: 409,
+		error: errors.New("capture goes further over the auth than the merchant's category allows"),
+	}
+	TransactionFullyCaptured = ApiError{
+		code: 409,
+		error: errors.New("transaction has been captured and holds no more funds"),
+	}
+	TransactionFullyRefunded = ApiError{
+		code: 409,
+		error: errors.New("transaction has been refunded in full"),
+	}
+	TransactionAlreadyReversed = ApiError{
+		code: 409,
+		error: errors.New("transaction has been reversed"),
+	}
+	InvalidTransfer = ApiError{
+		code: 400,
+		error: errors.New("invalid transfer, a card can't transfer to itself"),
+	}
+	TransferCurrencyMismatch = ApiError{
+		code: 422,
+		error: errors.New("transfers are only allowed between cards in the same currency"),
+	}
+	TransferAlreadyReversed = ApiError{
+		code: 409,
+		error: errors.New("transfer has already been reversed"),
+	}
+	IncrementCurrencyMismatch = ApiError{
+		code: 422,
+		error: errors.New("increments must be in the currency the merchant made the auth in"),
+	}
+	AuthExpired = ApiError{
+		code: 409,
+		error: errors.New("authorization has expired"),
+	}
+	IdempotencyKeyReused = ApiError{
+		code: 422,
+		error: errors.New("idempotency key was already used for a different request"),
+	}
+	IdempotencyKeyInProgress = ApiError{
+		code: 409,
+		error: errors.New("a request with this idempotency key is still in progress"),
+	}
 )
 
+// The error for an auth declined by one of the card's limits, naming the limit
+func LimitExceeded(limit *CardLimit) ApiError {
+	return ApiError{
+		code: 409,
+		error: fmt.Errorf("auth declined by card limit %s", limit),
+	}
+}
+
+// The error for an auth declined by the card's merchant category restrictions
+func MCCRestricted(code string) ApiError {
+	return ApiError{
+		code: 409,
+		error: fmt.Errorf("auth declined, merchant category %s is restricted on this card", code),
+	}
+}
+
+// The error for a transfer missing card ids, naming the fields that are missing
+func MissingTransferCard(fields ...string) ApiError {
+	verb := "is"
+	if len(fields) > 1 {
+		verb = "are"
+	}
+	return ApiError{
+		code: 400,
+		error: fmt.Errorf("invalid transfer, %s %s required", strings.Join(fields, " and "), verb),
+	}
+}
+
 type Error interface {
 	Code() int
 	error
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"prepaidcard/mcc"
+	"time"
+)
+
+const DefaultAuthLifetime = 7 * 24 * time.Hour
+
+// How long an auth blocks funds before it is released, globally or per MCC or MCC group
+type AuthExpiryPolicy struct {
+	Default			time.Duration
+	ByMCC			map[string]time.Duration
+}
+
+// A lifetime for the merchant's code wins over one for its group
+func (p AuthExpiryPolicy) Lifetime(merchantMCC string) time.Duration {
+	if lifetime, ok := p.ByMCC[merchantMCC]; ok {
+		return lifetime
+	}
+	if code, ok := mcc.Lookup(merchantMCC); ok {
+		if lifetime, ok := p.ByMCC[code.Group]; ok {
+			return lifetime
+		}
+	}
+	if p.Default > 0 {
+		return p.Default
+	}
+	return DefaultAuthLifetime
+}
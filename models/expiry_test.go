@@ -0,0 +1,28 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+// A lifetime for the merchant's code wins over one for its group, which wins over the default
+func TestAuthExpiryPolicyLifetime(t *testing.T) {
+	policy := AuthExpiryPolicy{
+		Default: 3 * 24 * time.Hour,
+		ByMCC: map[string]time.Duration{"travel": 30 * 24 * time.Hour, "3501": 14 * 24 * time.Hour},
+	}
+	cases := map[string]time.Duration{
+		"3501": 14 * 24 * time.Hour,
+		"3502": 30 * 24 * time.Hour,
+		"5411": 3 * 24 * time.Hour,
+		"0000": 3 * 24 * time.Hour,
+	}
+	for code, lifetime := range cases {
+		if policy.Lifetime(code) != lifetime {
+			t.Errorf("auths at %s last %s, expected %s", code, policy.Lifetime(code), lifetime)
+		}
+	}
+	if (AuthExpiryPolicy{}).Lifetime("5411") != DefaultAuthLifetime {
+		t.Errorf("an empty policy doesn't use the default lifetime")
+	}
+}
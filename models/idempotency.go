@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// A stored response for a request made with an Idempotency-Key header.
+// StatusCode is 0 while the original request is still being handled.
+type IdempotencyRecord struct {
+	Key			string		`json:"key" db:"idempotency_key"`
+	RequestHash	string		`json:"request_hash" db:"request_hash"`
+	StatusCode	int			`json:"status_code" db:"status_code"`
+	Response	string		`json:"response" db:"response"`
+	CreatedAt	time.Time	`json:"created_at,omitempty" db:"created_at"`
+	UpdatedAt	time.Time	`json:"updated_at,omitempty" db:"updated_at"`
+}
+
+func (r *IdempotencyRecord) Completed() bool { return r.StatusCode != 0 }
+
+// Reports whether the record is a claim that hasn't been touched since staleBefore, left by a request that never finished
+func (r *IdempotencyRecord) Stale(staleBefore time.Time) bool {
+	return !r.Completed() && r.UpdatedAt.Before(staleBefore)
+}
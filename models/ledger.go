@@ -0,0 +1,93 @@
+package models
+
+import "time"
+
+/*
+	Every balance change is recorded as a balanced journal entry of debit and credit postings.
+	A card is split into an available and a blocked account, so that
+	full_balance = available + blocked and blocked_balance = blocked.
+	Money enters from the funding account and leaves to merchant settlement accounts,
+	so the balances of all accounts always sum to zero in each currency.
+ */
+
+const (
+	FundingAccount = "funding"
+
+	EntryLoad = "load"
+	EntryAuth = "auth"
+	EntryIncrement = "increment"
+	EntryCapture = "capture"
+	EntryOverCapture = "over_capture"
+	EntryReverse = "reverse"
+	EntryRefund = "refund"
+	EntryExpire = "expire"
+	EntryTransfer = "transfer"
+	EntryTransferReversal = "transfer_reversal"
+	// The balances a card had before the ledger existed
+	EntryOpening = "opening"
+
+	Debit = "debit"
+	Credit = "credit"
+)
+
+func CardAvailableAccount(cardId string) string { return "card:" + cardId + ":available" }
+func CardBlockedAccount(cardId string) string { return "card:" + cardId + ":blocked" }
+func MerchantSettlementAccount(merchantId string) string { return "merchant:" + merchantId + ":settlement" }
+
+type JournalEntry struct {
+	ID			string		`json:"id" db:"id"`
+	Kind		string		`json:"kind" db:"kind"`
+	Reference	string		`json:"reference" db:"reference"`
+	Postings	[]*Posting	`json:"postings" db:"-"`
+	CreatedAt	time.Time	`json:"created_at,omitempty" db:"created_at"`
+}
+
+type Posting struct {
+	ID			string	`json:"id" db:"id"`
+	EntryID		string	`json:"-" db:"entry_id"`
+	Account		string	`json:"account" db:"account"`
+	Direction	string	`json:"direction" db:"direction"`
+	Amount		int64	`json:"amount" db:"amount"`
+	Currency	string	`json:"currency" db:"currency"`
+}
+
+// Signed effect of the posting on its account, credits increase a balance
+func (p *Posting) Value() int64 {
+	if p.Direction == Debit {
+		return -p.Amount
+	}
+	return p.Amount
+}
+
+// An entry is balanced when its debits and credits cancel out in every currency
+func (e *JournalEntry) Balanced() bool {
+	totals := make(map[string]int64)
+	for _, p := range e.Postings {
+		totals[p.Currency] = totals[p.Currency] + p.Value()
+	}
+	for _, total := range totals {
+		if total != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type CardLedger struct {
+	CardID			string			`json:"card_id"`
+	Currency		string			`json:"currency"`
+	FullBalance		int64			`json:"full_balance"`
+	BlockedBalance	int64			`json:"blocked_balance"`
+	Entries			[]*JournalEntry	`json:"entries"`
+}
+
+type AccountBalance struct {
+	Account		string	`json:"account" db:"account"`
+	Currency	string	`json:"currency" db:"currency"`
+	Balance		int64	`json:"balance" db:"balance"`
+}
+
+type LedgerBalances struct {
+	Accounts	[]*AccountBalance	`json:"accounts"`
+	Totals		map[string]int64	`json:"totals"`
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"fmt"
+	"prepaidcard/mcc"
+	"time"
+)
+
+const (
+	// Caps the amount of a single auth
+	LimitMaxAuth = "max_auth"
+	// Caps the total authorized and captured over a window
+	LimitSpend = "spend"
+	// Caps the number of auths over a window
+	LimitAuthCount = "auth_count"
+
+	WindowDay = "day"
+	WindowWeek = "week"
+	WindowMonth = "month"
+)
+
+// Windows are rolling, so a daily limit covers the 24 hours before the auth
+var limitWindows = map[string]time.Duration{
+	WindowDay: 24 * time.Hour,
+	WindowWeek: 7 * 24 * time.Hour,
+	WindowMonth: 30 * 24 * time.Hour,
+}
+
+/*
+	A spending rule on a card, checked on every auth
+	Value is an amount in the card's currency, or a number of auths for auth_count.
+	Setting MCC to a code or group only applies the rule to auths at merchants it covers.
+ */
+type CardLimit struct {
+	ID				string		`json:"id" db:"id"`
+	CardID			string		`json:"card_id" db:"card_id"`
+	Kind			string		`json:"kind" db:"kind"`
+	Window			string		`json:"window,omitempty" db:"limit_window"`
+	MCC				string		`json:"mcc,omitempty" db:"mcc"`
+	Value			int64		`json:"value" db:"limit_value"`
+	CreatedAt		time.Time	`json:"created_at,omitempty" db:"created_at"`
+	UpdatedAt		time.Time	`json:"updated_at,omitempty" db:"updated_at"`
+}
+
+type CardLimitList struct {
+	Limits	[]*CardLimit	`json:"limits"`
+}
+
+func (l *CardLimit) Validate() error {
+	if l.Value <= 0 {
+		return InvalidLimit
+	}
+	if l.MCC != "" && !mcc.ValidRule(l.MCC) {
+		return InvalidMCC
+	}
+	switch l.Kind {
+	case LimitMaxAuth:
+		if l.Window != "" {
+			return InvalidLimit
+		}
+	case LimitSpend, LimitAuthCount:
+		if _, ok := limitWindows[l.Window]; !ok {
+			return InvalidLimit
+		}
+	default:
+		return InvalidLimit
+	}
+	return nil
+}
+
+// The start of the window the limit covers for an auth at now
+func (l *CardLimit) Since(now time.Time) time.Time {
+	return now.Add(-limitWindows[l.Window])
+}
+
+func (l *CardLimit) AppliesTo(merchant *Merchant) bool {
+	return l.MCC == "" || mcc.Matches(l.MCC, merchant.MCC)
+}
+
+func (l *CardLimit) String() string {
+	description := l.Kind
+	if l.Window != "" {
+		description = l.Window + " " + description
+	}
+	if l.MCC != "" {
+		description = description + " at " + l.MCC
+	}
+	return fmt.Sprintf("%s %s of %d", l.ID, description, l.Value)
+}
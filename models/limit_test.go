@@ -0,0 +1,47 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCardLimitValidate(t *testing.T) {
+	cases := []struct {
+		limit	CardLimit
+		err		error
+	}{
+		{CardLimit{Kind: LimitMaxAuth, Value: 5000}, nil},
+		{CardLimit{Kind: LimitSpend, Window: WindowWeek, Value: 5000}, nil},
+		{CardLimit{Kind: LimitAuthCount, Window: WindowDay, MCC: "groceries", Value: 3}, nil},
+		{CardLimit{Kind: LimitMaxAuth, Window: WindowDay, Value: 5000}, InvalidLimit},
+		{CardLimit{Kind: LimitSpend, Value: 5000}, InvalidLimit},
+		{CardLimit{Kind: LimitSpend, Window: "year", Value: 5000}, InvalidLimit},
+		{CardLimit{Kind: "velocity", Window: WindowDay, Value: 5000}, InvalidLimit},
+		{CardLimit{Kind: LimitMaxAuth, Value: 0}, InvalidLimit},
+		{CardLimit{Kind: LimitMaxAuth, MCC: "0000", Value: 5000}, InvalidMCC},
+	}
+	for _, c := range cases {
+		if err := c.limit.Validate(); err != c.err {
+			t.Errorf("%+v validated as %v, expected %v", c.limit, err, c.err)
+		}
+	}
+}
+
+func TestCardLimitWindow(t *testing.T) {
+	now := time.Date(2018, 10, 8, 12, 0, 0, 0, time.UTC)
+	windows := map[string]time.Time{
+		WindowDay: time.Date(2018, 10, 7, 12, 0, 0, 0, time.UTC),
+		WindowWeek: time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC),
+		WindowMonth: time.Date(2018, 9, 8, 12, 0, 0, 0, time.UTC),
+	}
+	for window, since := range windows {
+		limit := CardLimit{Kind: LimitSpend, Window: window}
+		if !limit.Since(now).Equal(since) {
+			t.Errorf("%s window starts at %s, expected %s", window, limit.Since(now), since)
+		}
+	}
+	limit := CardLimit{Kind: LimitSpend, Window: WindowDay, MCC: "groceries"}
+	if !limit.AppliesTo(&Merchant{MCC: "5411"}) || limit.AppliesTo(&Merchant{MCC: "5541"}) {
+		t.Errorf("groceries limit applies to the wrong merchants")
+	}
+}
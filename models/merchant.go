@@ -2,11 +2,25 @@ package models
 
 import "time"
 
+/*
+	MCC is the merchant's ISO 18245 category code, e.g. "5411" for supermarkets.
+	Category is a human label for it, and defaults to the code's description.
+	Deleted merchants keep their row, so past transactions still show them, but can't take new auths.
+ */
 type Merchant struct {
 	ID 			string		`json:"id" db:"id"`
 	Name 		string		`json:"name" db:"name"`
-	Type 		string		`json:"type" db:"type"`
+	MCC			string		`json:"mcc" db:"mcc"`
+	Category	string		`json:"category" db:"category"`
 	Address 	string		`json:"address" db:"address"`
+	Currency	string		`json:"currency" db:"currency"`
 	CreatedAt	time.Time	`json:"created_at,omitempty" db:"created_at"`
 	UpdatedAt	time.Time	`json:"updated_at,omitempty" db:"updated_at"`
+	DeletedAt	*time.Time	`json:"deleted_at,omitempty" db:"deleted_at"`
+}
+
+// A page of merchants ordered by id, Next is the id to pass as after for the following page
+type MerchantList struct {
+	Merchants	[]*Merchant	`json:"merchants"`
+	Next		string		`json:"next,omitempty"`
 }
@@ -0,0 +1,57 @@
+package models
+
+import "prepaidcard/mcc"
+
+/*
+	How far captures on one transaction may go, in total, over what was authorized
+	Percent is a whole percentage of the original auth and Max an amount in the card's currency.
+	When both are set the smaller wins, and when neither is the merchant can't over-capture at all.
+ */
+type OverCaptureRule struct {
+	Percent	int64	`yaml:"percent" json:"percent"`
+	Max		int64	`yaml:"max" json:"max"`
+}
+
+/*
+	The over-capture rules by MCC or MCC group
+	Restaurants settle with the tip added, and fuel, hotel and car rental merchants settle on the final bill.
+ */
+type OverCapturePolicy struct {
+	ByMCC	map[string]OverCaptureRule
+}
+
+// The rules used unless the configuration replaces them
+func DefaultOverCaptureRules() map[string]OverCaptureRule {
+	return map[string]OverCaptureRule{
+		mcc.GroupRestaurants: {Percent: 20},
+		mcc.GroupFuel: {Percent: 15},
+		"7011": {Percent: 15},
+		"7512": {Percent: 15},
+	}
+}
+
+func (r OverCaptureRule) Allowance(authAmount int64) int64 {
+	switch {
+	case r.Percent > 0 && r.Max > 0:
+		if percent := authAmount * r.Percent / 100; percent < r.Max {
+			return percent
+		}
+		return r.Max
+	case r.Percent > 0:
+		return authAmount * r.Percent / 100
+	}
+	return r.Max
+}
+
+// The most a merchant may over-capture an auth of authAmount by, a rule for its code wins over one for its group
+func (p OverCapturePolicy) Allowance(merchantMCC string, authAmount int64) int64 {
+	if rule, ok := p.ByMCC[merchantMCC]; ok {
+		return rule.Allowance(authAmount)
+	}
+	if code, ok := mcc.Lookup(merchantMCC); ok {
+		if rule, ok := p.ByMCC[code.Group]; ok {
+			return rule.Allowance(authAmount)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,36 @@
+package models
+
+import "testing"
+
+func TestOverCaptureRuleAllowance(t *testing.T) {
+	cases := []struct {
+		rule		OverCaptureRule
+		allowance	int64
+	}{
+		{OverCaptureRule{}, 0},
+		{OverCaptureRule{Percent: 20}, 200},
+		{OverCaptureRule{Max: 150}, 150},
+		{OverCaptureRule{Percent: 20, Max: 150}, 150},
+		{OverCaptureRule{Percent: 10, Max: 150}, 100},
+	}
+	for _, c := range cases {
+		if allowance := c.rule.Allowance(1000); allowance != c.allowance {
+			t.Errorf("%+v allows %d over an auth of 1000, expected %d", c.rule, allowance, c.allowance)
+		}
+	}
+	// Percentages round down to the minor unit
+	if allowance := (OverCaptureRule{Percent: 15}).Allowance(999); allowance != 149 {
+		t.Errorf("15%% of 999 allows %d, expected 149", allowance)
+	}
+}
+
+// A rule for the merchant's code wins over one for its group, and merchants without a rule can't over-capture
+func TestOverCapturePolicyAllowance(t *testing.T) {
+	policy := OverCapturePolicy{ByMCC: map[string]OverCaptureRule{"restaurants": {Percent: 20}, "5814": {Max: 50}}}
+	cases := map[string]int64{"5812": 200, "5814": 50, "5411": 0, "0000": 0}
+	for code, allowance := range cases {
+		if policy.Allowance(code, 1000) != allowance {
+			t.Errorf("%s allows %d over an auth of 1000, expected %d", code, policy.Allowance(code, 1000), allowance)
+		}
+	}
+}
@@ -1,13 +1,92 @@
 package models
 
 import (
+	"encoding/json"
+	"strings"
 	"time"
 )
 
+const (
+	CardActive = "active"
+	CardFrozen = "frozen"
+	CardBlocked = "blocked"
+	CardClosed = "closed"
+)
+
+// The statuses a card can move to from each status, closed is final
+var cardTransitions = map[string][]string{
+	CardActive: {CardFrozen, CardBlocked, CardClosed},
+	CardFrozen: {CardActive, CardBlocked, CardClosed},
+	CardBlocked: {CardClosed},
+}
+
+/*
+	A card is identified by its opaque ID everywhere in the API.
+	Balances are in the minor units of the card's ISO 4217 currency, e.g. pence for GBP.
+	The card number (PAN) is only ever serialised masked, see MaskPAN.
+ */
 type PrepaidCard struct {
+	ID				string		`json:"id" db:"id"`
 	CardNumber 		string		`json:"card_number" db:"card_number"`
 	FullBalance 	int64		`json:"full_balance" db:"full_balance"`
 	BlockedBalance 	int64		`json:"blocked_balance" db:"blocked_balance"`
+	Currency		string		`json:"currency" db:"currency"`
+	Status			string		`json:"status" db:"status"`
 	CreatedAt		time.Time	`json:"created_at,omitempty" db:"created_at"`
 	UpdatedAt		time.Time	`json:"updated_at,omitempty" db:"updated_at"`
 }
+
+// Masks all but the last four digits of a card number, e.g. ************1234
+func MaskPAN(number string) string {
+	if len(number) <= 4 {
+		return number
+	}
+	return strings.Repeat("*", len(number) - 4) + number[len(number) - 4:]
+}
+
+func (c PrepaidCard) MarshalJSON() ([]byte, error) {
+	type card PrepaidCard
+	return json.Marshal(struct {
+		card
+		CardNumber	string	`json:"card_number"`
+	}{card(c), MaskPAN(c.CardNumber)})
+}
+
+// The unmasked card number, only returned by the privileged reveal endpoint
+type CardPAN struct {
+	ID			string	`json:"id"`
+	CardNumber	string	`json:"card_number"`
+}
+
+// Checks the card can move to status, a card can't be closed while funds are still blocked
+func (c *PrepaidCard) CheckTransition(status string) error {
+	for _, allowed := range cardTransitions[c.Status] {
+		if allowed == status {
+			if status == CardClosed && c.BlockedBalance > 0 {
+				return CardHasBlockedFunds
+			}
+			return nil
+		}
+	}
+	return InvalidCardStatusChange
+}
+
+// New auths are only allowed on active cards
+func (c *PrepaidCard) CheckAuth() error {
+	if c.Status != CardActive {
+		return InvalidCardStatus
+	}
+	return nil
+}
+
+// Frozen cards can still be loaded and have their existing auths captured
+func (c *PrepaidCard) CheckLoad() error {
+	if c.Status != CardActive && c.Status != CardFrozen {
+		return InvalidCardStatus
+	}
+	return nil
+}
+
+func (c *PrepaidCard) CheckCapture() error {
+	return c.CheckLoad()
+}
@@ -0,0 +1,40 @@
+package models
+
+import "prepaidcard/mcc"
+
+/*
+	The merchant categories a card can be used at, each entry is an MCC or an MCC group.
+	A deny entry always wins, and once there is an allow entry only what it covers is allowed.
+ */
+type CardRestrictions struct {
+	CardID	string		`json:"card_id"`
+	Allow	[]string	`json:"allow"`
+	Deny	[]string	`json:"deny"`
+}
+
+func (r *CardRestrictions) Validate() error {
+	for _, rule := range append(append([]string{}, r.Allow...), r.Deny...) {
+		if !mcc.ValidRule(rule) {
+			return InvalidMCC
+		}
+	}
+	return nil
+}
+
+// Checks an auth at merchant against the restrictions
+func (r *CardRestrictions) CheckAuth(merchant *Merchant) error {
+	for _, rule := range r.Deny {
+		if mcc.Matches(rule, merchant.MCC) {
+			return MCCRestricted(merchant.MCC)
+		}
+	}
+	if len(r.Allow) == 0 {
+		return nil
+	}
+	for _, rule := range r.Allow {
+		if mcc.Matches(rule, merchant.MCC) {
+			return nil
+		}
+	}
+	return MCCRestricted(merchant.MCC)
+}
@@ -0,0 +1,41 @@
+package models
+
+import "testing"
+
+func TestCardRestrictionsCheckAuth(t *testing.T) {
+	grocer := &Merchant{MCC: "5411"}
+	station := &Merchant{MCC: "5541"}
+	casino := &Merchant{MCC: "7995"}
+	cases := []struct {
+		restrictions	CardRestrictions
+		merchant		*Merchant
+		allowed			bool
+	}{
+		{CardRestrictions{}, casino, true},
+		{CardRestrictions{Deny: []string{"gambling"}}, casino, false},
+		{CardRestrictions{Deny: []string{"gambling"}}, grocer, true},
+		{CardRestrictions{Allow: []string{"groceries"}}, grocer, true},
+		{CardRestrictions{Allow: []string{"groceries"}}, station, false},
+		{CardRestrictions{Allow: []string{"groceries", "5541"}}, station, true},
+		// Deny wins over allow
+		{CardRestrictions{Allow: []string{"groceries"}, Deny: []string{"5411"}}, grocer, false},
+	}
+	for _, c := range cases {
+		err := c.restrictions.CheckAuth(c.merchant)
+		if (err == nil) != c.allowed {
+			t.Errorf("%+v at %s returned %v, expected allowed %v", c.restrictions, c.merchant.MCC, err, c.allowed)
+		}
+		if err != nil && err.Error() != MCCRestricted(c.merchant.MCC).Error() {
+			t.Errorf("%+v at %s returned %v", c.restrictions, c.merchant.MCC, err)
+		}
+	}
+}
+
+func TestCardRestrictionsValidate(t *testing.T) {
+	if err := (&CardRestrictions{Allow: []string{"groceries", "5541"}, Deny: []string{"3000"}}).Validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (&CardRestrictions{Deny: []string{"casinos"}}).Validate(); err != InvalidMCC {
+		t.Errorf("unknown group validated as %v", err)
+	}
+}
@@ -1,17 +1,108 @@
 package models
 
-import "time"
+import (
+	"prepaidcard/mcc"
+	"time"
+)
+
+const (
+	SortNewest = "desc"
+	SortOldest = "asc"
+)
 
 type Spending struct {
-	CardNumber		string		`json:"card_number" db:"card_id"`
+	CardID			string		`json:"card_id" db:"card_id"`
+	CardNumber		string		`json:"card_number" db:"card_number"`
 	TransactionId	string		`json:"transaction_id" db:"transaction_id"`
-	MerchantType	string		`json:"merchant_type" db:"merchant_type"`
+	MerchantID		string		`json:"merchant_id" db:"merchant_id"`
+	MerchantMCC		string		`json:"merchant_mcc" db:"merchant_mcc"`
+	MerchantCategory	string	`json:"merchant_category" db:"merchant_category"`
 	MerchantName	string		`json:"merchant_name" db:"merchant_name"`
 	OriginalAmount	int64		`json:"authorized_amount" db:"auth_amount"`
 	CapturedAmount	int64		`json:"amount" db:"amount"`
+	Currency		string		`json:"currency" db:"currency"`
+	// The transaction's status, see Transaction.UpdateStatus
+	Status			string		`json:"status" db:"status"`
 	Time 			time.Time	`json:"time" db:"auth_time"`
 }
 
+// Totals over every row that matched the filter, not just the page returned
+type SpendingSummary struct {
+	Count			int64	`json:"count" db:"count"`
+	AuthorizedTotal	int64	`json:"authorized_total" db:"authorized_total"`
+	CapturedTotal	int64	`json:"captured_total" db:"captured_total"`
+	Currency		string	`json:"currency" db:"-"`
+}
+
+// A page of a card's spending ordered by transaction id, Next is the id to pass as after for the following page
 type SpendingList struct {
-	SpendingList	[]*Spending `json:"spending"`
-}
\ No newline at end of file
+	SpendingList	[]*Spending		`json:"spending"`
+	Next			string			`json:"next,omitempty"`
+	Summary			SpendingSummary	`json:"summary"`
+}
+
+/*
+	Selects and pages a card's spending, every field left empty matches everything
+	From is inclusive and To exclusive, both on the auth time. MCC takes a code or a group,
+	and MinAmount and MaxAmount bound the authorized amount.
+ */
+type SpendingFilter struct {
+	After		string
+	Limit		int
+	Order		string
+	From		*time.Time
+	To			*time.Time
+	MerchantID	string
+	MCC			string
+	Status		string
+	MinAmount	*int64
+	MaxAmount	*int64
+}
+
+func (f *SpendingFilter) Validate() error {
+	if f.Limit <= 0 || (f.Order != SortNewest && f.Order != SortOldest) {
+		return InvalidPagination
+	}
+	if f.From != nil && f.To != nil && !f.From.Before(*f.To) {
+		return InvalidFilter
+	}
+	if f.MCC != "" && !mcc.ValidRule(f.MCC) {
+		return InvalidMCC
+	}
+	if f.Status != "" && !ValidTransactionStatus(f.Status) {
+		return InvalidFilter
+	}
+	if (f.MinAmount != nil && *f.MinAmount < 0) || (f.MaxAmount != nil && *f.MaxAmount < 0) {
+		return InvalidFilter
+	}
+	if f.MinAmount != nil && f.MaxAmount != nil && *f.MinAmount > *f.MaxAmount {
+		return InvalidFilter
+	}
+	return nil
+}
+
+// Reports whether a row passes every filter, the cursor aside
+func (f *SpendingFilter) Matches(spending *Spending) bool {
+	if f.From != nil && spending.Time.UTC().Before(f.From.UTC()) {
+		return false
+	}
+	if f.To != nil && !spending.Time.UTC().Before(f.To.UTC()) {
+		return false
+	}
+	if f.MerchantID != "" && spending.MerchantID != f.MerchantID {
+		return false
+	}
+	if f.MCC != "" && !mcc.Matches(f.MCC, spending.MerchantMCC) {
+		return false
+	}
+	if f.Status != "" && spending.Status != f.Status {
+		return false
+	}
+	if f.MinAmount != nil && spending.OriginalAmount < *f.MinAmount {
+		return false
+	}
+	if f.MaxAmount != nil && spending.OriginalAmount > *f.MaxAmount {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpendingFilterValidate(t *testing.T) {
+	from := time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+	small, large, negative := int64(100), int64(1000), int64(-1)
+	cases := []struct {
+		filter	SpendingFilter
+		err		error
+	}{
+		{SpendingFilter{Limit: 10, Order: SortNewest}, nil},
+		{SpendingFilter{Limit: 10, Order: SortOldest, From: &from, To: &to, MCC: "groceries", Status: TransactionPending,
+			MinAmount: &small, MaxAmount: &large}, nil},
+		{SpendingFilter{Limit: 0, Order: SortNewest}, InvalidPagination},
+		{SpendingFilter{Limit: 10, Order: "sideways"}, InvalidPagination},
+		{SpendingFilter{Limit: 10, Order: SortNewest, From: &to, To: &from}, InvalidFilter},
+		{SpendingFilter{Limit: 10, Order: SortNewest, From: &from, To: &from}, InvalidFilter},
+		{SpendingFilter{Limit: 10, Order: SortNewest, MCC: "0000"}, InvalidMCC},
+		{SpendingFilter{Limit: 10, Order: SortNewest, Status: "settled"}, InvalidFilter},
+		{SpendingFilter{Limit: 10, Order: SortNewest, MinAmount: &negative}, InvalidFilter},
+		{SpendingFilter{Limit: 10, Order: SortNewest, MinAmount: &large, MaxAmount: &small}, InvalidFilter},
+	}
+	for _, c := range cases {
+		if err := c.filter.Validate(); err != c.err {
+			t.Errorf("%+v validated as %v, expected %v", c.filter, err, c.err)
+		}
+	}
+}
+
+// Time bounds compare instants, whatever zone either side is in
+func TestSpendingFilterMatches(t *testing.T) {
+	tokyo := time.FixedZone("UTC+9", 9 * 60 * 60)
+	from := time.Date(2018, 10, 1, 9, 0, 0, 0, tokyo)
+	to := time.Date(2018, 10, 2, 0, 0, 0, 0, time.UTC)
+	min, max := int64(100), int64(1000)
+	filter := SpendingFilter{From: &from, To: &to, MCC: "groceries", MinAmount: &min, MaxAmount: &max}
+	matching := Spending{MerchantMCC: "5411", OriginalAmount: 500, Time: time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC)}
+	if !filter.Matches(&matching) {
+		t.Errorf("%+v doesn't match an auth at the start of the window", matching)
+	}
+	cases := map[string]Spending{
+		"before": {MerchantMCC: "5411", OriginalAmount: 500, Time: time.Date(2018, 9, 30, 23, 59, 0, 0, time.UTC)},
+		"at to": {MerchantMCC: "5411", OriginalAmount: 500, Time: time.Date(2018, 10, 2, 9, 0, 0, 0, tokyo)},
+		"fuel": {MerchantMCC: "5541", OriginalAmount: 500, Time: matching.Time},
+		"small": {MerchantMCC: "5411", OriginalAmount: 99, Time: matching.Time},
+		"large": {MerchantMCC: "5411", OriginalAmount: 1001, Time: matching.Time},
+	}
+	for name, spending := range cases {
+		if filter.Matches(&spending) {
+			t.Errorf("%s auth %+v matches", name, spending)
+		}
+	}
+}
@@ -2,15 +2,105 @@ package models
 
 import "time"
 
+const (
+	// Funds are held and nothing has been captured yet
+	TransactionPending = "pending"
+	// Some has been captured and funds are still held for the rest
+	TransactionPartiallyCaptured = "partially_captured"
+	// Nothing is held any more and what was captured stands
+	TransactionCaptured = "captured"
+	// Nothing is held and some of what was captured has been refunded
+	TransactionPartiallyRefunded = "partially_refunded"
+	// Everything captured has been refunded
+	TransactionRefunded = "refunded"
+	// The auth was reversed before anything was captured
+	TransactionReversed = "reversed"
+	// The auth expired before anything was captured
+	TransactionExpired = "expired"
+)
+
+/*
+	Amounts on a transaction are in the card's currency.
+	The auth as the merchant made it is kept in MerchantAmount and MerchantCurrency,
+	along with the FXRate used to convert it (1 when the currencies match).
+	Increments add to the MerchantAmount and OriginalAmount, so they are what the auth came to in total.
+ */
 type Transaction struct {
 	ID 					string			`json:"id" db:"id"`
-	CardID 				string			`json:"-" db:"card_id"`
+	CardID 				string			`json:"card_id" db:"card_id"`
 	Card 				*PrepaidCard	`json:"card" db:"-"`
 	MerchantID 			string			`json:"-" db:"merchant_id"`
 	Merchant 			*Merchant		`json:"merchant" db:"-"`
 	OriginalAmount		int64			`json:"original_amount" db:"original_amount"`
 	AuthorizedAmount 	int64			`json:"authorized_amount" db:"authorized_amount"`
 	CapturedAmount 		int64			`json:"captured_amount" db:"captured_amount"`
+	Status				string			`json:"status" db:"status"`
+	Currency			string			`json:"currency" db:"currency"`
+	MerchantAmount		int64			`json:"merchant_amount" db:"merchant_amount"`
+	MerchantCurrency	string			`json:"merchant_currency" db:"merchant_currency"`
+	FXRate				string			`json:"fx_rate" db:"fx_rate"`
+	ExpiresAt			time.Time		`json:"expires_at" db:"expires_at"`
 	CreatedAt			time.Time		`json:"created_at,omitempty" db:"created_at"`
 	UpdatedAt			time.Time		`json:"updated_at,omitempty" db:"updated_at"`
+	Captures			[]*Capture		`json:"captures,omitempty" db:"-"`
+}
+
+/*
+	Sets the status from the amounts once an operation of kind has been applied
+	refunded is the total refunded off the transaction's captures, so CapturedAmount + refunded is what was ever captured.
+	When an auth is released without anything captured, kind tells a reverse from an expiry.
+ */
+func (t *Transaction) UpdateStatus(kind string, refunded int64) {
+	everCaptured := t.CapturedAmount + refunded > 0
+	switch {
+	case t.AuthorizedAmount > 0 && !everCaptured:
+		t.Status = TransactionPending
+	case t.AuthorizedAmount > 0:
+		t.Status = TransactionPartiallyCaptured
+	case !everCaptured && kind == EventExpire:
+		t.Status = TransactionExpired
+	case !everCaptured:
+		t.Status = TransactionReversed
+	case t.CapturedAmount == 0:
+		t.Status = TransactionRefunded
+	case refunded > 0:
+		t.Status = TransactionPartiallyRefunded
+	default:
+		t.Status = TransactionCaptured
+	}
+}
+
+/*
+	Checks an operation of kind is allowed in the transaction's status
+	Increments, captures and reverses need funds still held, and refunds something captured and not yet refunded.
+ */
+func (t *Transaction) CheckOperation(kind string) error {
+	switch t.Status {
+	case TransactionPending:
+		if kind == EventRefund {
+			return InvalidTransactionCaptured
+		}
+	case TransactionPartiallyCaptured:
+	case TransactionCaptured, TransactionPartiallyRefunded:
+		if kind != EventRefund {
+			return TransactionFullyCaptured
+		}
+	case TransactionRefunded:
+		return TransactionFullyRefunded
+	case TransactionReversed:
+		return TransactionAlreadyReversed
+	case TransactionExpired:
+		return AuthExpired
+	}
+	return nil
+}
+
+// Reports whether status is one of the transaction statuses above
+func ValidTransactionStatus(status string) bool {
+	switch status {
+	case TransactionPending, TransactionPartiallyCaptured, TransactionCaptured, TransactionPartiallyRefunded,
+		TransactionRefunded, TransactionReversed, TransactionExpired:
+		return true
+	}
+	return false
 }
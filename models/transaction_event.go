@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+const (
+	EventAuth = "auth"
+	EventIncrement = "increment"
+	EventCapture = "capture"
+	EventReverse = "reverse"
+	EventRefund = "refund"
+	EventExpire = "expire"
+)
+
+// One operation on a transaction, with the transaction's totals once it was applied
+type TransactionEvent struct {
+	ID					string		`json:"id" db:"id"`
+	TransactionID		string		`json:"transaction_id" db:"transaction_id"`
+	Kind				string		`json:"kind" db:"kind"`
+	Amount				int64		`json:"amount" db:"amount"`
+	AuthorizedAmount	int64		`json:"authorized_amount" db:"authorized_amount"`
+	CapturedAmount		int64		`json:"captured_amount" db:"captured_amount"`
+	CreatedAt			time.Time	`json:"created_at" db:"created_at"`
+}
+
+type TransactionEventList struct {
+	Events	[]*TransactionEvent	`json:"events"`
+}
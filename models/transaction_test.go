@@ -0,0 +1,81 @@
+package models
+
+import "testing"
+
+// The status follows from the amounts left authorized and captured, what was refunded, and the last event
+func TestTransactionUpdateStatus(t *testing.T) {
+	cases := []struct {
+		authorized	int64
+		captured	int64
+		refunded	int64
+		kind		string
+		status		string
+	}{
+		{1000, 0, 0, EventAuth, TransactionPending},
+		{1200, 0, 0, EventIncrement, TransactionPending},
+		{700, 300, 0, EventCapture, TransactionPartiallyCaptured},
+		{700, 200, 100, EventRefund, TransactionPartiallyCaptured},
+		{0, 1000, 0, EventCapture, TransactionCaptured},
+		{0, 300, 0, EventReverse, TransactionCaptured},
+		{0, 300, 0, EventExpire, TransactionCaptured},
+		{0, 600, 400, EventRefund, TransactionPartiallyRefunded},
+		{0, 0, 1000, EventRefund, TransactionRefunded},
+		{0, 0, 0, EventReverse, TransactionReversed},
+		{0, 0, 0, EventExpire, TransactionExpired},
+	}
+	for _, c := range cases {
+		transaction := Transaction{AuthorizedAmount: c.authorized, CapturedAmount: c.captured}
+		transaction.UpdateStatus(c.kind, c.refunded)
+		if transaction.Status != c.status {
+			t.Errorf("%s leaving %d authorized, %d captured and %d refunded is %s, expected %s", c.kind, c.authorized,
+				c.captured, c.refunded, transaction.Status, c.status)
+		}
+	}
+}
+
+func TestTransactionCheckOperation(t *testing.T) {
+	held := []string{EventIncrement, EventCapture, EventReverse}
+	cases := map[string]map[string]error{
+		TransactionPending: {EventIncrement: nil, EventCapture: nil, EventReverse: nil, EventRefund: InvalidTransactionCaptured},
+		TransactionPartiallyCaptured: {EventIncrement: nil, EventCapture: nil, EventReverse: nil, EventRefund: nil},
+		TransactionCaptured: {EventRefund: nil},
+		TransactionPartiallyRefunded: {EventRefund: nil},
+		TransactionRefunded: {EventRefund: TransactionFullyRefunded},
+		TransactionReversed: {EventRefund: TransactionAlreadyReversed},
+		TransactionExpired: {EventRefund: AuthExpired},
+	}
+	// Nothing left held means no increment, capture or reverse, whichever way the funds went
+	for status, reason := range map[string]error{
+		TransactionCaptured: TransactionFullyCaptured,
+		TransactionPartiallyRefunded: TransactionFullyCaptured,
+		TransactionRefunded: TransactionFullyRefunded,
+		TransactionReversed: TransactionAlreadyReversed,
+		TransactionExpired: AuthExpired,
+	} {
+		for _, kind := range held {
+			cases[status][kind] = reason
+		}
+	}
+	for status, kinds := range cases {
+		for kind, expected := range kinds {
+			transaction := Transaction{Status: status}
+			if err := transaction.CheckOperation(kind); err != expected {
+				t.Errorf("%s on a %s transaction returned %v, expected %v", kind, status, err, expected)
+			}
+		}
+	}
+}
+
+func TestValidTransactionStatus(t *testing.T) {
+	for _, status := range []string{TransactionPending, TransactionPartiallyCaptured, TransactionCaptured,
+		TransactionPartiallyRefunded, TransactionRefunded, TransactionReversed, TransactionExpired} {
+		if !ValidTransactionStatus(status) {
+			t.Errorf("%s is not a valid status", status)
+		}
+	}
+	for _, status := range []string{"", "settled", "Pending"} {
+		if ValidTransactionStatus(status) {
+			t.Errorf("%q is a valid status", status)
+		}
+	}
+}
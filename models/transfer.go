@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+const (
+	TransferCompleted = "completed"
+	TransferReversed = "reversed"
+)
+
+/*
+	A move of Amount out of one card's available balance and into another's, both in Currency
+	Reversing a transfer moves the amount back, so the card it went to needs that much available.
+ */
+type Transfer struct {
+	ID			string			`json:"id" db:"id"`
+	FromCardID	string			`json:"from_card_id" db:"from_card_id"`
+	FromCard	*PrepaidCard	`json:"from_card,omitempty" db:"-"`
+	ToCardID	string			`json:"to_card_id" db:"to_card_id"`
+	ToCard		*PrepaidCard	`json:"to_card,omitempty" db:"-"`
+	Amount		int64			`json:"amount" db:"amount"`
+	Currency	string			`json:"currency" db:"currency"`
+	Status		string			`json:"status" db:"status"`
+	CreatedAt	time.Time		`json:"created_at" db:"created_at"`
+	UpdatedAt	time.Time		`json:"updated_at" db:"updated_at"`
+	ReversedAt	*time.Time		`json:"reversed_at,omitempty" db:"reversed_at"`
+}
+
+// A page of a card's transfers in and out ordered by id, Next is the id to pass as after for the following page
+type TransferList struct {
+	Transfers	[]*Transfer	`json:"transfers"`
+	Next		string		`json:"next,omitempty"`
+}
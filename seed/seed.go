@@ -0,0 +1,171 @@
+package seed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"prepaidcard/currency"
+	"prepaidcard/mcc"
+	"prepaidcard/models"
+	"strings"
+)
+
+type Merchant struct {
+	ID			string	`json:"id" yaml:"id"`
+	Name		string	`json:"name" yaml:"name"`
+	MCC			string	`json:"mcc" yaml:"mcc"`
+	Category	string	`json:"category" yaml:"category"`
+	Address		string	`json:"address" yaml:"address"`
+	Currency	string	`json:"currency" yaml:"currency"`
+}
+
+// A card to create with an opening balance, in the minor unit of its currency
+type Card struct {
+	ID			string	`json:"id" yaml:"id"`
+	Currency	string	`json:"currency" yaml:"currency"`
+	Balance		int64	`json:"balance" yaml:"balance"`
+}
+
+type Fixture struct {
+	Merchants	[]Merchant	`json:"merchants" yaml:"merchants"`
+	Cards		[]Card		`json:"cards" yaml:"cards"`
+}
+
+// The ids of the fixture's records by what seeding did with them
+type Result struct {
+	Created		[]string
+	Updated		[]string
+	Unchanged	[]string
+	// Merchants whose id or name is held by a deleted merchant, or by another merchant
+	Skipped		[]string
+}
+
+type Report struct {
+	Merchants	Result
+	Cards		Result
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%d created %v, %d updated %v, %d unchanged, %d skipped %v",
+		len(r.Created), r.Created, len(r.Updated), r.Updated, len(r.Unchanged), len(r.Skipped), r.Skipped)
+}
+
+// Reads a fixture from a .json, .yaml or .yml file
+func Load(path string) (*Fixture, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fixture Fixture
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&fixture)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, &fixture)
+	default:
+		return nil, fmt.Errorf("seed file %s must be .json, .yaml or .yml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid seed file %s: %v", path, err)
+	}
+	return &fixture, nil
+}
+
+/*
+	Upserts the fixture through the store, so it works the same against every backend and can be run on every start
+	- A merchant missing from the store is created, one that differs from the fixture is updated to match
+	- A card missing from the store is created with its balance in one go, an existing card is left alone
+ */
+func Apply(ctx context.Context, store models.CardStore, fixture *Fixture) (*Report, error) {
+	var report Report
+	for _, m := range fixture.Merchants {
+		if err := applyMerchant(ctx, store, m, &report.Merchants); err != nil {
+			return &report, fmt.Errorf("seeding merchant %q: %v", m.ID, err)
+		}
+	}
+	for _, c := range fixture.Cards {
+		if err := applyCard(ctx, store, c, &report.Cards); err != nil {
+			return &report, fmt.Errorf("seeding card %q: %v", c.ID, err)
+		}
+	}
+	return &report, nil
+}
+
+func applyMerchant(ctx context.Context, store models.CardStore, m Merchant, result *Result) error {
+	if m.ID == "" {
+		return models.InvalidMerchant
+	}
+	merchant := models.Merchant{
+		ID: m.ID,
+		Name: m.Name,
+		MCC: m.MCC,
+		Category: m.Category,
+		Address: m.Address,
+		Currency: m.Currency,
+	}
+	existing, err := store.GetMerchant(ctx, m.ID)
+	if err == models.NotFound {
+		_, err = store.CreateMerchant(ctx, &merchant)
+		if err == models.MerchantExists {
+			result.Skipped = append(result.Skipped, m.ID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		result.Created = append(result.Created, m.ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if merchant.Currency == "" {
+		merchant.Currency = currency.Default
+	}
+	if code, ok := mcc.Lookup(merchant.MCC); ok && merchant.Category == "" {
+		merchant.Category = code.Description
+	}
+	if existing.Name == merchant.Name && existing.MCC == merchant.MCC && existing.Category == merchant.Category &&
+		existing.Address == merchant.Address && existing.Currency == merchant.Currency {
+		result.Unchanged = append(result.Unchanged, m.ID)
+		return nil
+	}
+	_, err = store.UpdateMerchant(ctx, &merchant)
+	if err == models.MerchantExists {
+		result.Skipped = append(result.Skipped, m.ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	result.Updated = append(result.Updated, m.ID)
+	return nil
+}
+
+func applyCard(ctx context.Context, store models.CardStore, c Card, result *Result) error {
+	if c.ID == "" {
+		return fmt.Errorf("cards need an id")
+	}
+	if c.Balance < 0 {
+		return models.InvalidAmount
+	}
+	_, err := store.GetCard(ctx, c.ID)
+	if err == nil {
+		result.Unchanged = append(result.Unchanged, c.ID)
+		return nil
+	}
+	if err != models.NotFound {
+		return err
+	}
+	if _, err = store.CreateCardWithID(ctx, c.ID, c.Currency, c.Balance); err != nil {
+		return err
+	}
+	result.Created = append(result.Created, c.ID)
+	return nil
+}
@@ -1,19 +1,59 @@
 package server
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"prepaidcard/cardnumber"
+	"prepaidcard/currency"
+	"prepaidcard/mcc"
 	"prepaidcard/models"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const (
+	defaultPageSize = 50
+	maxPageSize = 500
+)
+
+// Captures the amount, and with final set releases whatever is left of the auth
+type CaptureRequest struct {
+	Amount	int64	`json:"amount"`
+	Final	bool	`json:"final,omitempty"`
+}
+
+// Refunds the amount off the capture with CaptureID, or off the transaction's captures oldest first without one
+type RefundRequest struct {
+	CaptureID	string	`json:"capture_id,omitempty"`
+	Amount		int64	`json:"amount"`
+}
+
+// Moves Amount from the card with FromCardID to the card with ToCardID
+type TransferRequest struct {
+	FromCardID	string	`json:"from_card_id"`
+	ToCardID	string	`json:"to_card_id"`
+	Amount		int64	`json:"amount"`
+}
+
 type CardRequest struct {
+	CardID		string	`json:"card_id,omitempty"`
 	CardNumber	string	`json:"card_number,omitempty"`
 	MerchantId	string	`json:"merchant_id,omitempty"`
 	Amount		int64	`json:"amount"`
+	Currency	string	`json:"currency,omitempty"`
 }
 
 func handleError(err error, c *gin.Context) {
+	if ctxErr := c.Request.Context().Err(); ctxErr != nil {
+		log.WithError(err).Warn("request ran out of time")
+		c.AbortWithStatusJSON(503, gin.H{
+			"details": fmt.Sprintln(ctxErr),
+		})
+		return
+	}
 	if e, ok := err.(models.Error); ok {
 		c.AbortWithStatusJSON(e.Code(), gin.H{
 			"details": fmt.Sprintln(e),
@@ -28,7 +68,17 @@ func handleError(err error, c *gin.Context) {
 }
 
 func (s *Server) createCard(c *gin.Context) {
-	newCard, err := s.store.CreateCard()
+	var request CardRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&request); err != nil {
+			return
+		}
+	}
+	if request.Currency != "" && !currency.Valid(request.Currency) {
+		handleError(models.InvalidCurrency, c)
+		return
+	}
+	newCard, err := s.store.CreateCard(c.Request.Context(), request.Currency)
 	if err != nil {
 		handleError(err, c)
 		return
@@ -38,7 +88,7 @@ func (s *Server) createCard(c *gin.Context) {
 
 func (s *Server) getCard(c *gin.Context) {
 	cardId := c.Param("cardId")
-	card, err := s.store.GetCard(cardId)
+	card, err := s.store.GetCard(c.Request.Context(), cardId)
 	if err != nil {
 		handleError(err, c)
 		return
@@ -46,9 +96,34 @@ func (s *Server) getCard(c *gin.Context) {
 	c.JSON(200, card)
 }
 
+// Returns the unmasked card number, only to callers presenting the configured reveal token
+func (s *Server) revealCardNumber(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if s.PANRevealToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.PANRevealToken)) != 1 {
+		handleError(models.Forbidden, c)
+		return
+	}
+	cardId := c.Param("cardId")
+	card, err := s.store.GetCard(c.Request.Context(), cardId)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, models.CardPAN{ID: card.ID, CardNumber: card.CardNumber})
+}
+
+/*
+	Pages through the card's spending, newest first unless order=asc, taking after and limit like the merchant list
+	Filters: from and to (RFC 3339 times), merchant_id, mcc (a code or group), status, min_amount and max_amount.
+ */
 func (s *Server) listSpending(c *gin.Context) {
 	cardId := c.Param("cardId")
-	transactionList, err := s.store.TransactionList(cardId)
+	filter, err := spendingFilter(c)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	transactionList, err := s.store.TransactionList(c.Request.Context(), cardId, filter)
 	if err != nil {
 		handleError(err, c)
 		return
@@ -56,6 +131,25 @@ func (s *Server) listSpending(c *gin.Context) {
 	c.JSON(200, transactionList)
 }
 
+func (s *Server) getCardLedger(c *gin.Context) {
+	cardId := c.Param("cardId")
+	ledger, err := s.store.CardLedger(c.Request.Context(), cardId)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, ledger)
+}
+
+func (s *Server) getLedgerBalances(c *gin.Context) {
+	balances, err := s.store.LedgerBalances(c.Request.Context())
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, balances)
+}
+
 func (s *Server) loadCard(c *gin.Context) {
 	cardId := c.Param("cardId")
 	var request CardRequest
@@ -67,7 +161,7 @@ func (s *Server) loadCard(c *gin.Context) {
 		handleError(err, c)
 		return
 	}
-	card, err := s.store.LoadCard(cardId, request.Amount)
+	card, err := s.store.LoadCard(c.Request.Context(), cardId, request.Amount)
 	if err != nil {
 		handleError(err, c)
 		return
@@ -75,6 +169,180 @@ func (s *Server) loadCard(c *gin.Context) {
 	c.JSON(200, card)
 }
 
+func (s *Server) setCardStatus(status string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cardId := c.Param("cardId")
+		card, err := s.store.SetCardStatus(c.Request.Context(), cardId, status)
+		if err != nil {
+			handleError(err, c)
+			return
+		}
+		c.JSON(200, card)
+	}
+}
+
+func (s *Server) listCardLimits(c *gin.Context) {
+	cardId := c.Param("cardId")
+	limits, err := s.store.ListCardLimits(c.Request.Context(), cardId)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, limits)
+}
+
+func (s *Server) getCardLimit(c *gin.Context) {
+	limit, err := s.store.GetCardLimit(c.Request.Context(), c.Param("cardId"), c.Param("limitId"))
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, limit)
+}
+
+func (s *Server) createCardLimit(c *gin.Context) {
+	var request models.CardLimit
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+	request.CardID = c.Param("cardId")
+	limit, err := s.store.CreateCardLimit(c.Request.Context(), &request)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, limit)
+}
+
+// Changes only the fields present in the request, the rest are kept from the stored limit
+func (s *Server) updateCardLimit(c *gin.Context) {
+	cardId := c.Param("cardId")
+	limitId := c.Param("limitId")
+	request, err := s.store.GetCardLimit(c.Request.Context(), cardId, limitId)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	if err := c.BindJSON(request); err != nil {
+		return
+	}
+	request.ID = limitId
+	request.CardID = cardId
+	limit, err := s.store.UpdateCardLimit(c.Request.Context(), request)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, limit)
+}
+
+func (s *Server) deleteCardLimit(c *gin.Context) {
+	err := s.store.DeleteCardLimit(c.Request.Context(), c.Param("cardId"), c.Param("limitId"))
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, gin.H{})
+}
+
+func (s *Server) getCardRestrictions(c *gin.Context) {
+	restrictions, err := s.store.GetCardRestrictions(c.Request.Context(), c.Param("cardId"))
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, restrictions)
+}
+
+func (s *Server) setCardRestrictions(c *gin.Context) {
+	var request models.CardRestrictions
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+	request.CardID = c.Param("cardId")
+	restrictions, err := s.store.SetCardRestrictions(c.Request.Context(), &request)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, restrictions)
+}
+
+func listMCCs(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"codes": mcc.Codes(),
+		"groups": mcc.Groups(),
+	})
+}
+
+func (s *Server) createMerchant(c *gin.Context) {
+	var request models.Merchant
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+	request.DeletedAt = nil
+	merchant, err := s.store.CreateMerchant(c.Request.Context(), &request)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, merchant)
+}
+
+func (s *Server) getMerchant(c *gin.Context) {
+	merchant, err := s.store.GetMerchant(c.Request.Context(), c.Param("merchantId"))
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, merchant)
+}
+
+// Takes optional after (the next from the previous page) and limit query parameters
+func (s *Server) listMerchants(c *gin.Context) {
+	limit, err := pageSize(c)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	merchants, err := s.store.ListMerchants(c.Request.Context(), c.Query("after"), limit)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, merchants)
+}
+
+// Changes only the fields present in the request, the rest are kept from the stored merchant
+func (s *Server) updateMerchant(c *gin.Context) {
+	merchantId := c.Param("merchantId")
+	request, err := s.store.GetMerchant(c.Request.Context(), merchantId)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	if err := c.BindJSON(request); err != nil {
+		return
+	}
+	request.ID = merchantId
+	request.DeletedAt = nil
+	merchant, err := s.store.UpdateMerchant(c.Request.Context(), request)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, merchant)
+}
+
+func (s *Server) deleteMerchant(c *gin.Context) {
+	err := s.store.DeleteMerchant(c.Request.Context(), c.Param("merchantId"))
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, gin.H{})
+}
+
 func (s *Server) authRequest(c *gin.Context) {
 	var request CardRequest
 	if err := c.BindJSON(&request); err != nil {
@@ -85,17 +353,32 @@ func (s *Server) authRequest(c *gin.Context) {
 		handleError(err, c)
 		return
 	}
-	merchant, err := s.store.GetMerchant(request.MerchantId)
+	if request.Currency != "" && !currency.Valid(request.Currency) {
+		handleError(models.InvalidCurrency, c)
+		return
+	}
+	if request.CardID == "" && !cardnumber.Valid(request.CardNumber) {
+		err := models.InvalidCardNumber
+		handleError(err, c)
+		return
+	}
+	merchant, err := s.store.GetMerchant(c.Request.Context(), request.MerchantId)
 	if err != nil {
 		handleError(err, c)
 		return
 	}
-	card, err := s.store.GetCard(request.CardNumber)
+	var card *models.PrepaidCard
+	if request.CardID != "" {
+		card, err = s.store.GetCard(c.Request.Context(), request.CardID)
+	} else {
+		card, err = s.store.GetCardByNumber(c.Request.Context(), request.CardNumber)
+	}
 	if err != nil {
 		handleError(err, c)
 		return
 	}
-	transaction, err := s.store.Auth(card, merchant, request.Amount)
+	expiresAt := time.Now().Add(s.AuthExpiry.Lifetime(merchant.MCC))
+	transaction, err := s.store.Auth(c.Request.Context(), card, merchant, request.Amount, request.Currency, expiresAt)
 	if err != nil {
 		handleError(err, c)
 		return
@@ -103,9 +386,20 @@ func (s *Server) authRequest(c *gin.Context) {
 	c.JSON(200, transaction)
 }
 
-func (s *Server) captureTransaction(c *gin.Context) {
+func (s *Server) listTransactionEvents(c *gin.Context) {
 	transactionId := c.Param("transactionId")
-	transaction, err := s.store.GetTransaction(transactionId)
+	events, err := s.store.TransactionEvents(c.Request.Context(), transactionId)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, events)
+}
+
+// Increases an auth by an amount in the merchant's currency, which has to be given
+func (s *Server) incrementTransaction(c *gin.Context) {
+	transactionId := c.Param("transactionId")
+	transaction, err := s.store.GetTransaction(c.Request.Context(), transactionId)
 	if err != nil {
 		handleError(err, c)
 		return
@@ -114,21 +408,74 @@ func (s *Server) captureTransaction(c *gin.Context) {
 	if err := c.BindJSON(&request); err != nil {
 		return
 	}
-	if request.Amount <= 0 || request.Amount > transaction.AuthorizedAmount {
+	if err := transaction.CheckOperation(models.EventIncrement); err != nil {
+		handleError(err, c)
+		return
+	}
+	if request.Amount <= 0 {
 		err := models.InvalidAmount
 		handleError(err, c)
 		return
 	}
-	if err = s.store.Capture(transaction, request.Amount); err != nil {
+	if err = s.store.Increment(c.Request.Context(), transaction, request.Amount, request.Currency); err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, transaction)
+}
+
+func (s *Server) captureTransaction(c *gin.Context) {
+	transactionId := c.Param("transactionId")
+	transaction, err := s.store.GetTransaction(c.Request.Context(), transactionId)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	var request CaptureRequest
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+	if err := transaction.CheckOperation(models.EventCapture); err != nil {
+		handleError(err, c)
+		return
+	}
+	// Captures over the auth are checked by the store against the merchant's over-capture allowance
+	if request.Amount <= 0 {
+		err := models.InvalidAmount
+		handleError(err, c)
+		return
+	}
+	if _, err = s.store.Capture(c.Request.Context(), transaction, request.Amount, request.Final); err != nil {
+		handleError(err, c)
+		return
+	}
+	s.respondWithCaptures(c, transaction)
+}
+
+func (s *Server) listCaptures(c *gin.Context) {
+	transactionId := c.Param("transactionId")
+	captures, err := s.store.ListCaptures(c.Request.Context(), transactionId)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, captures)
+}
+
+// Responds with the transaction and its captures, after a capture or refund has changed them
+func (s *Server) respondWithCaptures(c *gin.Context, transaction *models.Transaction) {
+	captures, err := s.store.ListCaptures(c.Request.Context(), transaction.ID)
+	if err != nil {
 		handleError(err, c)
 		return
 	}
+	transaction.Captures = captures.Captures
 	c.JSON(200, transaction)
 }
 
 func (s *Server) reverseTransaction(c *gin.Context) {
 	transactionId := c.Param("transactionId")
-	transaction, err := s.store.GetTransaction(transactionId)
+	transaction, err := s.store.GetTransaction(c.Request.Context(), transactionId)
 	if err != nil {
 		handleError(err, c)
 		return
@@ -137,12 +484,16 @@ func (s *Server) reverseTransaction(c *gin.Context) {
 	if err := c.BindJSON(&request); err != nil {
 		return
 	}
+	if err := transaction.CheckOperation(models.EventReverse); err != nil {
+		handleError(err, c)
+		return
+	}
 	if request.Amount <= 0 || request.Amount > transaction.AuthorizedAmount {
 		err := models.InvalidAmount
 		handleError(err, c)
 		return
 	}
-	if err = s.store.Reverse(transaction, request.Amount); err != nil {
+	if err = s.store.Reverse(c.Request.Context(), transaction, request.Amount); err != nil {
 		handleError(err, c)
 		return
 	}
@@ -151,24 +502,150 @@ func (s *Server) reverseTransaction(c *gin.Context) {
 
 func (s *Server) refundCapture(c *gin.Context) {
 	transactionId := c.Param("transactionId")
-	transaction, err := s.store.GetTransaction(transactionId)
+	transaction, err := s.store.GetTransaction(c.Request.Context(), transactionId)
 	if err != nil {
 		handleError(err, c)
 		return
 	}
-	var request CardRequest
+	var request RefundRequest
 	if err := c.BindJSON(&request); err != nil {
 		return
 	}
-	if request.Amount < 0 || request.Amount > transaction.CapturedAmount {
+	if err := transaction.CheckOperation(models.EventRefund); err != nil {
+		handleError(err, c)
+		return
+	}
+	if request.Amount <= 0 || request.Amount > transaction.CapturedAmount {
 		err := models.InvalidAmount
 		handleError(err, c)
 		return
 	}
-	err = s.store.Refund(transaction, request.Amount)
+	err = s.store.Refund(c.Request.Context(), transaction, request.CaptureID, request.Amount)
 	if err != nil {
 		handleError(err, c)
 		return
 	}
-	c.JSON(200, transaction)
+	s.respondWithCaptures(c, transaction)
+}
+
+func (s *Server) createTransfer(c *gin.Context) {
+	var request TransferRequest
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+	if request.Amount <= 0 {
+		err := models.InvalidAmount
+		handleError(err, c)
+		return
+	}
+	var missing []string
+	if request.FromCardID == "" {
+		missing = append(missing, "from_card_id")
+	}
+	if request.ToCardID == "" {
+		missing = append(missing, "to_card_id")
+	}
+	if len(missing) > 0 {
+		err := models.MissingTransferCard(missing...)
+		handleError(err, c)
+		return
+	}
+	if request.FromCardID == request.ToCardID {
+		err := models.InvalidTransfer
+		handleError(err, c)
+		return
+	}
+	transfer, err := s.store.Transfer(c.Request.Context(), request.FromCardID, request.ToCardID, request.Amount)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, transfer)
+}
+
+func (s *Server) getTransfer(c *gin.Context) {
+	transferId := c.Param("transferId")
+	transfer, err := s.store.GetTransfer(c.Request.Context(), transferId)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, transfer)
+}
+
+func (s *Server) reverseTransfer(c *gin.Context) {
+	transferId := c.Param("transferId")
+	transfer, err := s.store.ReverseTransfer(c.Request.Context(), transferId)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, transfer)
+}
+
+func (s *Server) listCardTransfers(c *gin.Context) {
+	cardId := c.Param("cardId")
+	limit, err := pageSize(c)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	transfers, err := s.store.ListTransfers(c.Request.Context(), cardId, c.Query("after"), limit)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.JSON(200, transfers)
+}
+
+// The limit query parameter, defaultPageSize when it's missing
+func pageSize(c *gin.Context) (int, error) {
+	value := c.Query("limit")
+	if value == "" {
+		return defaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > maxPageSize {
+		return 0, models.InvalidPagination
+	}
+	return limit, nil
+}
+
+func spendingFilter(c *gin.Context) (*models.SpendingFilter, error) {
+	limit, err := pageSize(c)
+	if err != nil {
+		return nil, err
+	}
+	filter := &models.SpendingFilter{
+		After: c.Query("after"),
+		Limit: limit,
+		Order: c.DefaultQuery("order", models.SortNewest),
+		MerchantID: c.Query("merchant_id"),
+		MCC: c.Query("mcc"),
+		Status: c.Query("status"),
+	}
+	for param, dest := range map[string]**time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := c.Query(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, models.InvalidFilter
+			}
+			// Auth times are stored in UTC, and SQLite compares them as text, so the bound must be too
+			t = t.UTC()
+			*dest = &t
+		}
+	}
+	for param, dest := range map[string]**int64{"min_amount": &filter.MinAmount, "max_amount": &filter.MaxAmount} {
+		if value := c.Query(param); value != "" {
+			amount, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, models.InvalidFilter
+			}
+			*dest = &amount
+		}
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	return filter, nil
 }
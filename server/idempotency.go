@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"prepaidcard/models"
+	"time"
+)
+
+const idempotencyHeader = "Idempotency-Key"
+
+// Keeps a copy of everything written to the response so it can be replayed later
+type recordingWriter struct {
+	gin.ResponseWriter
+	body	bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+func requestHash(c *gin.Context, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(c.Request.Method + " " + c.Request.URL.Path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Replays a stored response, or rejects the request if the key can't be used for it
+func replay(c *gin.Context, record *models.IdempotencyRecord, hash string) {
+	if record.RequestHash != hash {
+		handleError(models.IdempotencyKeyReused, c)
+		return
+	}
+	if !record.Completed() {
+		handleError(models.IdempotencyKeyInProgress, c)
+		return
+	}
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(record.StatusCode, "application/json; charset=utf-8", []byte(record.Response))
+	c.Abort()
+}
+
+/*
+	Middleware for mutating requests carrying an Idempotency-Key header
+	- A new key is claimed before the handler runs and stores its response afterwards
+	- A repeat with the same method, path and body gets the stored response back
+	- A repeat with anything different is rejected with a 422
+	Responses with a 5xx status aren't stored, so the client can retry with the same key.
+	A claim that is still in progress after IdempotencyClaimTTL was left by a request that never stored its
+	response, e.g. because the process died, and the next repeat takes it over and runs the request again.
+ */
+func (s *Server) idempotency(c *gin.Context) {
+	key := c.GetHeader(idempotencyHeader)
+	if key == "" || c.Request.Method == "GET" || c.Request.Method == "HEAD" {
+		c.Next()
+		return
+	}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		handleError(err, c)
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	hash := requestHash(c, body)
+	staleBefore := time.Now().Add(-s.idempotencyClaimTTL())
+	record, err := s.store.GetIdempotencyRecord(c.Request.Context(), key)
+	switch {
+	case err == models.NotFound:
+		record = &models.IdempotencyRecord{Key: key, RequestHash: hash}
+		if err = s.store.CreateIdempotencyRecord(c.Request.Context(), record); err != nil {
+			if existing, getErr := s.store.GetIdempotencyRecord(c.Request.Context(), key); getErr == nil {
+				replay(c, existing, hash)
+				return
+			}
+			handleError(err, c)
+			return
+		}
+	case err != nil:
+		handleError(err, c)
+		return
+	case record.RequestHash != hash || !record.Stale(staleBefore):
+		replay(c, record, hash)
+		return
+	default:
+		if err = s.store.ReclaimIdempotencyRecord(c.Request.Context(), record, staleBefore); err != nil {
+			handleError(err, c)
+			return
+		}
+		log.WithFields(log.Fields{"key": key}).Warn("took over a stale idempotency key claim")
+	}
+	writer := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	c.Next()
+	// The request's context may have run out by now, and the key must not be left claimed
+	ctx, cancel := context.WithTimeout(context.Background(), s.dbTimeout())
+	defer cancel()
+	if c.Writer.Status() >= 500 {
+		err = s.store.DeleteIdempotencyRecord(ctx, key)
+	} else {
+		record.StatusCode = c.Writer.Status()
+		record.Response = writer.body.String()
+		err = s.store.CompleteIdempotencyRecord(ctx, record)
+	}
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"key": key}).Error("failed to store idempotent response")
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"prepaidcard/datastore"
+	"prepaidcard/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sends body to the server with an Idempotency-Key header
+func callWithKey(s *Server, method string, path string, key string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(idempotencyHeader, key)
+	recorder := httptest.NewRecorder()
+	s.Router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	store := datastore.NewMemoryStore()
+	s := InitServer(store)
+	ctx := context.Background()
+	card, err := store.CreateCard(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/cards/" + card.ID
+	load := `{"amount": 1000}`
+
+	first := callWithKey(s, "POST", path, "load-1", load)
+	if first.Code != 200 {
+		t.Fatalf("load returned %d: %s", first.Code, first.Body.String())
+	}
+	// A repeat gets the stored response back without loading the card again
+	repeat := callWithKey(s, "POST", path, "load-1", load)
+	if repeat.Code != 200 || repeat.Body.String() != first.Body.String() || repeat.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("repeat returned %d %q (replayed %q), expected the first response %q", repeat.Code, repeat.Body.String(),
+			repeat.Header().Get("Idempotent-Replayed"), first.Body.String())
+	}
+	if card, err = store.GetCard(ctx, card.ID); err != nil || card.FullBalance != 1000 {
+		t.Errorf("card has %d after a load and its repeat, expected 1000: %v", card.FullBalance, err)
+	}
+
+	// The same key for a different body, or a different path, is rejected
+	if recorder := callWithKey(s, "POST", path, "load-1", `{"amount": 2000}`); recorder.Code != 422 {
+		t.Errorf("key reused for another body returned %d, expected 422", recorder.Code)
+	}
+	if recorder := callWithKey(s, "POST", "/cards/other", "load-1", load); recorder.Code != 422 {
+		t.Errorf("key reused for another path returned %d, expected 422", recorder.Code)
+	}
+
+	// A key claimed by a request still running is a 409, until the claim goes stale and is taken over
+	hash := sha256.Sum256([]byte("POST " + path + "\n" + load))
+	claim := &models.IdempotencyRecord{Key: "load-2", RequestHash: hex.EncodeToString(hash[:])}
+	if err = store.CreateIdempotencyRecord(ctx, claim); err != nil {
+		t.Fatal(err)
+	}
+	if recorder := callWithKey(s, "POST", path, "load-2", load); recorder.Code != 409 {
+		t.Errorf("key claimed by a running request returned %d, expected 409", recorder.Code)
+	}
+	s.IdempotencyClaimTTL = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if recorder := callWithKey(s, "POST", path, "load-2", load); recorder.Code != 200 {
+		t.Errorf("key with a stale claim returned %d, expected 200", recorder.Code)
+	}
+	if card, err = store.GetCard(ctx, card.ID); err != nil || card.FullBalance != 2000 {
+		t.Errorf("card has %d after the stale claim was taken over, expected 2000: %v", card.FullBalance, err)
+	}
+
+	// Reads and requests without a key aren't recorded
+	for i := 0; i < 2; i++ {
+		if recorder := callWithKey(s, "POST", path, "", load); recorder.Code != 200 {
+			t.Errorf("load without a key returned %d", recorder.Code)
+		}
+	}
+	if recorder := callWithKey(s, "GET", path, "load-1", ""); recorder.Code != 200 || recorder.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("GET with a used key returned %d (replayed %q)", recorder.Code, recorder.Header().Get("Idempotent-Replayed"))
+	}
+	if card, err = store.GetCard(ctx, card.ID); err != nil || card.FullBalance != 4000 {
+		t.Errorf("card has %d after two loads without a key, expected 4000: %v", card.FullBalance, err)
+	}
+}
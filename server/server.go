@@ -1,31 +1,94 @@
 package server
 
 import (
+	"context"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"prepaidcard/models"
+	"time"
 )
 
 type Server struct {
 	Router *gin.Engine
+	AuthExpiry models.AuthExpiryPolicy
+	PANRevealToken string
+	// How long a request's database work may take, DefaultDBTimeout when zero
+	DBTimeout time.Duration
+	// How long an idempotency key stays claimed by a request that never finishes, DefaultIdempotencyClaimTTL when zero
+	IdempotencyClaimTTL time.Duration
 	store models.CardStore
 }
 
+const (
+	DefaultDBTimeout = 5 * time.Second
+	DefaultIdempotencyClaimTTL = time.Minute
+)
+
+func (s *Server) dbTimeout() time.Duration {
+	if s.DBTimeout > 0 {
+		return s.DBTimeout
+	}
+	return DefaultDBTimeout
+}
+
+func (s *Server) idempotencyClaimTTL() time.Duration {
+	if s.IdempotencyClaimTTL > 0 {
+		return s.IdempotencyClaimTTL
+	}
+	return DefaultIdempotencyClaimTTL
+}
+
+// Gives each request a deadline, which the store methods it calls run under
+func (s *Server) withTimeout(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), s.dbTimeout())
+	defer cancel()
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
+
 func handlePing(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"hello": "world!"})
 }
 
 func (s *Server) bindHandlers() {
 	router := s.Router
+	router.Use(s.withTimeout, s.idempotency)
 	router.GET("/", handlePing)
 	router.POST("/cards", s.createCard)
 	router.GET("/cards/:cardId", s.getCard)
+	router.GET("/cards/:cardId/pan", s.revealCardNumber)
 	router.GET("cards/:cardId/spending", s.listSpending)
 	router.POST("/cards/:cardId", s.loadCard)
+	router.PATCH("/cards/:cardId/freeze", s.setCardStatus(models.CardFrozen))
+	router.PATCH("/cards/:cardId/unfreeze", s.setCardStatus(models.CardActive))
+	router.PATCH("/cards/:cardId/block", s.setCardStatus(models.CardBlocked))
+	router.PATCH("/cards/:cardId/close", s.setCardStatus(models.CardClosed))
+	router.GET("/cards/:cardId/limits", s.listCardLimits)
+	router.POST("/cards/:cardId/limits", s.createCardLimit)
+	router.GET("/cards/:cardId/limits/:limitId", s.getCardLimit)
+	router.PATCH("/cards/:cardId/limits/:limitId", s.updateCardLimit)
+	router.DELETE("/cards/:cardId/limits/:limitId", s.deleteCardLimit)
+	router.GET("/cards/:cardId/restrictions", s.getCardRestrictions)
+	router.PUT("/cards/:cardId/restrictions", s.setCardRestrictions)
+	router.GET("/cards/:cardId/ledger", s.getCardLedger)
+	router.GET("/cards/:cardId/transfers", s.listCardTransfers)
+	router.GET("/ledger/balances", s.getLedgerBalances)
+	router.GET("/mccs", listMCCs)
+	router.GET("/merchants", s.listMerchants)
+	router.POST("/merchants", s.createMerchant)
+	router.GET("/merchants/:merchantId", s.getMerchant)
+	router.PATCH("/merchants/:merchantId", s.updateMerchant)
+	router.DELETE("/merchants/:merchantId", s.deleteMerchant)
 	router.POST("/transactions", s.authRequest)
+	router.GET("/transactions/:transactionId/events", s.listTransactionEvents)
+	router.GET("/transactions/:transactionId/captures", s.listCaptures)
+	router.PATCH("/transactions/:transactionId/increment", s.incrementTransaction)
 	router.PATCH("/transactions/:transactionId/capture", s.captureTransaction)
 	router.PATCH("/transactions/:transactionId/reverse", s.reverseTransaction)
 	router.PATCH("/transactions/:transactionId/refund", s.refundCapture)
+	router.POST("/transfers", s.createTransfer)
+	router.GET("/transfers/:transferId", s.getTransfer)
+	router.PATCH("/transfers/:transferId/reverse", s.reverseTransfer)
 }
 
 func InitServer(store models.CardStore) *Server {
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http/httptest"
+	"prepaidcard/datastore"
+	"prepaidcard/models"
+	"testing"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// Sends a request to the server and decodes the JSON response into out, failing the test unless it has the wanted status
+func call(t *testing.T, s *Server, method string, path string, body interface{}, status int, out interface{}) {
+	t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	request := httptest.NewRequest(method, path, &payload)
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	s.Router.ServeHTTP(recorder, request)
+	if recorder.Code != status {
+		t.Fatalf("%s %s returned %d, expected %d: %s", method, path, recorder.Code, status, recorder.Body.String())
+	}
+	if out != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decoding %s: %v", method, path, recorder.Body.String(), err)
+		}
+	}
+}
+
+// Runs a card through load, auth, capture, reverse and refund over HTTP against the memory store
+func TestCardLifecycle(t *testing.T) {
+	store := datastore.NewMemoryStore()
+	merchant, err := store.CreateMerchant(context.Background(), &models.Merchant{ID: "corner-shop", Name: "Corner Shop", MCC: "5411", Address: "High Street"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := InitServer(store)
+
+	var card models.PrepaidCard
+	call(t, s, "POST", "/cards", gin.H{}, 200, &card)
+	call(t, s, "POST", "/cards/" + card.ID, gin.H{"amount": 10000}, 200, &card)
+
+	var transaction models.Transaction
+	call(t, s, "POST", "/transactions", gin.H{"merchant_id": merchant.ID, "card_id": card.ID, "amount": 3000}, 200, &transaction)
+	call(t, s, "PATCH", "/transactions/" + transaction.ID + "/capture", gin.H{"amount": 2000}, 200, &transaction)
+	call(t, s, "PATCH", "/transactions/" + transaction.ID + "/reverse", gin.H{"amount": 1000}, 200, &transaction)
+	call(t, s, "PATCH", "/transactions/" + transaction.ID + "/refund", gin.H{"amount": 500}, 200, &transaction)
+	call(t, s, "PATCH", "/transactions/" + transaction.ID + "/refund", gin.H{"amount": 0}, 400, nil)
+	if transaction.AuthorizedAmount != 0 || transaction.CapturedAmount != 1500 {
+		t.Errorf("transaction has authorized %d captured %d, expected 0 and 1500", transaction.AuthorizedAmount, transaction.CapturedAmount)
+	}
+
+	call(t, s, "GET", "/cards/" + card.ID, nil, 200, &card)
+	if card.FullBalance != 8500 || card.BlockedBalance != 0 {
+		t.Errorf("card has full %d blocked %d, expected 8500 and 0", card.FullBalance, card.BlockedBalance)
+	}
+}
+
+// A transfer missing card ids is a 400 naming each missing field
+func TestTransferNamesMissingCards(t *testing.T) {
+	s := InitServer(datastore.NewMemoryStore())
+	cases := []struct {
+		body	gin.H
+		details	string
+	}{
+		{gin.H{"to_card_id": "card", "amount": 100}, "invalid transfer, from_card_id is required\n"},
+		{gin.H{"from_card_id": "card", "amount": 100}, "invalid transfer, to_card_id is required\n"},
+		{gin.H{"amount": 100}, "invalid transfer, from_card_id and to_card_id are required\n"},
+	}
+	for _, c := range cases {
+		var response struct {
+			Details	string	`json:"details"`
+		}
+		call(t, s, "POST", "/transfers", c.body, 400, &response)
+		if response.Details != c.details {
+			t.Errorf("transfer with %v failed with %q, expected %q", c.body, response.Details, c.details)
+		}
+	}
+}
+
+// Invalid spending query parameters are a 400 before the store is asked
+func TestSpendingQueryValidation(t *testing.T) {
+	store := datastore.NewMemoryStore()
+	card, err := store.CreateCard(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := InitServer(store)
+	path := "/cards/" + card.ID + "/spending"
+	invalid := []string{
+		"limit=0", "limit=501", "limit=ten", "order=sideways", "from=yesterday",
+		"from=2018-10-02T00:00:00Z&to=2018-10-01T00:00:00Z", "mcc=0000", "status=settled",
+		"min_amount=-1", "max_amount=lots", "min_amount=500&max_amount=100",
+	}
+	for _, query := range invalid {
+		call(t, s, "GET", path + "?" + query, nil, 400, nil)
+	}
+	var list models.SpendingList
+	call(t, s, "GET", path + "?limit=500&order=asc&from=2018-10-01T09:00:00%2B09:00&mcc=groceries&status=pending&min_amount=0", nil, 200, &list)
+}
@@ -0,0 +1,62 @@
+package worker
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"prepaidcard/models"
+	"time"
+)
+
+// Periodically releases the blocked funds of auths that were never captured or reversed
+type ExpiryWorker struct {
+	store		models.CardStore
+	interval	time.Duration
+	ctx			context.Context
+	cancel		context.CancelFunc
+	done		chan struct{}
+}
+
+func NewExpiryWorker(store models.CardStore, interval time.Duration) *ExpiryWorker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ExpiryWorker{
+		store: store,
+		interval: interval,
+		ctx: ctx,
+		cancel: cancel,
+		done: make(chan struct{}),
+	}
+}
+
+func (w *ExpiryWorker) Start() {
+	go w.run()
+}
+
+// Stops the worker, cancelling any sweep in progress, and waits for it to finish
+func (w *ExpiryWorker) Stop() {
+	w.cancel()
+	<-w.done
+}
+
+func (w *ExpiryWorker) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		w.sweep()
+		select {
+		case <-ticker.C:
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *ExpiryWorker) sweep() {
+	expired, err := w.store.ExpireAuths(w.ctx, time.Now())
+	if err != nil && w.ctx.Err() == nil {
+		log.WithError(err).Error("failed to expire auths")
+	}
+	if expired > 0 {
+		log.WithFields(log.Fields{"count": expired}).Info("expired auths")
+	}
+}
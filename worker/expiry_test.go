@@ -0,0 +1,76 @@
+package worker
+
+import (
+	"context"
+	"prepaidcard/datastore"
+	"prepaidcard/models"
+	"testing"
+	"time"
+)
+
+// The worker sweeps on start and on every tick, and Stop waits for it to finish
+func TestExpiryWorker(t *testing.T) {
+	store := datastore.NewMemoryStore()
+	ctx := context.Background()
+	card, err := store.CreateCard(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.LoadCard(ctx, card.ID, 10000); err != nil {
+		t.Fatal(err)
+	}
+	merchant, err := store.CreateMerchant(ctx, &models.Merchant{Name: "Corner Shop", MCC: "5411", Address: "High Street"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := store.Auth(ctx, card, merchant, 1000, "", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiring, err := store.Auth(ctx, card, merchant, 500, "", time.Now().Add(50 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewExpiryWorker(store, 10 * time.Millisecond)
+	w.Start()
+	defer w.Stop()
+	for _, transaction := range []*models.Transaction{expired, expiring} {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			stored, err := store.GetTransaction(ctx, transaction.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status == models.TransactionExpired {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("auth of %d is still %s", transaction.OriginalAmount, stored.Status)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	card, err = store.GetCard(ctx, card.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.FullBalance != 10000 || card.BlockedBalance != 0 {
+		t.Errorf("card has full %d blocked %d, expected 10000 and 0", card.FullBalance, card.BlockedBalance)
+	}
+}
+
+func TestExpiryWorkerStop(t *testing.T) {
+	w := NewExpiryWorker(datastore.NewMemoryStore(), time.Hour)
+	w.Start()
+	stopped := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker didn't stop")
+	}
+}